@@ -2,23 +2,37 @@ package main
 
 import (
 	"code-runner/internal/api"
+	"code-runner/internal/cache"
 	"code-runner/internal/config"
 	"code-runner/internal/database"
 	"code-runner/internal/file"
+	"code-runner/internal/images"
+	"code-runner/internal/metrics"
 	"code-runner/internal/queue"
 	"code-runner/internal/sandbox"
 	"code-runner/internal/sandbox/docker"
+	"code-runner/internal/sandbox/native"
+	"code-runner/internal/sandbox/wasm"
 	"code-runner/internal/spec"
 	"code-runner/internal/worker"
 	"code-runner/internal/util"
+	"code-runner/pkg/models"
+	"flag"
 	"github.com/joho/godotenv"
 	"github.com/zekrotja/rogu/log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 func main() {
+	// Returns immediately unless this process is the init of a native sandbox
+	native.Init()
+
+	role := flag.String("role", "", "process role: api, worker or all (overrides RUNNER_ROLE)")
+	flag.Parse()
+
 	godotenv.Load()
 
 	// Add in-memory logger for Admin Portal
@@ -29,6 +43,12 @@ func main() {
 	if err := cfg.Load(); err != nil {
 		log.Fatal().Err(err).Msg("Failed to load config")
 	}
+	if *role != "" {
+		cfg.SetRole(*role)
+		if err := cfg.Validate(); err != nil {
+			log.Fatal().Err(err).Msg("Invalid role")
+		}
+	}
 
 	// 2. Database
 	db, err := database.NewPostgresDB(cfg.Config().Database.DSN)
@@ -41,29 +61,167 @@ func main() {
 	q := queue.NewRedisQueue(cfg.Config().Redis.Addr, cfg.Config().Redis.Pwd)
 	log.Info().Msg("Connected to Redis")
 
+	var verdictCache *cache.RedisVerdictCache
+	if cfg.Config().Cache.Enabled {
+		verdictCache = cache.NewRedisVerdictCache(cfg.Config().Redis.Addr, cfg.Config().Redis.Pwd,
+			time.Duration(cfg.Config().Cache.TTLSeconds)*time.Second)
+	}
+
 	// 4. Specs
 	specProvider := spec.NewFileProvider("spec/spec.yaml")
 
-	// 5. Docker Sandbox
-	sandboxProvider, err := docker.NewProvider(cfg)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to init docker")
+	// 5. Worker tier (Docker, Sandbox Manager, Auto-Scaling Worker Pool)
+	var workers *workerTier
+	if cfg.Config().RunsWorker() {
+		workers = startWorkers(cfg, specProvider, q, db, verdictCache)
+	}
+
+	// 6. API tier (Producer)
+	var webApi api.API
+	if cfg.Config().RunsAPI() {
+		webApi = startAPI(cfg, specProvider, q, db, verdictCache)
+	}
+
+	log.Info().Msgf("Code Runner Started (role: %s)", cfg.Config().Role)
+
+	// Graceful Shutdown
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
+	<-sc
+
+	grace := time.Duration(cfg.Config().Shutdown.GraceSeconds) * time.Second
+	log.Info().Msgf("Shutting down (grace period %s)", grace)
+	// both steps share the grace period
+	deadline := time.Now().Add(grace)
+
+	// 1. stop accepting new HTTP requests
+	if webApi != nil {
+		if err := webApi.Shutdown(time.Until(deadline)); err != nil {
+			log.Error().Err(err).Msg("Failed to shut down API")
+		}
+	}
+
+	// 2. stop dequeuing, drain in-flight jobs and requeue the rest
+	if workers != nil {
+		workers.Shutdown(time.Until(deadline))
+	}
+
+	log.Info().Msg("Shutdown complete")
+}
+
+type workerTier struct {
+	pool     *worker.Pool
+	mgr      *sandbox.Manager
+	sweeper  *worker.Sweeper
+	reaper   *worker.Reaper
+	images   *images.Service
+	docker   *docker.Provider
+	wasm     *wasm.Provider
+}
+
+func (t *workerTier) Shutdown(grace time.Duration) {
+	t.sweeper.Stop()
+	t.images.Stop()
+	t.pool.Shutdown(grace)
+	t.mgr.Cleanup()
+	t.reaper.Stop()
+	if t.docker != nil {
+		t.docker.Close()
+	}
+	if t.wasm != nil {
+		t.wasm.Close()
+	}
+}
+
+func startWorkers(cfg *config.EnvProvider, sp *spec.BaseProvider, q queue.Queue, db database.Database, vc *cache.RedisVerdictCache) *workerTier {
+	// only connect to the backends which are used by a spec
+	providers := map[string]sandbox.Provider{}
+	var dockerProvider *docker.Provider
+	var wasmProvider *wasm.Provider
+	for _, s := range sp.All() {
+		if _, ok := providers[s.GetBackend()]; ok {
+			continue
+		}
+		switch s.GetBackend() {
+		case models.BackendDocker:
+			p, err := docker.NewProvider(cfg)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to init docker")
+			}
+			p.StartWarmPool(specsFor(sp, models.BackendDocker))
+			providers[models.BackendDocker], dockerProvider = p, p
+		case models.BackendNative:
+			p, err := native.NewProvider(cfg)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to init native sandbox")
+			}
+			providers[models.BackendNative] = p
+		case models.BackendWasm:
+			p, err := wasm.NewProvider(cfg)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to init wasm runtime")
+			}
+			providers[models.BackendWasm], wasmProvider = p, p
+		}
 	}
 
-	// 6. Sandbox Manager
 	fileProvider := file.NewLocalFileProvider()
-	mgr, err := sandbox.NewManager(sandboxProvider, specProvider, fileProvider, cfg)
+	mgr, err := sandbox.NewManager(providers, sp, fileProvider, cfg)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to create manager")
 	}
-	defer mgr.Cleanup()
 
-	// 7. Start Auto-Scaling Worker Pool
-	pool := worker.NewPool(cfg, q, db, mgr)
+	// pre-pull the images and report their status to the API
+	imageService := images.NewService(cfg, mgr)
+	imageService.Start()
+
+	// workers only take jobs once the images are there, otherwise the first
+	// jobs of a language would wait for its pull and time out
+	timeout := time.Duration(cfg.Config().Images.PrePullTimeoutSeconds) * time.Second
+	select {
+	case <-imageService.Ready():
+	case <-time.After(timeout):
+		log.Warn().Msgf("Images were not pre-pulled within %s, starting workers anyway", timeout)
+	}
+
+	pool, err := worker.NewPool(cfg, q, db, mgr, vc)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to create worker pool")
+	}
 	pool.Start()
 
-	// 8. Start API Server (Producer)
-	webApi, err := api.NewRestAPI(cfg, specProvider, q, db)
+	sweeper := worker.NewSweeper(cfg, q, db)
+	sweeper.Start()
+
+	// removes containers and workspaces left behind by crashed instances
+	reaper := worker.NewReaper(cfg, q, mgr)
+	reaper.Start()
+
+	// The API serves metrics itself, worker-only processes need their own listener
+	if addr := cfg.Config().Metrics.BindAddress; addr != "" && !cfg.Config().RunsAPI() {
+		go func() {
+			if err := metrics.ListenAndServeBlocking(addr); err != nil {
+				log.Error().Err(err).Msg("Metrics listener failed")
+			}
+		}()
+	}
+
+	log.Info().Msgf("Worker Pool started. Workers: Min=%d, Max=%d", cfg.Config().Worker.Min, cfg.Config().Worker.Max)
+	return &workerTier{pool: pool, mgr: mgr, sweeper: sweeper, reaper: reaper, images: imageService, docker: dockerProvider, wasm: wasmProvider}
+}
+
+func specsFor(sp *spec.BaseProvider, backend string) []models.Spec {
+	var specs []models.Spec
+	for _, s := range sp.All() {
+		if s.GetBackend() == backend {
+			specs = append(specs, s)
+		}
+	}
+	return specs
+}
+
+func startAPI(cfg *config.EnvProvider, sp *spec.BaseProvider, q queue.Queue, db database.Database, vc *cache.RedisVerdictCache) api.API {
+	webApi, err := api.NewRestAPI(cfg, sp, q, db, vc, images.NewClient(cfg))
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to create API")
 	}
@@ -74,11 +232,6 @@ func main() {
 		}
 	}()
 
-	log.Info().Msgf("Code Runner Started on port %s. Workers: Min=%d, Max=%d", 
-		cfg.Config().API.BindAddress, cfg.Config().Worker.Min, cfg.Config().Worker.Max)
-
-	// Graceful Shutdown
-	sc := make(chan os.Signal, 1)
-	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt, os.Kill)
-	<-sc
-}
\ No newline at end of file
+	log.Info().Msgf("API listening on %s", cfg.Config().API.BindAddress)
+	return webApi
+}
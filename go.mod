@@ -10,7 +10,9 @@ require (
 	github.com/lib/pq v1.10.9
 	github.com/redis/go-redis/v9 v9.5.1
 	github.com/rs/xid v1.5.0
+	github.com/tetratelabs/wazero v1.8.2
 	github.com/zekrotja/rogu v0.8.0
+	golang.org/x/sys v0.18.0
 )
 
 require (
@@ -48,7 +50,6 @@ require (
 	github.com/valyala/fasthttp v1.51.0 // indirect
 	github.com/valyala/tcplisten v1.0.0 // indirect
 	golang.org/x/mod v0.8.0 // indirect
-	golang.org/x/sys v0.18.0 // indirect
 	golang.org/x/tools v0.6.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
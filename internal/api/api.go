@@ -1,5 +1,8 @@
 package api
 
+import "time"
+
 type API interface {
 	ListenAndServeBlocking() error
+	Shutdown(timeout time.Duration) error
 }
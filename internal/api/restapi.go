@@ -2,12 +2,17 @@ package api
 
 import (
 	v1 "code-runner/internal/api/v1"
+	"code-runner/internal/cache"
 	"code-runner/internal/config"
 	"code-runner/internal/database"
+	"code-runner/internal/images"
 	"code-runner/internal/queue"
 	"code-runner/internal/spec"
+	"code-runner/pkg/models"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/gofiber/fiber/v2/middleware/expvar"
+	"time"
 )
 
 type RestAPI struct {
@@ -15,13 +20,15 @@ type RestAPI struct {
 	app         *fiber.App
 }
 
-func NewRestAPI(cfg *config.EnvProvider, sp *spec.BaseProvider, q *queue.RedisQueue, db *database.PostgresDB) (*RestAPI, error) {
+func NewRestAPI(cfg *config.EnvProvider, sp *spec.BaseProvider, q queue.Queue, db database.Database, vc *cache.RedisVerdictCache, img *images.Client) (*RestAPI, error) {
 	r := &RestAPI{
 		bindAddress: cfg.Config().API.BindAddress,
 	}
 
 	r.app = fiber.New(fiber.Config{
 		DisableStartupMessage: true,
+		// leaves room for the encoding overhead of files and stdin at their limits
+		BodyLimit: 3 * models.MaxFilesBytes,
 	})
 
 	r.app.Use(cors.New(cors.Config{
@@ -29,16 +36,31 @@ func NewRestAPI(cfg *config.EnvProvider, sp *spec.BaseProvider, q *queue.RedisQu
 		AllowHeaders: "Origin, Content-Type, Accept",
 	}))
 
+	// exposes engine metrics at /debug/vars
+	r.app.Use(expvar.New())
+
 	// changed to Serve index.html on localhost 8080 and it accesses the server from v1
 	r.app.Get("/", func(c *fiber.Ctx) error {
 		return c.SendFile("./index.html")
 	})
 
-	v1.Setup(r.app.Group("/v1"), cfg, sp, q, db)
+	v1.Setup(r.app.Group("/v1"), cfg, sp, q, db, vc, img)
 
 	return r, nil
 }
 
 func (r *RestAPI) ListenAndServeBlocking() error {
 	return r.app.Listen(r.bindAddress)
-}
\ No newline at end of file
+}
+
+// App returns the underlying fiber app, e.g. to serve requests in-process
+// with App().Test.
+func (r *RestAPI) App() *fiber.App {
+	return r.app
+}
+
+// Shutdown stops accepting new connections and waits up to timeout for
+// in-flight requests to complete.
+func (r *RestAPI) Shutdown(timeout time.Duration) error {
+	return r.app.ShutdownWithTimeout(timeout)
+}
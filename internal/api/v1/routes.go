@@ -1,17 +1,26 @@
 package v1
 
 import (
+	"code-runner/internal/cache"
 	"code-runner/internal/config"
 	"code-runner/internal/database"
+	"code-runner/internal/file"
+	"code-runner/internal/images"
 	"code-runner/internal/queue"
 	"code-runner/internal/spec"
+	"code-runner/internal/starter"
 	"code-runner/internal/util"
 	"code-runner/pkg/models"
+	"errors"
+	"fmt"
 	"github.com/gofiber/fiber/v2"
 	"github.com/rs/xid"
+	"github.com/zekrotja/rogu/log"
+	"io"
+	"mime/multipart"
 )
 
-func Setup(router fiber.Router, cfg *config.EnvProvider, sp *spec.BaseProvider, q *queue.RedisQueue, db *database.PostgresDB) {
+func Setup(router fiber.Router, cfg *config.EnvProvider, sp *spec.BaseProvider, q queue.Queue, db database.Database, vc *cache.RedisVerdictCache, img *images.Client) {
 	
 	router.Get("/spec", func(c *fiber.Ctx) error {
 		return c.JSON(sp.Spec())
@@ -22,6 +31,9 @@ func Setup(router fiber.Router, cfg *config.EnvProvider, sp *spec.BaseProvider,
 		if err != nil {
 			return c.Status(500).JSON(models.ErrorModel{Error: err.Error()})
 		}
+		for i := range questions {
+			questions[i] = questions[i].Public()
+		}
 		return c.JSON(questions)
 	})
 
@@ -31,6 +43,16 @@ func Setup(router fiber.Router, cfg *config.EnvProvider, sp *spec.BaseProvider,
 		if err != nil {
 			return c.Status(404).JSON(models.ErrorModel{Error: "Question not found"})
 		}
+		q.StarterCode = starter.ForQuestion(q, sp.Spec())
+		return c.JSON(q.Public())
+	})
+
+	// the full question, as edited by the instructor and replaced by PUT
+	router.Get("/admin/questions/:id", func(c *fiber.Ctx) error {
+		q, err := db.GetQuestion(c.Params("id"))
+		if err != nil {
+			return c.Status(404).JSON(models.ErrorModel{Error: "Question not found"})
+		}
 		return c.JSON(q)
 	})
 
@@ -39,6 +61,15 @@ func Setup(router fiber.Router, cfg *config.EnvProvider, sp *spec.BaseProvider,
 		if err := c.BodyParser(&q); err != nil {
 			return c.Status(400).JSON(models.ErrorModel{Error: "Invalid JSON"})
 		}
+		if err := validateGrading(&q); err != nil {
+			return c.Status(400).JSON(models.ErrorModel{Error: err.Error()})
+		}
+		if err := checkStarterCode(sp, &q); err != nil {
+			return c.Status(400).JSON(models.ErrorModel{Error: err.Error()})
+		}
+		if err := checkLimits(sp, &q); err != nil {
+			return c.Status(400).JSON(models.ErrorModel{Error: err.Error()})
+		}
 		if q.ID == "" {
 			q.ID = xid.New().String()
 		}
@@ -54,9 +85,19 @@ func Setup(router fiber.Router, cfg *config.EnvProvider, sp *spec.BaseProvider,
 			return c.Status(400).JSON(models.ErrorModel{Error: "Invalid JSON"})
 		}
 		q.ID = c.Params("id")
+		if err := validateGrading(&q); err != nil {
+			return c.Status(400).JSON(models.ErrorModel{Error: err.Error()})
+		}
+		if err := checkStarterCode(sp, &q); err != nil {
+			return c.Status(400).JSON(models.ErrorModel{Error: err.Error()})
+		}
+		if err := checkLimits(sp, &q); err != nil {
+			return c.Status(400).JSON(models.ErrorModel{Error: err.Error()})
+		}
 		if err := db.UpdateQuestion(&q); err != nil {
 			return c.Status(500).JSON(models.ErrorModel{Error: err.Error()})
 		}
+		invalidateVerdicts(vc, q.ID)
 		return c.JSON(q)
 	})
 
@@ -64,6 +105,7 @@ func Setup(router fiber.Router, cfg *config.EnvProvider, sp *spec.BaseProvider,
 		if err := db.DeleteQuestion(c.Params("id")); err != nil {
 			return c.Status(500).JSON(models.ErrorModel{Error: err.Error()})
 		}
+		invalidateVerdicts(vc, c.Params("id"))
 		return c.JSON(fiber.Map{"success": true})
 	})
 
@@ -125,6 +167,78 @@ func Setup(router fiber.Router, cfg *config.EnvProvider, sp *spec.BaseProvider,
 		return c.JSON(fiber.Map{"submission_id": id})
 	})
 
+	// Rejudges a judged submission in place, skipping the verdict cache.
+	// Its new verdict replaces the cached one.
+	router.Post("/admin/submissions/:id/rejudge", func(c *fiber.Ctx) error {
+		old, err := db.GetSubmission(c.Params("id"))
+		if err != nil {
+			return c.Status(404).JSON(models.ErrorModel{Error: "Not found"})
+		}
+		// generation runs do not store their inputs and cannot be repeated
+		if old.IsAdmin {
+			return c.Status(400).JSON(models.ErrorModel{Error: "Admin generation runs cannot be rejudged"})
+		}
+		reset, err := db.ResetSubmission(old.ID)
+		if err != nil {
+			return c.Status(500).JSON(models.ErrorModel{Error: "Database Error"})
+		}
+		if !reset {
+			return c.Status(409).JSON(models.ErrorModel{Error: "Only judged submissions can be rejudged"})
+		}
+		payload := models.JobPayload{
+			SubmissionID: old.ID,
+			Language:     old.Language,
+			Code:         old.Code,
+			QuestionID:   old.QuestionID,
+			BypassCache:  true,
+			Playground:   old.Playground,
+			Files:        old.Files,
+			Arguments:    old.Arguments,
+			Environment:  old.Environment,
+			Stdin:        old.Stdin,
+		}
+		if err := q.Enqueue(payload); err != nil {
+			db.MarkFailed(old.ID, "ERROR", "Failed to enqueue the rejudge.")
+			return c.Status(500).JSON(models.ErrorModel{Error: "Queue Error"})
+		}
+		return c.JSON(models.ExecutionResponse{
+			SubmissionID: old.ID,
+			Status:       "PENDING",
+		})
+	})
+
+	router.Get("/admin/images", func(c *fiber.Ctx) error {
+		if img == nil {
+			return c.Status(503).JSON(models.ErrorModel{Error: "Image status is not available"})
+		}
+		statuses, err := img.Statuses()
+		if err != nil {
+			return c.Status(500).JSON(models.ErrorModel{Error: err.Error()})
+		}
+		return c.JSON(statuses)
+	})
+
+	router.Post("/admin/images/pull", func(c *fiber.Ctx) error {
+		if img == nil {
+			return c.Status(503).JSON(models.ErrorModel{Error: "Image status is not available"})
+		}
+		var req struct {
+			Language string `json:"language"`
+		}
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&req); err != nil {
+				return c.Status(400).JSON(models.ErrorModel{Error: "Invalid JSON"})
+			}
+		}
+		if req.Language != "" && !hasLanguage(sp, req.Language) {
+			return c.Status(400).JSON(models.ErrorModel{Error: "Unsupported language"})
+		}
+		if err := img.RequestPull(req.Language); err != nil {
+			return c.Status(500).JSON(models.ErrorModel{Error: err.Error()})
+		}
+		return c.Status(202).JSON(fiber.Map{"success": true})
+	})
+
 	router.Get("/admin/logs", func(c *fiber.Ctx) error {
 		return c.JSON(util.GlobalRingLogger.GetLogs())
 	})
@@ -145,11 +259,68 @@ func Setup(router fiber.Router, cfg *config.EnvProvider, sp *spec.BaseProvider,
 		return c.JSON(sub)
 	})
 
+	// Cancels a submission. A waiting job is taken out of the queue, the
+	// sandbox of a running job is killed by the worker process owning it.
+	router.Delete("/submissions/:id", func(c *fiber.Ctx) error {
+		id := c.Params("id")
+		sub, err := db.GetSubmission(id)
+		if err != nil {
+			return c.Status(404).JSON(models.ErrorModel{Error: "Not found"})
+		}
+		if sub.Status != "PENDING" && sub.Status != "RUNNING" {
+			return c.Status(409).JSON(models.ErrorModel{Error: "Submission has already finished"})
+		}
+
+		// flag first, so a worker picking the job up concurrently skips it
+		if err := q.Cancel(id); err != nil {
+			return c.Status(500).JSON(models.ErrorModel{Error: "Queue Error"})
+		}
+		removed, err := q.Remove(id)
+		if err != nil {
+			log.Error().Err(err).Field("job_id", id).Msg("Failed to remove cancelled job from queue")
+		}
+		if removed {
+			q.Complete(id)
+		}
+		ok, err := db.MarkCancelled(id)
+		if err != nil {
+			return c.Status(500).JSON(models.ErrorModel{Error: "Database Error"})
+		}
+		if !ok {
+			return c.Status(409).JSON(models.ErrorModel{Error: "Submission has already finished"})
+		}
+
+		return c.JSON(models.ExecutionResponse{
+			SubmissionID: id,
+			Status:       "CANCELLED",
+		})
+	})
+
 	router.Post("/exec", func(c *fiber.Ctx) error {
 		req := new(models.ExecutionRequest)
 		if err := c.BodyParser(req); err != nil {
 			return c.Status(400).JSON(models.ErrorModel{Error: "Invalid JSON"})
 		}
+		// multipart requests may upload the files as an archive
+		if fh, err := c.FormFile("archive"); err == nil {
+			if len(req.Files) > 0 {
+				return c.Status(400).JSON(models.ErrorModel{Error: "files and archive may not be combined"})
+			}
+			if req.Files, err = readArchive(fh); err != nil {
+				return c.Status(400).JSON(models.ErrorModel{Error: err.Error()})
+			}
+		}
+		if err := req.ValidateInputs(); err != nil {
+			return c.Status(400).JSON(models.ErrorModel{Error: err.Error()})
+		}
+		if err := req.ValidateFiles(); err != nil {
+			return c.Status(400).JSON(models.ErrorModel{Error: err.Error()})
+		}
+		if s, ok := sp.Get(req.Language); ok && req.QuestionID == "" {
+			if err := checkEntryFile(req, s.FileName); err != nil {
+				return c.Status(400).JSON(models.ErrorModel{Error: err.Error()})
+			}
+		}
 
 		id := xid.New().String()
 
@@ -159,6 +330,13 @@ func Setup(router fiber.Router, cfg *config.EnvProvider, sp *spec.BaseProvider,
 			Code:       req.Code,
 			QuestionID: req.QuestionID,
 			Status:     "PENDING",
+			// without a question the code runs as-is
+			Playground: req.QuestionID == "",
+			Files:      req.Files,
+			// kept to rebuild the job, e.g. when it gets lost
+			Arguments:   req.Arguments,
+			Environment: req.Environment,
+			Stdin:       req.Stdin,
 		}
 
 		if err := db.CreateSubmission(sub); err != nil {
@@ -170,6 +348,11 @@ func Setup(router fiber.Router, cfg *config.EnvProvider, sp *spec.BaseProvider,
 			Language:     req.Language,
 			Code:         req.Code,
 			QuestionID:   req.QuestionID,
+			Arguments:    req.Arguments,
+			Environment:  req.Environment,
+			Stdin:        req.Stdin,
+			Playground:   sub.Playground,
+			Files:        req.Files,
 		}
 
 		if err := q.Enqueue(payload); err != nil {
@@ -181,4 +364,116 @@ func Setup(router fiber.Router, cfg *config.EnvProvider, sp *spec.BaseProvider,
 			Status:       "PENDING",
 		})
 	})
-}
\ No newline at end of file
+}
+
+func invalidateVerdicts(vc *cache.RedisVerdictCache, questionID string) {
+	if vc == nil {
+		return
+	}
+	if err := vc.InvalidateQuestion(questionID); err != nil {
+		log.Error().Err(err).Field("question_id", questionID).Msg("Failed to invalidate verdict cache")
+	}
+}
+
+// validateGrading checks the project, unit tests, SQL setup or scoring of a
+// question, at most one of which may replace the test cases, and the
+// signature the test cases are called with.
+func validateGrading(q *models.Question) error {
+	n := 0
+	for _, set := range []bool{q.Project != nil, q.UnitTests != nil, q.SQL != nil, q.Scoring != nil} {
+		if set {
+			n++
+		}
+	}
+	if n > 1 {
+		return errors.New("a question may only be one of a project, unit tests, sql or scored")
+	}
+	if q.Signature != nil {
+		if q.Project != nil || q.UnitTests != nil || q.SQL != nil {
+			return errors.New("only questions with test cases may have a signature")
+		}
+		if err := q.Signature.Validate(q.TestCases); err != nil {
+			return err
+		}
+	}
+	switch {
+	case q.Project != nil:
+		return q.Project.Validate()
+	case q.UnitTests != nil:
+		return q.UnitTests.Validate()
+	case q.SQL != nil:
+		return q.SQL.Validate()
+	case q.Scoring != nil:
+		return q.Scoring.Validate(q.TestCases)
+	}
+	return nil
+}
+
+// checkStarterCode makes sure starter code is only given for languages of
+// the spec and drops the code equal to the generated one.
+func checkStarterCode(sp *spec.BaseProvider, q *models.Question) error {
+	for lang := range q.StarterCode {
+		if _, ok := sp.Get(lang); !ok {
+			return fmt.Errorf("starter code for unknown language %s", lang)
+		}
+	}
+	q.StarterCode = starter.Customized(q)
+	return nil
+}
+
+// checkLimits validates the limits of the question, multipliers may only
+// be given for languages of the spec.
+func checkLimits(sp *spec.BaseProvider, q *models.Question) error {
+	if q.Limits == nil {
+		return nil
+	}
+	for lang := range q.Limits.Multipliers {
+		if _, ok := sp.Get(lang); !ok {
+			return fmt.Errorf("limit multiplier for unknown language %s", lang)
+		}
+	}
+	return q.Limits.Validate()
+}
+
+// readArchive extracts an uploaded zip or tar archive within the file limits.
+func readArchive(fh *multipart.FileHeader) (map[string]string, error) {
+	if fh.Size > models.MaxFilesBytes {
+		return nil, fmt.Errorf("archive may not exceed %d bytes", models.MaxFilesBytes)
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, models.MaxFilesBytes))
+	if err != nil {
+		return nil, err
+	}
+	return file.ReadArchive(data, models.MaxFiles, models.MaxFilesBytes)
+}
+
+// checkEntryFile makes sure a playground run has the file the language
+// executes, either as code or among the files.
+func checkEntryFile(req *models.ExecutionRequest, entry string) error {
+	_, ok := req.Files[entry]
+	if req.Code != "" && ok {
+		return fmt.Errorf("code and file %s may not be combined", entry)
+	}
+	if req.Code == "" && !ok {
+		return fmt.Errorf("missing code or file %s", entry)
+	}
+	return nil
+}
+
+// hasLanguage reports whether lang is a spec key or the language of a spec.
+func hasLanguage(sp *spec.BaseProvider, lang string) bool {
+	if _, ok := sp.Get(lang); ok {
+		return true
+	}
+	for _, s := range sp.All() {
+		if s.Language == lang {
+			return true
+		}
+	}
+	return false
+}
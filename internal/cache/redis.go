@@ -0,0 +1,115 @@
+package cache
+
+import (
+	"code-runner/pkg/models"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"strings"
+	"time"
+)
+
+// Verdict is the judged outcome of a submission, stored so that identical
+// resubmissions can be completed without starting a container.
+type Verdict struct {
+	Status      string `json:"status"`
+	StdOut      string `json:"stdout"`
+	StdErr      string `json:"stderr"`
+	ExecTimeMS  int    `json:"exec_time_ms"`
+	PassedCount int    `json:"passed_count"`
+	TotalCount  int    `json:"total_count"`
+	// Results are the per-test results of project runs
+	Results []models.TestResult `json:"results,omitempty"`
+	// Score is the aggregated score of scored questions
+	Score *float64 `json:"score,omitempty"`
+}
+
+type RedisVerdictCache struct {
+	client *redis.Client
+	ctx    context.Context
+	prefix string
+	ttl    time.Duration
+}
+
+func NewRedisVerdictCache(addr, pwd string, ttl time.Duration) *RedisVerdictCache {
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: pwd,
+		DB:       0,
+	})
+	return &RedisVerdictCache{
+		client: rdb,
+		ctx:    context.Background(),
+		prefix: "verdict_cache",
+		ttl:    ttl,
+	}
+}
+
+// Hash builds a stable cache key out of the given parts. Parts are length
+// prefixed so that ("ab", "c") and ("a", "bc") never collide.
+func Hash(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		fmt.Fprintf(h, "%d:%s;", len(p), p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *RedisVerdictCache) key(questionID, hash string) string {
+	return c.prefix + ":" + questionID + ":" + hash
+}
+
+func (c *RedisVerdictCache) Get(questionID, hash string) (*Verdict, bool, error) {
+	data, err := c.client.Get(c.ctx, c.key(questionID, hash)).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	v := new(Verdict)
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, false, err
+	}
+	return v, true, nil
+}
+
+func (c *RedisVerdictCache) Set(questionID, hash string, v *Verdict) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.client.Set(c.ctx, c.key(questionID, hash), data, c.ttl).Err()
+}
+
+// InvalidateQuestion drops every cached verdict of the given question. It is
+// called whenever the question (and therefore possibly its tests) changes.
+func (c *RedisVerdictCache) InvalidateQuestion(questionID string) error {
+	// escape glob characters so a question ID can never match other questions
+	pattern := c.key(escapeGlob(questionID), "*")
+	iter := c.client.Scan(c.ctx, 0, pattern, 500).Iterator()
+	var keys []string
+	for iter.Next(c.ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) >= 500 {
+			if err := c.client.Del(c.ctx, keys...).Err(); err != nil {
+				return err
+			}
+			keys = keys[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		return c.client.Del(c.ctx, keys...).Err()
+	}
+	return nil
+}
+
+var globReplacer = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+func escapeGlob(s string) string { return globReplacer.Replace(s) }
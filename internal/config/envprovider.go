@@ -1,12 +1,31 @@
 package config
 
 import (
+	"fmt"
+	"github.com/rs/xid"
 	"os"
 	"strconv"
 )
 
+const (
+	RoleAPI    = "api"
+	RoleWorker = "worker"
+	RoleAll    = "all"
+)
+
+const (
+	// WorkspaceBind mounts job workspaces from HostRootDir into sandboxes,
+	// dockerd has to see the same filesystem as the worker.
+	WorkspaceBind = "bind"
+	// WorkspaceCopy uploads workspaces into containers and downloads the
+	// outputs afterwards, e.g. for a remote DOCKER_HOST.
+	WorkspaceCopy = "copy"
+)
+
 type Config struct {
 	Debug       bool
+	Role        string
+	InstanceID  string
 	HostRootDir string
 	API         struct {
 		BindAddress string
@@ -14,6 +33,33 @@ type Config struct {
 	Sandbox struct {
 		TimeoutSeconds int
 		Memory         string
+		// Workspace selects how job files get into docker sandboxes (bind, copy)
+		Workspace string
+	}
+	Docker struct {
+		// Hosts is a comma separated list of docker endpoints with an
+		// optional "=capacity" suffix, e.g. "tcp://a:2376=8,unix:///var/run/docker.sock=4"
+		Hosts                   string
+		HealthIntervalSeconds   int
+		FailureThreshold        int
+		PlacementTimeoutSeconds int
+	}
+	Registry struct {
+		// Server the credentials belong to, empty applies them to all registries
+		Server             string
+		Username           string
+		Password           string
+		PullTimeoutSeconds int
+	}
+	Images struct {
+		// PrePull pulls all spec images when a worker starts
+		PrePull bool
+		// PrePullTimeoutSeconds bounds how long workers wait for the
+		// pre-pull before they take jobs
+		PrePullTimeoutSeconds int
+		StatusIntervalSeconds int
+		// BuildTimeoutSeconds bounds building the image of a spec with a build section
+		BuildTimeoutSeconds int
 	}
 	Redis struct {
 		Addr string
@@ -25,6 +71,60 @@ type Config struct {
 	Worker struct {
 		Min int
 		Max int
+		// Policy is a comma separated list of scaling policies (queue, age, latency)
+		Policy                string
+		IntervalSeconds       int
+		JobsPerWorker         int
+		TargetQueueAgeSeconds int
+		TargetLatencySeconds  int
+		MinCPUHeadroom        float64
+		MinMemoryHeadroom     float64
+		UpCooldownSeconds     int
+		DownCooldownSeconds   int
+	}
+	Cache struct {
+		Enabled    bool
+		TTLSeconds int
+	}
+	Shutdown struct {
+		GraceSeconds int
+	}
+	Sweeper struct {
+		IntervalSeconds  int
+		ThresholdSeconds int
+		MaxAttempts      int
+	}
+	Reaper struct {
+		IntervalSeconds int
+		// GraceSeconds is the age after which a workspace directory of an
+		// unknown job is removed
+		GraceSeconds int
+	}
+	Metrics struct {
+		BindAddress string
+	}
+	WarmPool struct {
+		Enabled bool
+		// Min and Max bound the idle containers kept per language
+		Min           int
+		Max           int
+		WindowSeconds int
+	}
+	Native struct {
+		// RootfsDir holds the extracted image filesystems
+		RootfsDir string
+		// CgroupParent must be a delegated cgroup v2 directory
+		CgroupParent string
+		PidsMax      int
+		CPUs         float64
+	}
+	Wasm struct {
+		// CacheDir keeps downloaded and compiled modules
+		CacheDir string
+		// Fuel is the number of function calls and loop iterations a run may
+		// make, 0 is unlimited
+		Fuel                   int64
+		DownloadTimeoutSeconds int
 	}
 }
 
@@ -37,13 +137,37 @@ func NewEnvProvider(prefix string) *EnvProvider {
 	return &EnvProvider{prefix: prefix}
 }
 
+// NewStaticProvider serves a fixed configuration instead of reading the
+// environment, e.g. for running the engine in-process.
+func NewStaticProvider(c Config) *EnvProvider {
+	return &EnvProvider{c: c}
+}
+
 func (ep *EnvProvider) Load() error {
 	ep.c.Debug = os.Getenv(ep.prefix+"DEBUG") == "true"
+	ep.c.Role = getEnv(ep.prefix+"ROLE", RoleAll)
+	ep.c.InstanceID = getEnv(ep.prefix+"INSTANCEID", defaultInstanceID())
 	ep.c.HostRootDir = getEnv(ep.prefix+"HOSTROOTDIR", "./data")
 	ep.c.API.BindAddress = getEnv(ep.prefix+"API_BINDADDRESS", ":8080")
 	ep.c.Sandbox.Memory = getEnv(ep.prefix+"SANDBOX_MEMORY", "100M")
 	ep.c.Sandbox.TimeoutSeconds, _ = strconv.Atoi(getEnv(ep.prefix+"SANDBOX_TIMEOUTSECONDS", "20"))
+	ep.c.Sandbox.Workspace = getEnv(ep.prefix+"SANDBOX_WORKSPACE", WorkspaceBind)
 	
+	ep.c.Docker.Hosts = getEnv(ep.prefix+"DOCKER_HOSTS", "")
+	ep.c.Docker.HealthIntervalSeconds, _ = strconv.Atoi(getEnv(ep.prefix+"DOCKER_HEALTHINTERVALSECONDS", "10"))
+	ep.c.Docker.FailureThreshold, _ = strconv.Atoi(getEnv(ep.prefix+"DOCKER_FAILURETHRESHOLD", "2"))
+	ep.c.Docker.PlacementTimeoutSeconds, _ = strconv.Atoi(getEnv(ep.prefix+"DOCKER_PLACEMENTTIMEOUTSECONDS", "30"))
+
+	ep.c.Registry.Server = getEnv(ep.prefix+"REGISTRY_SERVER", "")
+	ep.c.Registry.Username = getEnv(ep.prefix+"REGISTRY_USERNAME", "")
+	ep.c.Registry.Password = getEnv(ep.prefix+"REGISTRY_PASSWORD", "")
+	ep.c.Registry.PullTimeoutSeconds, _ = strconv.Atoi(getEnv(ep.prefix+"REGISTRY_PULLTIMEOUTSECONDS", "600"))
+
+	ep.c.Images.PrePull = getEnv(ep.prefix+"IMAGES_PREPULL", "true") == "true"
+	ep.c.Images.PrePullTimeoutSeconds, _ = strconv.Atoi(getEnv(ep.prefix+"IMAGES_PREPULLTIMEOUTSECONDS", "600"))
+	ep.c.Images.StatusIntervalSeconds, _ = strconv.Atoi(getEnv(ep.prefix+"IMAGES_STATUSINTERVALSECONDS", "60"))
+	ep.c.Images.BuildTimeoutSeconds, _ = strconv.Atoi(getEnv(ep.prefix+"IMAGES_BUILDTIMEOUTSECONDS", "1200"))
+
 	ep.c.Redis.Addr = getEnv(ep.prefix+"REDIS_ADDR", "localhost:6379")
 	ep.c.Redis.Pwd = getEnv(ep.prefix+"REDIS_PWD", "")
 	
@@ -51,12 +175,84 @@ func (ep *EnvProvider) Load() error {
 	
 	ep.c.Worker.Min, _ = strconv.Atoi(getEnv(ep.prefix+"WORKER_MIN", "1"))
 	ep.c.Worker.Max, _ = strconv.Atoi(getEnv(ep.prefix+"WORKER_MAX", "6"))
+	ep.c.Worker.Policy = getEnv(ep.prefix+"WORKER_POLICY", "queue")
+	ep.c.Worker.IntervalSeconds, _ = strconv.Atoi(getEnv(ep.prefix+"WORKER_INTERVALSECONDS", "3"))
+	ep.c.Worker.JobsPerWorker, _ = strconv.Atoi(getEnv(ep.prefix+"WORKER_JOBSPERWORKER", "2"))
+	ep.c.Worker.TargetQueueAgeSeconds, _ = strconv.Atoi(getEnv(ep.prefix+"WORKER_TARGETQUEUEAGESECONDS", "10"))
+	ep.c.Worker.TargetLatencySeconds, _ = strconv.Atoi(getEnv(ep.prefix+"WORKER_TARGETLATENCYSECONDS", "15"))
+	ep.c.Worker.MinCPUHeadroom, _ = strconv.ParseFloat(getEnv(ep.prefix+"WORKER_MINCPUHEADROOM", "0.1"), 64)
+	ep.c.Worker.MinMemoryHeadroom, _ = strconv.ParseFloat(getEnv(ep.prefix+"WORKER_MINMEMORYHEADROOM", "0.1"), 64)
+	ep.c.Worker.UpCooldownSeconds, _ = strconv.Atoi(getEnv(ep.prefix+"WORKER_UPCOOLDOWNSECONDS", "3"))
+	ep.c.Worker.DownCooldownSeconds, _ = strconv.Atoi(getEnv(ep.prefix+"WORKER_DOWNCOOLDOWNSECONDS", "30"))
+
+	ep.c.Cache.Enabled = getEnv(ep.prefix+"CACHE_ENABLED", "true") == "true"
+	ep.c.Cache.TTLSeconds, _ = strconv.Atoi(getEnv(ep.prefix+"CACHE_TTLSECONDS", "86400"))
+
+	ep.c.Shutdown.GraceSeconds, _ = strconv.Atoi(getEnv(ep.prefix+"SHUTDOWN_GRACESECONDS", "30"))
+
+	ep.c.Sweeper.IntervalSeconds, _ = strconv.Atoi(getEnv(ep.prefix+"SWEEPER_INTERVALSECONDS", "60"))
+	ep.c.Sweeper.ThresholdSeconds, _ = strconv.Atoi(getEnv(ep.prefix+"SWEEPER_THRESHOLDSECONDS", "300"))
+	ep.c.Sweeper.MaxAttempts, _ = strconv.Atoi(getEnv(ep.prefix+"SWEEPER_MAXATTEMPTS", "3"))
+
+	ep.c.Reaper.IntervalSeconds, _ = strconv.Atoi(getEnv(ep.prefix+"REAPER_INTERVALSECONDS", "60"))
+	ep.c.Reaper.GraceSeconds, _ = strconv.Atoi(getEnv(ep.prefix+"REAPER_GRACESECONDS", "600"))
+
+	ep.c.Metrics.BindAddress = getEnv(ep.prefix+"METRICS_BINDADDRESS", "")
+
+	ep.c.WarmPool.Enabled = getEnv(ep.prefix+"WARMPOOL_ENABLED", "false") == "true"
+	ep.c.WarmPool.Min, _ = strconv.Atoi(getEnv(ep.prefix+"WARMPOOL_MIN", "1"))
+	ep.c.WarmPool.Max, _ = strconv.Atoi(getEnv(ep.prefix+"WARMPOOL_MAX", "4"))
+	ep.c.WarmPool.WindowSeconds, _ = strconv.Atoi(getEnv(ep.prefix+"WARMPOOL_WINDOWSECONDS", "60"))
+
+	ep.c.Native.RootfsDir = getEnv(ep.prefix+"NATIVE_ROOTFSDIR", "./data/.rootfs")
+	ep.c.Native.CgroupParent = getEnv(ep.prefix+"NATIVE_CGROUPPARENT", "/sys/fs/cgroup/code-runner")
+	ep.c.Native.PidsMax, _ = strconv.Atoi(getEnv(ep.prefix+"NATIVE_PIDSMAX", "64"))
+	ep.c.Native.CPUs, _ = strconv.ParseFloat(getEnv(ep.prefix+"NATIVE_CPUS", "1"), 64)
+
+	ep.c.Wasm.CacheDir = getEnv(ep.prefix+"WASM_CACHEDIR", "./data/.wasm")
+	ep.c.Wasm.Fuel, _ = strconv.ParseInt(getEnv(ep.prefix+"WASM_FUEL", "1000000000"), 10, 64)
+	ep.c.Wasm.DownloadTimeoutSeconds, _ = strconv.Atoi(getEnv(ep.prefix+"WASM_DOWNLOADTIMEOUTSECONDS", "300"))
+
+	return ep.Validate()
+}
+
+func (ep *EnvProvider) Validate() error {
+	switch ep.c.Role {
+	case RoleAPI, RoleWorker, RoleAll:
+	default:
+		return fmt.Errorf("invalid role %q, must be one of %s, %s or %s", ep.c.Role, RoleAPI, RoleWorker, RoleAll)
+	}
+
+	switch ep.c.Sandbox.Workspace {
+	case WorkspaceBind, WorkspaceCopy:
+	default:
+		return fmt.Errorf("invalid sandbox workspace mode %q, must be %s or %s", ep.c.Sandbox.Workspace, WorkspaceBind, WorkspaceCopy)
+	}
 
 	return nil
 }
 
 func (ep *EnvProvider) Config() Config { return ep.c }
 
+// SetRole overrides the configured process role, e.g. from a command line flag.
+func (ep *EnvProvider) SetRole(role string) { ep.c.Role = role }
+
+// RunsAPI reports whether this process serves the HTTP API.
+func (c Config) RunsAPI() bool { return c.Role == RoleAPI || c.Role == RoleAll }
+
+// RunsWorker reports whether this process executes jobs from the queue.
+func (c Config) RunsWorker() bool { return c.Role == RoleWorker || c.Role == RoleAll }
+
+// defaultInstanceID identifies this process among all API and worker
+// instances sharing the same queue.
+func defaultInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "runner"
+	}
+	return host + "-" + xid.New().String()
+}
+
 func getEnv(key, def string) string {
 	if v := os.Getenv(key); v != "" {
 		return v
@@ -0,0 +1,33 @@
+package database
+
+import (
+	"code-runner/pkg/models"
+	"time"
+)
+
+// Database stores submissions and questions. Lookups of unknown IDs return
+// sql.ErrNoRows.
+type Database interface {
+	CreateSubmission(sub *models.Submission) error
+	UpdateResult(id string, status string, stdout, stderr string, timeMs, passed, total int) error
+	MarkRunning(id string) error
+	MarkPending(id string) (bool, error)
+	MarkCancelled(id string) (bool, error)
+	UpdateCancelled(id string, stdout, stderr string) error
+	MarkFailed(id string, status, stderr string) (bool, error)
+	ResetSubmission(id string) (bool, error)
+	UpdateRunStats(id string, exitCode, cpuTimeMs, maxMemoryKB int) error
+	UpdateTestResults(id string, results []models.TestResult) error
+	UpdateScore(id string, score float64) error
+	GetStaleSubmissions(since time.Time) ([]models.Submission, error)
+	GetSubmission(id string) (*models.Submission, error)
+	GetAllSubmissions() ([]models.Submission, error)
+
+	CreateQuestion(q *models.Question) error
+	UpdateQuestion(q *models.Question) error
+	DeleteQuestion(id string) error
+	GetQuestion(id string) (*models.Question, error)
+	GetAllQuestions() ([]models.Question, error)
+}
+
+var _ Database = (*PostgresDB)(nil)
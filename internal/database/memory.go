@@ -0,0 +1,229 @@
+package database
+
+import (
+	"code-runner/pkg/models"
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryDB is an in-process Database for running the engine without
+// Postgres, e.g. in tests. It mirrors the behaviour of PostgresDB.
+type MemoryDB struct {
+	mu          sync.Mutex
+	submissions map[string]models.Submission
+	questions   map[string]models.Question
+}
+
+func NewMemoryDB() *MemoryDB {
+	return &MemoryDB{
+		submissions: make(map[string]models.Submission),
+		questions:   make(map[string]models.Question),
+	}
+}
+
+func (m *MemoryDB) CreateSubmission(sub *models.Submission) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := *sub
+	s.StdOut, s.StdErr = "", ""
+	s.ExecTimeMS, s.PassedCount, s.TotalCount = 0, 0, 0
+	s.CreatedAt = time.Now()
+	s.UpdatedAt = s.CreatedAt
+	m.submissions[s.ID] = s
+	return nil
+}
+
+func (m *MemoryDB) update(id string, fn func(s *models.Submission)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.submissions[id]; ok {
+		fn(&s)
+		s.UpdatedAt = time.Now()
+		m.submissions[id] = s
+	}
+	return nil
+}
+
+func (m *MemoryDB) UpdateResult(id string, status string, stdout, stderr string, timeMs, passed, total int) error {
+	return m.update(id, func(s *models.Submission) {
+		if s.Status == "CANCELLED" {
+			return
+		}
+		s.Status, s.StdOut, s.StdErr = status, stdout, stderr
+		s.ExecTimeMS, s.PassedCount, s.TotalCount = timeMs, passed, total
+	})
+}
+
+func (m *MemoryDB) UpdateRunStats(id string, exitCode, cpuTimeMs, maxMemoryKB int) error {
+	return m.update(id, func(s *models.Submission) {
+		s.ExitCode, s.CPUTimeMS, s.MaxMemoryKB = exitCode, cpuTimeMs, maxMemoryKB
+	})
+}
+
+func (m *MemoryDB) UpdateTestResults(id string, results []models.TestResult) error {
+	return m.update(id, func(s *models.Submission) { s.Results = results })
+}
+
+func (m *MemoryDB) UpdateScore(id string, score float64) error {
+	return m.update(id, func(s *models.Submission) { s.Score = &score })
+}
+
+func (m *MemoryDB) MarkRunning(id string) error {
+	return m.update(id, func(s *models.Submission) {
+		s.Status = "RUNNING"
+		s.Attempts++
+	})
+}
+
+func (m *MemoryDB) MarkPending(id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.submissions[id]
+	if !ok || (s.Status != "PENDING" && s.Status != "RUNNING") {
+		return false, nil
+	}
+	s.Status = "PENDING"
+	s.UpdatedAt = time.Now()
+	m.submissions[id] = s
+	return true, nil
+}
+
+func (m *MemoryDB) MarkCancelled(id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.submissions[id]
+	if !ok || (s.Status != "PENDING" && s.Status != "RUNNING") {
+		return false, nil
+	}
+	s.Status, s.StdErr = "CANCELLED", "Submission was cancelled."
+	s.UpdatedAt = time.Now()
+	m.submissions[id] = s
+	return true, nil
+}
+
+func (m *MemoryDB) UpdateCancelled(id string, stdout, stderr string) error {
+	return m.update(id, func(s *models.Submission) {
+		if s.Status != "PENDING" && s.Status != "RUNNING" && s.Status != "CANCELLED" {
+			return
+		}
+		s.Status, s.StdOut, s.StdErr = "CANCELLED", stdout, stderr
+		s.ExecTimeMS, s.PassedCount, s.TotalCount = 0, 0, 0
+	})
+}
+
+func (m *MemoryDB) MarkFailed(id string, status, stderr string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.submissions[id]
+	if !ok || (s.Status != "PENDING" && s.Status != "RUNNING") {
+		return false, nil
+	}
+	s.Status, s.StdOut, s.StdErr = status, "", stderr
+	s.UpdatedAt = time.Now()
+	m.submissions[id] = s
+	return true, nil
+}
+
+func (m *MemoryDB) ResetSubmission(id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.submissions[id]
+	if !ok || s.Status == "PENDING" || s.Status == "RUNNING" || s.Status == "CANCELLED" {
+		return false, nil
+	}
+	s.Status, s.StdOut, s.StdErr = "PENDING", "", ""
+	s.ExecTimeMS, s.PassedCount, s.TotalCount, s.Attempts = 0, 0, 0, 0
+	s.ExitCode, s.CPUTimeMS, s.MaxMemoryKB = 0, 0, 0
+	s.Results, s.Score = nil, nil
+	s.UpdatedAt = time.Now()
+	m.submissions[id] = s
+	return true, nil
+}
+
+func (m *MemoryDB) GetStaleSubmissions(since time.Time) ([]models.Submission, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var subs []models.Submission
+	for _, s := range m.submissions {
+		if (s.Status == "PENDING" || s.Status == "RUNNING") && s.UpdatedAt.Before(since) {
+			subs = append(subs, s)
+		}
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].CreatedAt.Before(subs[j].CreatedAt) })
+	if len(subs) > 100 {
+		subs = subs[:100]
+	}
+	return subs, nil
+}
+
+func (m *MemoryDB) GetSubmission(id string) (*models.Submission, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.submissions[id]
+	if !ok {
+		return &models.Submission{}, sql.ErrNoRows
+	}
+	return &s, nil
+}
+
+func (m *MemoryDB) GetAllSubmissions() ([]models.Submission, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var subs []models.Submission
+	for _, s := range m.submissions {
+		if !s.IsAdmin {
+			subs = append(subs, s)
+		}
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].CreatedAt.After(subs[j].CreatedAt) })
+	if len(subs) > 50 {
+		subs = subs[:50]
+	}
+	return subs, nil
+}
+
+func (m *MemoryDB) CreateQuestion(q *models.Question) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.questions[q.ID] = *q
+	return nil
+}
+
+func (m *MemoryDB) UpdateQuestion(q *models.Question) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.questions[q.ID]; ok {
+		m.questions[q.ID] = *q
+	}
+	return nil
+}
+
+func (m *MemoryDB) DeleteQuestion(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.questions, id)
+	return nil
+}
+
+func (m *MemoryDB) GetQuestion(id string) (*models.Question, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q, ok := m.questions[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &q, nil
+}
+
+func (m *MemoryDB) GetAllQuestions() ([]models.Question, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var questions []models.Question
+	for _, q := range m.questions {
+		questions = append(questions, q)
+	}
+	sort.Slice(questions, func(i, j int) bool { return questions[i].ID < questions[j].ID })
+	return questions, nil
+}
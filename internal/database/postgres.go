@@ -52,6 +52,25 @@ func NewPostgresDB(dsn string) (*PostgresDB, error) {
 		ALTER TABLE test_questions ADD COLUMN IF NOT EXISTS solution_code TEXT DEFAULT '';
 		ALTER TABLE test_questions ADD COLUMN IF NOT EXISTS solution_lang TEXT DEFAULT '';
 		ALTER TABLE test_questions ADD COLUMN IF NOT EXISTS generator_config TEXT DEFAULT '{}';
+		ALTER TABLE submissions ADD COLUMN IF NOT EXISTS attempts INT DEFAULT 0;
+		ALTER TABLE submissions ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP;
+		ALTER TABLE submissions ADD COLUMN IF NOT EXISTS playground BOOLEAN DEFAULT false;
+		ALTER TABLE submissions ADD COLUMN IF NOT EXISTS exit_code INT DEFAULT 0;
+		ALTER TABLE submissions ADD COLUMN IF NOT EXISTS cpu_time_ms INT DEFAULT 0;
+		ALTER TABLE submissions ADD COLUMN IF NOT EXISTS max_memory_kb INT DEFAULT 0;
+		ALTER TABLE submissions ADD COLUMN IF NOT EXISTS files JSONB DEFAULT '{}';
+		ALTER TABLE submissions ADD COLUMN IF NOT EXISTS results JSONB;
+		ALTER TABLE test_questions ADD COLUMN IF NOT EXISTS project JSONB;
+		ALTER TABLE test_questions ADD COLUMN IF NOT EXISTS unit_tests JSONB;
+		ALTER TABLE test_questions ADD COLUMN IF NOT EXISTS sql_setup JSONB;
+		ALTER TABLE submissions ADD COLUMN IF NOT EXISTS score DOUBLE PRECISION;
+		ALTER TABLE test_questions ADD COLUMN IF NOT EXISTS scoring JSONB;
+		ALTER TABLE test_questions ADD COLUMN IF NOT EXISTS signature JSONB;
+		ALTER TABLE test_questions ADD COLUMN IF NOT EXISTS starter_code JSONB;
+		ALTER TABLE test_questions ADD COLUMN IF NOT EXISTS limits JSONB;
+		ALTER TABLE submissions ADD COLUMN IF NOT EXISTS arguments JSONB;
+		ALTER TABLE submissions ADD COLUMN IF NOT EXISTS environment JSONB;
+		ALTER TABLE submissions ADD COLUMN IF NOT EXISTS stdin TEXT DEFAULT '';
 	`
 	if _, err := db.Exec(alterQuery); err != nil {
 		return nil, err
@@ -61,33 +80,180 @@ func NewPostgresDB(dsn string) (*PostgresDB, error) {
 }
 
 func (p *PostgresDB) CreateSubmission(sub *models.Submission) error {
-	query := `INSERT INTO submissions (id, language, code, question_id, status, stdout, stderr, exec_time_ms, passed_count, total_count, created_at, is_admin) 
-              VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
-	_, err := p.db.Exec(query, sub.ID, sub.Language, sub.Code, sub.QuestionID, sub.Status, "", "", 0, 0, 0, time.Now(), sub.IsAdmin)
+	query := `INSERT INTO submissions (id, language, code, question_id, status, stdout, stderr, exec_time_ms, passed_count, total_count, created_at, is_admin, playground, files, arguments, environment, stdin) 
+              VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)`
+	filesJSON, _ := json.Marshal(sub.Files)
+	argsJSON, _ := json.Marshal(sub.Arguments)
+	envJSON, _ := json.Marshal(sub.Environment)
+	_, err := p.db.Exec(query, sub.ID, sub.Language, sub.Code, sub.QuestionID, sub.Status, "", "", 0, 0, 0, time.Now(), sub.IsAdmin, sub.Playground, filesJSON, argsJSON, envJSON, sub.Stdin)
 	return err
 }
 
+// UpdateResult stores the verdict of a run. A submission cancelled in the
+// meantime keeps its CANCELLED state.
 func (p *PostgresDB) UpdateResult(id string, status string, stdout, stderr string, timeMs, passed, total int) error {
-	query := `UPDATE submissions SET status=$1, stdout=$2, stderr=$3, exec_time_ms=$4, passed_count=$5, total_count=$6 WHERE id=$7`
-	_, err := p.db.Exec(query, status, stdout, stderr, timeMs, passed, total, id)
+	query := `UPDATE submissions SET status=$1, stdout=$2, stderr=$3, exec_time_ms=$4, passed_count=$5, total_count=$6, updated_at=$7
+              WHERE id=$8 AND status <> 'CANCELLED'`
+	_, err := p.db.Exec(query, status, stdout, stderr, timeMs, passed, total, time.Now(), id)
 	return err
 }
 
+// UpdateRunStats stores the exit code and resource usage of the last run.
+func (p *PostgresDB) UpdateRunStats(id string, exitCode, cpuTimeMs, maxMemoryKB int) error {
+	query := `UPDATE submissions SET exit_code=$1, cpu_time_ms=$2, max_memory_kb=$3 WHERE id=$4`
+	_, err := p.db.Exec(query, exitCode, cpuTimeMs, maxMemoryKB, id)
+	return err
+}
+
+// UpdateTestResults stores the per-test results of the last run.
+func (p *PostgresDB) UpdateTestResults(id string, results []models.TestResult) error {
+	resultsJSON, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec(`UPDATE submissions SET results=$1 WHERE id=$2`, resultsJSON, id)
+	return err
+}
+
+// UpdateScore stores the aggregated score of a scored question.
+func (p *PostgresDB) UpdateScore(id string, score float64) error {
+	_, err := p.db.Exec(`UPDATE submissions SET score=$1 WHERE id=$2`, score, id)
+	return err
+}
+
+// MarkRunning flags the submission as picked up by a worker and counts the attempt.
+func (p *PostgresDB) MarkRunning(id string) error {
+	query := `UPDATE submissions SET status='RUNNING', attempts=COALESCE(attempts, 0)+1, updated_at=$1 WHERE id=$2`
+	_, err := p.db.Exec(query, time.Now(), id)
+	return err
+}
+
+// MarkPending puts an unfinished submission back into the PENDING state,
+// e.g. after it was requeued. It returns false if the submission had
+// already finished.
+func (p *PostgresDB) MarkPending(id string) (bool, error) {
+	query := `UPDATE submissions SET status='PENDING', updated_at=$1
+              WHERE id=$2 AND status IN ('PENDING', 'RUNNING')`
+	res, err := p.db.Exec(query, time.Now(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// MarkCancelled ends an unfinished submission as CANCELLED. It returns false
+// if the submission had already finished.
+func (p *PostgresDB) MarkCancelled(id string) (bool, error) {
+	query := `UPDATE submissions SET status='CANCELLED', stderr='Submission was cancelled.', updated_at=$1
+              WHERE id=$2 AND status IN ('PENDING', 'RUNNING')`
+	res, err := p.db.Exec(query, time.Now(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// UpdateCancelled ends a submission whose run was stopped because it was
+// cancelled, keeping the output produced until then.
+func (p *PostgresDB) UpdateCancelled(id string, stdout, stderr string) error {
+	query := `UPDATE submissions SET status='CANCELLED', stdout=$1, stderr=$2, exec_time_ms=0, passed_count=0, total_count=0, updated_at=$3
+              WHERE id=$4 AND status IN ('PENDING', 'RUNNING', 'CANCELLED')`
+	_, err := p.db.Exec(query, stdout, stderr, time.Now(), id)
+	return err
+}
+
+// MarkFailed ends an unfinished submission with the status. It returns
+// false if the submission had already finished.
+func (p *PostgresDB) MarkFailed(id string, status, stderr string) (bool, error) {
+	query := `UPDATE submissions SET status=$1, stdout='', stderr=$2, updated_at=$3
+              WHERE id=$4 AND status IN ('PENDING', 'RUNNING')`
+	res, err := p.db.Exec(query, status, stderr, time.Now(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ResetSubmission clears the verdict of a judged submission and puts it
+// back into the PENDING state to be judged again. It returns false if the
+// submission has not finished yet or was cancelled.
+func (p *PostgresDB) ResetSubmission(id string) (bool, error) {
+	query := `UPDATE submissions SET status='PENDING', stdout='', stderr='', exec_time_ms=0, passed_count=0, total_count=0,
+              exit_code=0, cpu_time_ms=0, max_memory_kb=0, results=NULL, score=NULL, attempts=0, updated_at=$1
+              WHERE id=$2 AND status NOT IN ('PENDING', 'RUNNING', 'CANCELLED')`
+	res, err := p.db.Exec(query, time.Now(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// GetStaleSubmissions returns unfinished submissions which have not been
+// touched since the given time.
+func (p *PostgresDB) GetStaleSubmissions(since time.Time) ([]models.Submission, error) {
+	query := `SELECT id, language, code, COALESCE(question_id,''), status, COALESCE(attempts, 0),
+              created_at, COALESCE(updated_at, created_at), COALESCE(is_admin, false), COALESCE(playground, false),
+              COALESCE(files, '{}'), COALESCE(arguments, 'null'), COALESCE(environment, 'null'), COALESCE(stdin, '')
+              FROM submissions
+              WHERE status IN ('PENDING', 'RUNNING') AND COALESCE(updated_at, created_at) < $1
+              ORDER BY created_at ASC LIMIT 100`
+	rows, err := p.db.Query(query, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []models.Submission
+	for rows.Next() {
+		var s models.Submission
+		var filesJSON, argsJSON, envJSON []byte
+		if err := rows.Scan(&s.ID, &s.Language, &s.Code, &s.QuestionID, &s.Status, &s.Attempts, &s.CreatedAt, &s.UpdatedAt, &s.IsAdmin, &s.Playground, &filesJSON, &argsJSON, &envJSON, &s.Stdin); err != nil {
+			return nil, err
+		}
+		json.Unmarshal(filesJSON, &s.Files)
+		json.Unmarshal(argsJSON, &s.Arguments)
+		json.Unmarshal(envJSON, &s.Environment)
+		subs = append(subs, s)
+	}
+	return subs, rows.Err()
+}
+
 func (p *PostgresDB) GetSubmission(id string) (*models.Submission, error) {
 	s := &models.Submission{}
 	query := `SELECT id, language, code, COALESCE(question_id,''), status, 
               COALESCE(stdout, ''), COALESCE(stderr, ''), COALESCE(exec_time_ms, 0),
-              COALESCE(passed_count, 0), COALESCE(total_count, 0), created_at, COALESCE(is_admin, false) 
+              COALESCE(passed_count, 0), COALESCE(total_count, 0), created_at, COALESCE(is_admin, false),
+              COALESCE(attempts, 0), COALESCE(updated_at, created_at), COALESCE(playground, false),
+              COALESCE(exit_code, 0), COALESCE(cpu_time_ms, 0), COALESCE(max_memory_kb, 0),
+              COALESCE(files, '{}'), COALESCE(results, 'null'), score,
+              COALESCE(arguments, 'null'), COALESCE(environment, 'null'), COALESCE(stdin, '')
               FROM submissions WHERE id=$1`
+	var filesJSON, resultsJSON, argsJSON, envJSON []byte
+	var score sql.NullFloat64
 	err := p.db.QueryRow(query, id).
-		Scan(&s.ID, &s.Language, &s.Code, &s.QuestionID, &s.Status, &s.StdOut, &s.StdErr, &s.ExecTimeMS, &s.PassedCount, &s.TotalCount, &s.CreatedAt, &s.IsAdmin)
+		Scan(&s.ID, &s.Language, &s.Code, &s.QuestionID, &s.Status, &s.StdOut, &s.StdErr, &s.ExecTimeMS, &s.PassedCount, &s.TotalCount, &s.CreatedAt, &s.IsAdmin, &s.Attempts, &s.UpdatedAt, &s.Playground, &s.ExitCode, &s.CPUTimeMS, &s.MaxMemoryKB, &filesJSON, &resultsJSON, &score, &argsJSON, &envJSON, &s.Stdin)
+	if err == nil {
+		json.Unmarshal(filesJSON, &s.Files)
+		json.Unmarshal(resultsJSON, &s.Results)
+		json.Unmarshal(argsJSON, &s.Arguments)
+		json.Unmarshal(envJSON, &s.Environment)
+		if score.Valid {
+			s.Score = &score.Float64
+		}
+	}
 	return s, err
 }
 
 func (p *PostgresDB) GetAllSubmissions() ([]models.Submission, error) {
 	query := `SELECT id, language, code, COALESCE(question_id,''), status, 
               COALESCE(stdout, ''), COALESCE(stderr, ''), COALESCE(exec_time_ms, 0),
-              COALESCE(passed_count, 0), COALESCE(total_count, 0), created_at, COALESCE(is_admin, false) 
+              COALESCE(passed_count, 0), COALESCE(total_count, 0), created_at, COALESCE(is_admin, false),
+              COALESCE(attempts, 0), COALESCE(updated_at, created_at), COALESCE(playground, false),
+              COALESCE(exit_code, 0), COALESCE(cpu_time_ms, 0), COALESCE(max_memory_kb, 0), score
               FROM submissions 
               WHERE is_admin = false OR is_admin IS NULL
               ORDER BY created_at DESC LIMIT 50`
@@ -100,9 +266,13 @@ func (p *PostgresDB) GetAllSubmissions() ([]models.Submission, error) {
 	var subs []models.Submission
 	for rows.Next() {
 		var s models.Submission
-		if err := rows.Scan(&s.ID, &s.Language, &s.Code, &s.QuestionID, &s.Status, &s.StdOut, &s.StdErr, &s.ExecTimeMS, &s.PassedCount, &s.TotalCount, &s.CreatedAt, &s.IsAdmin); err != nil {
+		var score sql.NullFloat64
+		if err := rows.Scan(&s.ID, &s.Language, &s.Code, &s.QuestionID, &s.Status, &s.StdOut, &s.StdErr, &s.ExecTimeMS, &s.PassedCount, &s.TotalCount, &s.CreatedAt, &s.IsAdmin, &s.Attempts, &s.UpdatedAt, &s.Playground, &s.ExitCode, &s.CPUTimeMS, &s.MaxMemoryKB, &score); err != nil {
 			return nil, err
 		}
+		if score.Valid {
+			s.Score = &score.Float64
+		}
 		subs = append(subs, s)
 	}
 	return subs, nil
@@ -110,15 +280,29 @@ func (p *PostgresDB) GetAllSubmissions() ([]models.Submission, error) {
 
 func (p *PostgresDB) CreateQuestion(q *models.Question) error {
 	casesJSON, _ := json.Marshal(q.TestCases)
-	query := `INSERT INTO test_questions (id, title, description, test_cases, solution_code, solution_lang, generator_config) VALUES ($1, $2, $3, $4, $5, $6, $7)`
-	_, err := p.db.Exec(query, q.ID, q.Title, q.Description, casesJSON, q.SolutionCode, q.SolutionLang, q.GeneratorConfig)
+	projectJSON, _ := json.Marshal(q.Project)
+	unitTestsJSON, _ := json.Marshal(q.UnitTests)
+	sqlJSON, _ := json.Marshal(q.SQL)
+	scoringJSON, _ := json.Marshal(q.Scoring)
+	signatureJSON, _ := json.Marshal(q.Signature)
+	starterJSON, _ := json.Marshal(q.StarterCode)
+	limitsJSON, _ := json.Marshal(q.Limits)
+	query := `INSERT INTO test_questions (id, title, description, test_cases, solution_code, solution_lang, generator_config, project, unit_tests, sql_setup, scoring, signature, starter_code, limits) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`
+	_, err := p.db.Exec(query, q.ID, q.Title, q.Description, casesJSON, q.SolutionCode, q.SolutionLang, q.GeneratorConfig, projectJSON, unitTestsJSON, sqlJSON, scoringJSON, signatureJSON, starterJSON, limitsJSON)
 	return err
 }
 
 func (p *PostgresDB) UpdateQuestion(q *models.Question) error {
 	casesJSON, _ := json.Marshal(q.TestCases)
-	query := `UPDATE test_questions SET title=$1, description=$2, test_cases=$3, solution_code=$4, solution_lang=$5, generator_config=$6 WHERE id=$7`
-	_, err := p.db.Exec(query, q.Title, q.Description, casesJSON, q.SolutionCode, q.SolutionLang, q.GeneratorConfig, q.ID)
+	projectJSON, _ := json.Marshal(q.Project)
+	unitTestsJSON, _ := json.Marshal(q.UnitTests)
+	sqlJSON, _ := json.Marshal(q.SQL)
+	scoringJSON, _ := json.Marshal(q.Scoring)
+	signatureJSON, _ := json.Marshal(q.Signature)
+	starterJSON, _ := json.Marshal(q.StarterCode)
+	limitsJSON, _ := json.Marshal(q.Limits)
+	query := `UPDATE test_questions SET title=$1, description=$2, test_cases=$3, solution_code=$4, solution_lang=$5, generator_config=$6, project=$7, unit_tests=$8, sql_setup=$9, scoring=$10, signature=$11, starter_code=$12, limits=$13 WHERE id=$14`
+	_, err := p.db.Exec(query, q.Title, q.Description, casesJSON, q.SolutionCode, q.SolutionLang, q.GeneratorConfig, projectJSON, unitTestsJSON, sqlJSON, scoringJSON, signatureJSON, starterJSON, limitsJSON, q.ID)
 	return err
 }
 
@@ -130,20 +314,27 @@ func (p *PostgresDB) DeleteQuestion(id string) error {
 
 func (p *PostgresDB) GetQuestion(id string) (*models.Question, error) {
 	q := &models.Question{}
-	var casesJSON []byte
-	query := `SELECT id, title, description, test_cases, COALESCE(solution_code, ''), COALESCE(solution_lang, ''), COALESCE(generator_config, '{}') FROM test_questions WHERE id=$1`
-	err := p.db.QueryRow(query, id).Scan(&q.ID, &q.Title, &q.Description, &casesJSON, &q.SolutionCode, &q.SolutionLang, &q.GeneratorConfig)
+	var casesJSON, projectJSON, unitTestsJSON, sqlJSON, scoringJSON, signatureJSON, starterJSON, limitsJSON []byte
+	query := `SELECT id, title, description, test_cases, COALESCE(solution_code, ''), COALESCE(solution_lang, ''), COALESCE(generator_config, '{}'), COALESCE(project, 'null'), COALESCE(unit_tests, 'null'), COALESCE(sql_setup, 'null'), COALESCE(scoring, 'null'), COALESCE(signature, 'null'), COALESCE(starter_code, 'null'), COALESCE(limits, 'null') FROM test_questions WHERE id=$1`
+	err := p.db.QueryRow(query, id).Scan(&q.ID, &q.Title, &q.Description, &casesJSON, &q.SolutionCode, &q.SolutionLang, &q.GeneratorConfig, &projectJSON, &unitTestsJSON, &sqlJSON, &scoringJSON, &signatureJSON, &starterJSON, &limitsJSON)
 	if err != nil {
 		return nil, err
 	}
 	if len(casesJSON) > 0 {
 		json.Unmarshal(casesJSON, &q.TestCases)
 	}
+	json.Unmarshal(projectJSON, &q.Project)
+	json.Unmarshal(unitTestsJSON, &q.UnitTests)
+	json.Unmarshal(sqlJSON, &q.SQL)
+	json.Unmarshal(scoringJSON, &q.Scoring)
+	json.Unmarshal(signatureJSON, &q.Signature)
+	json.Unmarshal(starterJSON, &q.StarterCode)
+	json.Unmarshal(limitsJSON, &q.Limits)
 	return q, nil
 }
 
 func (p *PostgresDB) GetAllQuestions() ([]models.Question, error) {
-	query := `SELECT id, title, description, test_cases, COALESCE(solution_code, ''), COALESCE(solution_lang, ''), COALESCE(generator_config, '{}') FROM test_questions ORDER BY id ASC`
+	query := `SELECT id, title, description, test_cases, COALESCE(solution_code, ''), COALESCE(solution_lang, ''), COALESCE(generator_config, '{}'), COALESCE(project, 'null'), COALESCE(unit_tests, 'null'), COALESCE(sql_setup, 'null'), COALESCE(scoring, 'null'), COALESCE(signature, 'null'), COALESCE(starter_code, 'null'), COALESCE(limits, 'null') FROM test_questions ORDER BY id ASC`
 	rows, err := p.db.Query(query)
 	if err != nil {
 		return nil, err
@@ -153,13 +344,20 @@ func (p *PostgresDB) GetAllQuestions() ([]models.Question, error) {
 	var questions []models.Question
 	for rows.Next() {
 		var q models.Question
-		var casesJSON []byte
-		if err := rows.Scan(&q.ID, &q.Title, &q.Description, &casesJSON, &q.SolutionCode, &q.SolutionLang, &q.GeneratorConfig); err != nil {
+		var casesJSON, projectJSON, unitTestsJSON, sqlJSON, scoringJSON, signatureJSON, starterJSON, limitsJSON []byte
+		if err := rows.Scan(&q.ID, &q.Title, &q.Description, &casesJSON, &q.SolutionCode, &q.SolutionLang, &q.GeneratorConfig, &projectJSON, &unitTestsJSON, &sqlJSON, &scoringJSON, &signatureJSON, &starterJSON, &limitsJSON); err != nil {
 			return nil, err
 		}
 		if len(casesJSON) > 0 {
 			json.Unmarshal(casesJSON, &q.TestCases)
 		}
+		json.Unmarshal(projectJSON, &q.Project)
+		json.Unmarshal(unitTestsJSON, &q.UnitTests)
+		json.Unmarshal(sqlJSON, &q.SQL)
+		json.Unmarshal(scoringJSON, &q.Scoring)
+		json.Unmarshal(signatureJSON, &q.Signature)
+		json.Unmarshal(starterJSON, &q.StarterCode)
+		json.Unmarshal(limitsJSON, &q.Limits)
 		questions = append(questions, q)
 	}
 	return questions, nil
@@ -0,0 +1,150 @@
+package file
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"code-runner/pkg/models"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ReadArchive extracts the regular files of a zip, tar or gzipped tar
+// archive into a map of paths to contents. If all files share one top level
+// directory, it is stripped. Extraction fails once the archive holds more
+// than maxFiles files or maxBytes bytes of content.
+func ReadArchive(data []byte, maxFiles int, maxBytes int64) (map[string]string, error) {
+	ar := &archiveReader{files: make(map[string]string), maxFiles: maxFiles, remaining: maxBytes}
+
+	var err error
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")) || bytes.HasPrefix(data, []byte("PK\x05\x06")):
+		err = ar.readZip(data)
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(bytes.NewReader(data)); err == nil {
+			err = ar.readTar(gz)
+		}
+	default:
+		err = ar.readTar(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stripTopDir(ar.files), nil
+}
+
+type archiveReader struct {
+	files     map[string]string
+	maxFiles  int
+	remaining int64
+}
+
+func (ar *archiveReader) readZip(data []byte) error {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return fmt.Errorf("invalid zip archive: %w", err)
+	}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || skipEntry(f.Name) {
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			return fmt.Errorf("unsupported archive entry %q", f.Name)
+		}
+		r, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("invalid zip archive: %w", err)
+		}
+		err = ar.add(f.Name, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ar *archiveReader) readTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for i := 0; ; i++ {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if i == 0 {
+				return errors.New("unsupported archive format, expected zip, tar or tar.gz")
+			}
+			return fmt.Errorf("invalid tar archive: %w", err)
+		}
+		switch h.Typeflag {
+		case tar.TypeDir, tar.TypeXGlobalHeader:
+			continue
+		case tar.TypeReg:
+		default:
+			return fmt.Errorf("unsupported archive entry %q", h.Name)
+		}
+		if skipEntry(h.Name) {
+			continue
+		}
+		if err := ar.add(h.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func (ar *archiveReader) add(name string, r io.Reader) error {
+	name = strings.TrimPrefix(name, "./")
+	if err := models.ValidatePath(name); err != nil {
+		return err
+	}
+	if _, ok := ar.files[name]; ok {
+		return fmt.Errorf("duplicate archive entry %q", name)
+	}
+	if len(ar.files) >= ar.maxFiles {
+		return fmt.Errorf("archive may not contain more than %d files", ar.maxFiles)
+	}
+	// reading one byte more than allowed detects oversized contents without
+	// trusting the sizes stated in the headers
+	data, err := io.ReadAll(io.LimitReader(r, ar.remaining+1))
+	if err != nil {
+		return fmt.Errorf("failed to read %q: %w", name, err)
+	}
+	if int64(len(data)) > ar.remaining {
+		return errors.New("archive contents are too large")
+	}
+	ar.remaining -= int64(len(data))
+	ar.files[name] = string(data)
+	return nil
+}
+
+// skipEntry reports entries which only hold metadata of the tool that
+// created the archive.
+func skipEntry(name string) bool {
+	return strings.HasPrefix(name, "__MACOSX/") || strings.HasSuffix(name, "/.DS_Store") || name == ".DS_Store"
+}
+
+// stripTopDir removes the directory all files are in, as archives of a
+// project usually contain the project directory itself.
+func stripTopDir(files map[string]string) map[string]string {
+	top := ""
+	for name := range files {
+		i := strings.IndexByte(name, '/')
+		if i < 0 || (top != "" && name[:i] != top) {
+			return files
+		}
+		top = name[:i]
+	}
+	if top == "" {
+		return files
+	}
+	res := make(map[string]string, len(files))
+	for name, content := range files {
+		res[strings.TrimPrefix(name, top+"/")] = content
+	}
+	return res
+}
@@ -1,6 +1,7 @@
 package file
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 )
@@ -17,9 +18,18 @@ func (lf *LocalFileProvider) CreateFile(path, content string) error {
 	return os.WriteFile(path, []byte(content), 0777)
 }
 
+// CreateFiles writes the files below dir, creating their directories. Names
+// are slash separated and may not leave dir.
 func (lf *LocalFileProvider) CreateFiles(dir string, files map[string]string) error {
 	for name, content := range files {
-		fullPath := filepath.Join(dir, name)
+		rel := filepath.FromSlash(name)
+		if !filepath.IsLocal(rel) {
+			return fmt.Errorf("invalid file path %q", name)
+		}
+		fullPath := filepath.Join(dir, rel)
+		if err := lf.CreateDirectory(filepath.Dir(fullPath)); err != nil {
+			return err
+		}
 		if err := lf.CreateFile(fullPath, content); err != nil {
 			return err
 		}
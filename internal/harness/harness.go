@@ -0,0 +1,178 @@
+// Package harness runs the complete API -> queue -> worker -> judge flow
+// in-process. The queue and the database are kept in memory and sandboxes
+// are faked, so neither Docker, Postgres nor Redis are needed.
+package harness
+
+import (
+	"bytes"
+	"code-runner/internal/api"
+	"code-runner/internal/config"
+	"code-runner/internal/database"
+	"code-runner/internal/file"
+	"code-runner/internal/queue"
+	"code-runner/internal/sandbox"
+	"code-runner/internal/sandbox/fake"
+	"code-runner/internal/spec"
+	"code-runner/internal/worker"
+	"code-runner/pkg/models"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+)
+
+// DefaultSpecs mirrors the languages of spec/spec.yaml.
+func DefaultSpecs() models.SpecMap {
+	return models.SpecMap{
+		"python3": {Image: "python:alpine", Cmd: `/bin/sh -c "python3 driver.py"`, FileName: "driver.py", Language: "python"},
+		"node":    {Image: "node:alpine", Cmd: `/bin/sh -c "node driver.js"`, FileName: "driver.js", Language: "javascript"},
+		"go":      {Image: "golang:alpine", Cmd: `/bin/sh -c "go run main.go"`, FileName: "main.go", Language: "go"},
+		"pytest":  {Image: "python:alpine", Cmd: `/bin/sh -c "python3 -m pytest"`, FileName: "test_main.py", Language: "python-pytest"},
+		"maven":   {Image: "maven:3.9-eclipse-temurin-21", Cmd: `/bin/sh -c "mvn -B test"`, FileName: "pom.xml", Language: "java-maven"},
+		"gradle":  {Image: "gradle:8-jdk21", Cmd: `/bin/sh -c "gradle test --no-daemon"`, FileName: "build.gradle", Language: "java-gradle"},
+		"cargo":   {Image: "rust:alpine", Cmd: `/bin/sh -c "cargo test"`, FileName: "Cargo.toml", Language: "rust"},
+		"make":    {Image: "gcc:latest", Cmd: `/bin/sh -c "make test"`, FileName: "Makefile", Language: "c-make"},
+		"sqlite":  {Image: "python:alpine", Cmd: `/bin/sh -c "python3 driver.py"`, FileName: "submission.sql", Language: "sql"},
+	}
+}
+
+type Harness struct {
+	Config  *config.EnvProvider
+	Queue   *queue.MemoryQueue
+	DB      *database.MemoryDB
+	Sandbox *fake.Provider
+	Manager *sandbox.Manager
+	Pool    *worker.Pool
+	API     *api.RestAPI
+
+	dir string
+}
+
+// New starts a harness whose sandboxes behave as scripted by h. specs may
+// be nil to use DefaultSpecs. The caller has to Close the harness.
+func New(h fake.Handler, specs models.SpecMap) (*Harness, error) {
+	if specs == nil {
+		specs = DefaultSpecs()
+	}
+	dir, err := os.MkdirTemp("", "code-runner-harness-")
+	if err != nil {
+		return nil, err
+	}
+
+	var c config.Config
+	c.Role = config.RoleAll
+	c.InstanceID = "harness"
+	c.HostRootDir = dir
+	c.Sandbox.Memory = "100M"
+	c.Sandbox.TimeoutSeconds = 5
+	c.Sandbox.Workspace = config.WorkspaceBind
+	c.Worker.Min = 1
+	c.Worker.Max = 1
+	c.Worker.Policy = "queue"
+	c.Worker.IntervalSeconds = 1
+	c.Worker.JobsPerWorker = 1
+	c.Sweeper.IntervalSeconds = 60
+	c.Sweeper.ThresholdSeconds = 300
+	c.Sweeper.MaxAttempts = 3
+	c.Reaper.IntervalSeconds = 60
+	c.Reaper.GraceSeconds = 600
+	cfg := config.NewStaticProvider(c)
+
+	hs := &Harness{
+		Config:  cfg,
+		Queue:   queue.NewMemoryQueue(),
+		DB:      database.NewMemoryDB(),
+		Sandbox: fake.NewProvider(h),
+		dir:     dir,
+	}
+
+	sp := spec.NewProvider(specs)
+	providers := map[string]sandbox.Provider{}
+	for _, s := range sp.All() {
+		providers[s.GetBackend()] = hs.Sandbox
+	}
+
+	if hs.Manager, err = sandbox.NewManager(providers, sp, file.NewLocalFileProvider(), cfg); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if hs.Pool, err = worker.NewPool(cfg, hs.Queue, hs.DB, hs.Manager, nil); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if hs.API, err = api.NewRestAPI(cfg, sp, hs.Queue, hs.DB, nil, nil); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	hs.Pool.Start()
+	return hs, nil
+}
+
+// Close stops the workers and removes all workspaces.
+func (hs *Harness) Close() {
+	hs.Pool.Shutdown(time.Second)
+	hs.Manager.Cleanup()
+	os.RemoveAll(hs.dir)
+}
+
+// Do sends a request to the API. A non-nil body is encoded as JSON and the
+// JSON response is decoded into res, if given.
+func (hs *Harness) Do(method, path string, body, res interface{}) (int, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		r = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, r)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := hs.API.App().Test(req, -1)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if res != nil {
+		if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// Submit posts the request to /v1/exec and returns the submission ID.
+func (hs *Harness) Submit(req models.ExecutionRequest) (string, error) {
+	var res models.ExecutionResponse
+	status, err := hs.Do(http.MethodPost, "/v1/exec", req, &res)
+	if err != nil {
+		return "", err
+	}
+	if status != http.StatusOK {
+		return "", fmt.Errorf("exec returned status %d", status)
+	}
+	return res.SubmissionID, nil
+}
+
+// Wait polls the API until the submission reached a final status.
+func (hs *Harness) Wait(id string, timeout time.Duration) (*models.Submission, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		var sub models.Submission
+		if _, err := hs.Do(http.MethodGet, "/v1/submissions/"+id, nil, &sub); err != nil {
+			return nil, err
+		}
+		if sub.Status != "PENDING" && sub.Status != "RUNNING" {
+			return &sub, nil
+		}
+		if time.Now().After(deadline) {
+			return &sub, fmt.Errorf("submission %s still %s after %s", id, sub.Status, timeout)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,553 @@
+package harness
+
+import (
+	"code-runner/internal/sandbox"
+	"code-runner/internal/sandbox/fake"
+	"code-runner/pkg/models"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var errUnavailable = errors.New("docker daemon unavailable")
+
+const passingReport = `<testsuite><testcase classname="test_app" name="test_add"/></testsuite>`
+
+var project = models.Question{
+	ID:      "p1",
+	Title:   "Project",
+	Project: &models.Project{BuildSystem: "pytest"},
+}
+
+// expected is a project whose reports have to hold two tests.
+var expected = models.Question{
+	ID:      "p2",
+	Title:   "Project with expected tests",
+	Project: &models.Project{BuildSystem: "pytest", ExpectedTests: []string{"test_app.test_add", "test_app.test_sub"}},
+}
+
+// writeReport is a handler writing the report to the path the pytest
+// project command passes.
+func writeReport(report string) fake.Handler {
+	return func(spec sandbox.RunSpec, files map[string]string) fake.Run {
+		for _, arg := range strings.Fields(spec.Command[2]) {
+			if path, ok := strings.CutPrefix(arg, "--junitxml="); ok {
+				return fake.Run{Files: map[string]string{path: report}}
+			}
+		}
+		return fake.Run{}
+	}
+}
+
+var unitTests = models.Question{
+	ID:        "u1",
+	Title:     "Unit tests",
+	UnitTests: &models.UnitTests{Framework: models.FrameworkPytest, Code: "def test_add(): pass"},
+}
+
+// junitxml returns the report path the pytest driver got.
+func junitxml(files map[string]string) string {
+	_, report, _ := strings.Cut(files["driver.py"], "--junitxml=")
+	report, _, _ = strings.Cut(report, `"`)
+	return report
+}
+
+// forgeReport simulates a solution writing a passing report where the
+// suite's report is collected from, as far as it can learn the path. Code
+// exiting as soon as pytest imports it only sees the workspace and has to
+// guess, code reading the running pytest config gets the real path.
+func forgeReport(spec sandbox.RunSpec, files map[string]string) fake.Run {
+	report := "report.xml"
+	if strings.Contains(files["solution.py"], "config.option.xmlpath") {
+		report = junitxml(files)
+	}
+	return fake.Run{Files: map[string]string{report: passingReport}}
+}
+
+// inProcessForgery finds the pytest config it is imported by and writes a
+// passing report before the suite runs.
+const inProcessForgery = `import gc, os, _pytest.config
+config = next(o for o in gc.get_objects() if isinstance(o, _pytest.config.Config))
+open(config.option.xmlpath, "w").write('<testsuite><testcase name="test_add"/></testsuite>')
+os._exit(0)`
+
+var question = models.Question{
+	ID:    "q1",
+	Title: "Double",
+	TestCases: []models.TestCase{
+		{ID: "1", Input: "1", ExpectedOutput: "2"},
+		{ID: "2", Input: "2", ExpectedOutput: "4"},
+	},
+}
+
+func start(t *testing.T, h fake.Handler, questions ...models.Question) *Harness {
+	t.Helper()
+	hs, err := New(h, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(hs.Close)
+	for _, q := range questions {
+		var res models.ErrorModel
+		status, err := hs.Do(http.MethodPost, "/v1/admin/questions", q, &res)
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("creating question %s: %d %v %s", q.ID, status, err, res.Error)
+		}
+	}
+	return hs
+}
+
+func submit(t *testing.T, hs *Harness, req models.ExecutionRequest) *models.Submission {
+	t.Helper()
+	id, err := hs.Submit(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := hs.Wait(id, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sub
+}
+
+func TestJudge(t *testing.T) {
+	timed := question
+	timed.Limits = &models.Limits{TimeMS: 100}
+
+	tests := []struct {
+		name      string
+		handler   fake.Handler
+		questions []models.Question
+		req       models.ExecutionRequest
+		status    string
+		check     func(t *testing.T, sub *models.Submission, calls []fake.Call)
+	}{
+		{
+			name:      "all test cases pass",
+			handler:   fake.Static(fake.Run{Stdout: "[]"}),
+			questions: []models.Question{question},
+			req:       models.ExecutionRequest{Language: "python3", Code: "def solve(x): return 2*int(x)", QuestionID: "q1"},
+			status:    "SUCCESS",
+			check: func(t *testing.T, sub *models.Submission, calls []fake.Call) {
+				if sub.PassedCount != 2 || sub.TotalCount != 2 {
+					t.Errorf("passed %d of %d, want 2 of 2", sub.PassedCount, sub.TotalCount)
+				}
+				if len(calls) != 1 || !strings.Contains(calls[0].Files["tests.json"], `"expected_output":"4"`) {
+					t.Errorf("test cases were not passed to the sandbox: %+v", calls)
+				}
+			},
+		},
+		{
+			name:      "failed test case",
+			handler:   fake.Static(fake.Run{Stdout: `[{"test_case_id":"2","status":"FAILED","expected":"4","actual":"5"}]`}),
+			questions: []models.Question{question},
+			req:       models.ExecutionRequest{Language: "python3", Code: "def solve(x): return 5", QuestionID: "q1"},
+			status:    "FAILURE",
+			check: func(t *testing.T, sub *models.Submission, calls []fake.Call) {
+				if sub.PassedCount != 1 {
+					t.Errorf("passed %d, want 1", sub.PassedCount)
+				}
+				if !strings.Contains(sub.StdErr, "Failed Case 2") || !strings.Contains(sub.StdErr, "5") {
+					t.Errorf("stderr does not describe the failure: %q", sub.StdErr)
+				}
+			},
+		},
+		{
+			name:      "output the judge cannot parse",
+			handler:   fake.Static(fake.Run{Stdout: "Traceback (most recent call last):", ExitCode: 1}),
+			questions: []models.Question{question},
+			req:       models.ExecutionRequest{Language: "python3", Code: "raise", QuestionID: "q1"},
+			status:    "ERROR",
+			check: func(t *testing.T, sub *models.Submission, calls []fake.Call) {
+				if !strings.Contains(sub.StdErr, "Judge Error") {
+					t.Errorf("stderr %q does not report a judge error", sub.StdErr)
+				}
+			},
+		},
+		{
+			name:      "time limit exceeded",
+			handler:   fake.Static(fake.Run{Stdout: "[]", Delay: 3 * time.Second}),
+			questions: []models.Question{timed},
+			req:       models.ExecutionRequest{Language: "python3", Code: "while True: pass", QuestionID: "q1"},
+			status:    "TIMEOUT",
+			check: func(t *testing.T, sub *models.Submission, calls []fake.Call) {
+				if len(calls) != 1 || !calls[0].Killed {
+					t.Errorf("sandbox was not killed: %+v", calls)
+				}
+			},
+		},
+		{
+			name:    "playground exit code and usage",
+			handler: fake.Static(fake.Run{Stdout: "partial", Stderr: "boom", ExitCode: 3, CPUTime: 40 * time.Millisecond, MaxMemory: 8 << 20}),
+			req:     models.ExecutionRequest{Language: "python3", Code: "import sys; sys.exit(3)"},
+			status:  "ERROR",
+			check: func(t *testing.T, sub *models.Submission, calls []fake.Call) {
+				if !sub.Playground || sub.ExitCode != 3 || sub.StdOut != "partial" || sub.StdErr != "boom" {
+					t.Errorf("unexpected playground result: %+v", sub)
+				}
+				if sub.CPUTimeMS != 40 || sub.MaxMemoryKB != 8<<10 {
+					t.Errorf("usage %d ms, %d KB, want 40 ms, 8192 KB", sub.CPUTimeMS, sub.MaxMemoryKB)
+				}
+			},
+		},
+		{
+			name:    "arguments, environment and stdin reach the sandbox",
+			handler: fake.Static(fake.Run{Stdout: "ok"}),
+			req: models.ExecutionRequest{
+				Language:    "python3",
+				Code:        "print(input())",
+				Arguments:   []string{"-v", "two words"},
+				Environment: map[string]string{"MODE": "test"},
+				Stdin:       "line\n",
+			},
+			status: "SUCCESS",
+			check: func(t *testing.T, sub *models.Submission, calls []fake.Call) {
+				if len(calls) != 1 {
+					t.Fatalf("%d sandboxes created, want 1", len(calls))
+				}
+				spec := calls[0].Spec
+				if !reflect.DeepEqual(spec.Arguments, []string{"-v", "two words"}) {
+					t.Errorf("arguments %q", spec.Arguments)
+				}
+				if spec.Environment["MODE"] != "test" {
+					t.Errorf("environment %v", spec.Environment)
+				}
+				if spec.Stdin != "line\n" {
+					t.Errorf("stdin %q", spec.Stdin)
+				}
+				if calls[0].Files["driver.py"] != "print(input())" {
+					t.Errorf("code was not written as driver.py: %v", calls[0].Files)
+				}
+			},
+		},
+		{
+			name:    "sandbox cannot be created",
+			handler: fake.Static(fake.Run{Err: errUnavailable}),
+			req:     models.ExecutionRequest{Language: "python3", Code: "print(1)"},
+			status:  "ERROR",
+			check: func(t *testing.T, sub *models.Submission, calls []fake.Call) {
+				if !strings.Contains(sub.StdErr, errUnavailable.Error()) {
+					t.Errorf("stderr %q does not contain the sandbox error", sub.StdErr)
+				}
+			},
+		},
+		{
+			name:      "project report written by the tests",
+			handler:   writeReport(passingReport),
+			questions: []models.Question{project},
+			req:       models.ExecutionRequest{Language: "pytest", QuestionID: "p1", Files: map[string]string{"app.py": "", "test_app.py": ""}},
+			status:    "SUCCESS",
+			check: func(t *testing.T, sub *models.Submission, calls []fake.Call) {
+				if sub.PassedCount != 1 || sub.TotalCount != 1 {
+					t.Errorf("passed %d of %d, want 1 of 1", sub.PassedCount, sub.TotalCount)
+				}
+			},
+		},
+		{
+			name:      "project report forged by the submission",
+			handler:   fake.Static(fake.Run{Files: map[string]string{"report.xml": passingReport}}),
+			questions: []models.Question{project},
+			req:       models.ExecutionRequest{Language: "pytest", QuestionID: "p1", Files: map[string]string{"app.py": "", "report.xml": passingReport}},
+			status:    "ERROR",
+			check: func(t *testing.T, sub *models.Submission, calls []fake.Call) {
+				if !strings.Contains(sub.StdErr, "wrote no report") {
+					t.Errorf("stderr %q does not report the missing report", sub.StdErr)
+				}
+			},
+		},
+		{
+			name:      "project plugging into the test framework",
+			handler:   writeReport(passingReport),
+			questions: []models.Question{project},
+			req:       models.ExecutionRequest{Language: "pytest", QuestionID: "p1", Files: map[string]string{"app.py": "", "tests/conftest.py": ""}},
+			status:    "ERROR",
+			check: func(t *testing.T, sub *models.Submission, calls []fake.Call) {
+				if !strings.Contains(sub.StdErr, "tests/conftest.py") {
+					t.Errorf("stderr %q does not name the framework file", sub.StdErr)
+				}
+				if len(calls) != 0 {
+					t.Errorf("%d sandboxes created, want none", len(calls))
+				}
+			},
+		},
+		{
+			name:      "project leaving out an expected test",
+			handler:   writeReport(passingReport),
+			questions: []models.Question{expected},
+			req:       models.ExecutionRequest{Language: "pytest", QuestionID: "p2", Files: map[string]string{"app.py": "", "test_app.py": ""}},
+			status:    "FAILURE",
+			check: func(t *testing.T, sub *models.Submission, calls []fake.Call) {
+				if sub.PassedCount != 1 || sub.TotalCount != 2 {
+					t.Errorf("passed %d of %d, want 1 of 2", sub.PassedCount, sub.TotalCount)
+				}
+				if !strings.Contains(sub.StdErr, "Missing tests: test_app.test_sub.") {
+					t.Errorf("stderr %q does not name the missing test", sub.StdErr)
+				}
+			},
+		},
+		{
+			name: "unit test report written by the driver",
+			handler: func(spec sandbox.RunSpec, files map[string]string) fake.Run {
+				return fake.Run{Files: map[string]string{junitxml(files): passingReport}}
+			},
+			questions: []models.Question{unitTests},
+			req:       models.ExecutionRequest{Language: "python3", Code: "def add(a, b): return a + b", QuestionID: "u1"},
+			status:    "SUCCESS",
+			check: func(t *testing.T, sub *models.Submission, calls []fake.Call) {
+				if report := junitxml(calls[0].Files); report == "" || report == "report.xml" {
+					t.Errorf("driver writes its report to %q", report)
+				}
+			},
+		},
+		{
+			name:      "unit test report guessed by a solution exiting early",
+			handler:   forgeReport,
+			questions: []models.Question{unitTests},
+			req:       models.ExecutionRequest{Language: "python3", Code: "import os; os._exit(0)", QuestionID: "u1"},
+			status:    "ERROR",
+			check: func(t *testing.T, sub *models.Submission, calls []fake.Call) {
+				// the driver holding the path deletes itself before the
+				// solution is imported
+				report := junitxml(calls[0].Files)
+				for name, content := range calls[0].Files {
+					if name != "driver.py" && strings.Contains(content, report) {
+						t.Errorf("%s reveals the report path", name)
+					}
+				}
+			},
+		},
+		{
+			// Not defended: the solution runs inside the pytest process,
+			// which knows where the report goes.
+			name:      "unit test report forged by the solution inside pytest",
+			handler:   forgeReport,
+			questions: []models.Question{unitTests},
+			req:       models.ExecutionRequest{Language: "python3", Code: inProcessForgery, QuestionID: "u1"},
+			status:    "SUCCESS",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hs := start(t, tt.handler, tt.questions...)
+			sub := submit(t, hs, tt.req)
+			if sub.Status != tt.status {
+				t.Errorf("status %s, want %s (stdout %q, stderr %q)", sub.Status, tt.status, sub.StdOut, sub.StdErr)
+			}
+			if tt.check != nil {
+				tt.check(t, sub, hs.Sandbox.Calls())
+			}
+		})
+	}
+}
+
+func TestCancel(t *testing.T) {
+	hs := start(t, fake.Static(fake.Run{Stdout: "late", Delay: 4 * time.Second}))
+	id, err := hs.Submit(models.ExecutionRequest{Language: "python3", Code: "import time; time.sleep(60)"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cancel once the sandbox runs, so the worker has to kill it
+	deadline := time.Now().Add(5 * time.Second)
+	for len(hs.Sandbox.Calls()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the job was never started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var res models.ExecutionResponse
+	status, err := hs.Do(http.MethodDelete, "/v1/submissions/"+id, nil, &res)
+	if err != nil || status != http.StatusOK || res.Status != "CANCELLED" {
+		t.Fatalf("cancel returned %d %v %+v", status, err, res)
+	}
+
+	sub, err := hs.Wait(id, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Status != "CANCELLED" {
+		t.Errorf("status %s, want CANCELLED", sub.Status)
+	}
+	// the status is set by the API, the worker kills the sandbox right after
+	for !hs.Sandbox.Calls()[0].Killed {
+		if time.Now().After(deadline) {
+			t.Fatal("the sandbox of the cancelled job was not killed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a finished submission cannot be cancelled again
+	status, _ = hs.Do(http.MethodDelete, "/v1/submissions/"+id, nil, nil)
+	if status != http.StatusConflict {
+		t.Errorf("cancelling again returned %d, want %d", status, http.StatusConflict)
+	}
+}
+
+func TestRejudge(t *testing.T) {
+	hs := start(t, fake.Sequence(
+		fake.Run{Stdout: `[{"test_case_id":"1","status":"FAILED","expected":"2","actual":"3"}]`},
+		fake.Run{Stdout: "[]"},
+	), question)
+	first := submit(t, hs, models.ExecutionRequest{Language: "python3", Code: "def solve(x): return 2*int(x)", QuestionID: "q1"})
+	if first.Status != "FAILURE" {
+		t.Fatalf("status %s, want FAILURE", first.Status)
+	}
+
+	var res models.ExecutionResponse
+	status, err := hs.Do(http.MethodPost, "/v1/admin/submissions/"+first.ID+"/rejudge", nil, &res)
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("rejudge returned %d %v", status, err)
+	}
+	if res.SubmissionID != first.ID {
+		t.Fatalf("rejudge created submission %s instead of judging %s again", res.SubmissionID, first.ID)
+	}
+	second, err := hs.Wait(first.ID, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Status != "SUCCESS" || second.PassedCount != 2 || second.StdErr != "" {
+		t.Errorf("rejudged submission %+v", second)
+	}
+	if n := len(hs.Sandbox.Calls()); n != 2 {
+		t.Errorf("%d sandboxes created, want 2", n)
+	}
+
+	// generation runs do not keep their inputs
+	var gen struct {
+		SubmissionID string `json:"submission_id"`
+	}
+	hs.Do(http.MethodPost, "/v1/admin/generate", models.GenerateRequest{Language: "python3", Code: "print(1)", QuestionID: "q1", AdminInputs: []string{"1"}}, &gen)
+	if _, err := hs.Wait(gen.SubmissionID, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	status, _ = hs.Do(http.MethodPost, "/v1/admin/submissions/"+gen.SubmissionID+"/rejudge", nil, nil)
+	if status != http.StatusBadRequest {
+		t.Errorf("rejudging a generation run returned %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestPublicQuestion(t *testing.T) {
+	tests := []struct {
+		name     string
+		question models.Question
+		hidden   string
+		shown    string
+	}{
+		{
+			name: "project files",
+			question: models.Question{ID: "p1", Title: "Project", Project: &models.Project{
+				BuildSystem: "pytest",
+				Files:       map[string]string{"test_hidden.py": "def test_secret(): pass"},
+			}},
+			hidden: "test_secret",
+			shown:  `"build_system":"pytest"`,
+		},
+		{
+			name: "unit tests",
+			question: models.Question{ID: "u1", Title: "Unit tests", UnitTests: &models.UnitTests{
+				Framework: models.FrameworkPytest,
+				Code:      "def test_secret(): pass",
+			}},
+			hidden: "test_secret",
+			shown:  `"framework":"pytest"`,
+		},
+		{
+			name: "sql reference",
+			question: models.Question{ID: "s1", Title: "Query", SQL: &models.SQLQuestion{
+				Schema:    "CREATE TABLE t (a INT);",
+				Reference: "SELECT secret FROM t;",
+			}},
+			hidden: "secret",
+			shown:  "CREATE TABLE t",
+		},
+		{
+			name: "scorer",
+			question: models.Question{
+				ID:        "sc1",
+				Title:     "Scored",
+				TestCases: []models.TestCase{{ID: "1", Input: "1", ExpectedOutput: "1"}},
+				Scoring:   &models.Scoring{Scorer: "print(secret)", ScorerLang: "python3", Aggregate: "average"},
+			},
+			hidden: "secret",
+			shown:  `"aggregate":"average"`,
+		},
+		{
+			name: "solution and generator",
+			question: models.Question{
+				ID:              "g1",
+				Title:           "Generated",
+				SolutionCode:    "print(secret)",
+				SolutionLang:    "python3",
+				GeneratorConfig: "import secret",
+			},
+			hidden: "secret",
+			shown:  `"title":"Generated"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hs := start(t, fake.Static(fake.Run{}), tt.question)
+			for _, path := range []string{"/v1/questions/" + tt.question.ID, "/v1/questions"} {
+				var res json.RawMessage
+				if status, err := hs.Do(http.MethodGet, path, nil, &res); err != nil || status != http.StatusOK {
+					t.Fatalf("GET %s returned %d %v", path, status, err)
+				}
+				if strings.Contains(string(res), tt.hidden) {
+					t.Errorf("GET %s shows hidden material: %s", path, res)
+				}
+				if !strings.Contains(string(res), tt.shown) {
+					t.Errorf("GET %s does not show %s: %s", path, tt.shown, res)
+				}
+			}
+
+			var full json.RawMessage
+			path := "/v1/admin/questions/" + tt.question.ID
+			if status, err := hs.Do(http.MethodGet, path, nil, &full); err != nil || status != http.StatusOK {
+				t.Fatalf("GET %s returned %d %v", path, status, err)
+			}
+			if !strings.Contains(string(full), tt.hidden) {
+				t.Errorf("GET %s does not show the full question: %s", path, full)
+			}
+		})
+	}
+}
+
+func TestTypedScoring(t *testing.T) {
+	q := models.Question{
+		ID:        "ts1",
+		Title:     "Typed scored",
+		Signature: &models.Signature{Function: "add", Params: []models.Param{{Name: "a", Type: "int"}, {Name: "b", Type: "int"}}, Returns: "int"},
+		TestCases: []models.TestCase{{ID: "1", Input: "2 3", ExpectedOutput: "5", Args: []json.RawMessage{json.RawMessage("2"), json.RawMessage("3")}}},
+		Scoring:   &models.Scoring{Scorer: "score", ScorerLang: "python3"},
+	}
+	hs := start(t, func(spec sandbox.RunSpec, files map[string]string) fake.Run {
+		tests, ok := files["tests.json"]
+		if !ok {
+			// the scorer accepts the output of the typed call only
+			if files["output.txt"] != "5" {
+				return fake.Run{Stdout: "wrong output", ExitCode: 1}
+			}
+			return fake.Run{Stdout: "1"}
+		}
+		var cases []models.TestCase
+		json.Unmarshal([]byte(tests), &cases)
+		if len(cases) != 1 || len(cases[0].Args) != 2 {
+			return fake.Run{Stdout: `{"generated":[{"input":"2 3","expected_output":"ERROR: add() missing 2 required positional arguments"}]}`}
+		}
+		return fake.Run{Stdout: `{"generated":[{"input":"2 3","args":[2,3],"expected_output":"5"}]}`}
+	}, q)
+
+	sub := submit(t, hs, models.ExecutionRequest{Language: "python3", Code: "def add(a, b): return a + b", QuestionID: "ts1"})
+	if sub.Status != "SUCCESS" {
+		t.Fatalf("status %s, want SUCCESS (stdout %q, stderr %q)", sub.Status, sub.StdOut, sub.StdErr)
+	}
+	if sub.Score == nil || *sub.Score != 1 {
+		t.Errorf("score %v, want 1", sub.Score)
+	}
+}
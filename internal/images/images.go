@@ -0,0 +1,216 @@
+// Package images shares the image state of the workers with the API. Every
+// worker periodically reports the images it holds and listens for re-pull
+// requests issued through the admin API.
+package images
+
+import (
+	"code-runner/internal/config"
+	"code-runner/internal/sandbox"
+	"code-runner/pkg/models"
+	"context"
+	"encoding/json"
+	"github.com/redis/go-redis/v9"
+	"github.com/zekrotja/rogu/log"
+	"strings"
+	"time"
+)
+
+const (
+	statusKey   = "images:status"
+	pullChannel = "images:pull"
+)
+
+// Status is the state of an image as reported by a worker instance.
+type Status struct {
+	sandbox.ImageStatus
+	Instance   string    `json:"instance"`
+	ReportedAt time.Time `json:"reported_at"`
+}
+
+type pullRequest struct {
+	Language string `json:"language"`
+}
+
+func newClient(cfg *config.EnvProvider) *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:     cfg.Config().Redis.Addr,
+		Password: cfg.Config().Redis.Pwd,
+		DB:       0,
+	})
+}
+
+// Service runs on workers. It pre-pulls the images of all specs, publishes
+// their status and executes re-pull requests.
+type Service struct {
+	cfg    *config.EnvProvider
+	mgr    *sandbox.Manager
+	client *redis.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+	ready  chan struct{}
+	done   chan struct{}
+}
+
+func NewService(cfg *config.EnvProvider, mgr *sandbox.Manager) *Service {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Service{
+		cfg:    cfg,
+		mgr:    mgr,
+		client: newClient(cfg),
+		ctx:    ctx,
+		cancel: cancel,
+		ready:  make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start pulls the images in the background and reports each one as soon as
+// its pull completed.
+func (s *Service) Start() {
+	sub := s.client.Subscribe(s.ctx, pullChannel)
+	go func() {
+		defer close(s.done)
+		defer sub.Close()
+
+		if s.cfg.Config().Images.PrePull {
+			if err := s.mgr.PrepareAll(func(models.Spec) { s.report() }); err != nil {
+				log.Error().Err(err).Msg("Not all images could be pre-pulled")
+			}
+		}
+		s.report()
+		close(s.ready)
+
+		interval := time.Duration(s.cfg.Config().Images.StatusIntervalSeconds) * time.Second
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		msgs := sub.Channel()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+				s.report()
+			case msg, ok := <-msgs:
+				if !ok {
+					return
+				}
+				var req pullRequest
+				if err := json.Unmarshal([]byte(msg.Payload), &req); err != nil {
+					log.Warn().Err(err).Msg("Invalid image pull request")
+					continue
+				}
+				log.Info().Field("language", req.Language).Msg("Re-pulling images")
+				if err := s.mgr.Pull(req.Language); err != nil {
+					log.Error().Err(err).Field("language", req.Language).Msg("Failed to re-pull images")
+				}
+				s.report()
+			}
+		}
+	}()
+}
+
+// Ready is closed once the pre-pull is done.
+func (s *Service) Ready() <-chan struct{} { return s.ready }
+
+// Stop ends reporting and withdraws the reports of this instance.
+func (s *Service) Stop() {
+	s.cancel()
+	<-s.done
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if fields := s.fields(ctx); len(fields) > 0 {
+		s.client.HDel(ctx, statusKey, fields...)
+	}
+	s.client.Close()
+}
+
+func (s *Service) report() {
+	instance := s.cfg.Config().InstanceID
+	now := time.Now()
+	values := make(map[string]interface{})
+	for _, st := range s.mgr.ImageStatus() {
+		data, err := json.Marshal(Status{ImageStatus: st, Instance: instance, ReportedAt: now})
+		if err != nil {
+			continue
+		}
+		values[instance+"/"+st.Language+"/"+st.Host] = data
+	}
+	if len(values) == 0 {
+		return
+	}
+	if err := s.client.HSet(s.ctx, statusKey, values).Err(); err != nil && s.ctx.Err() == nil {
+		log.Error().Err(err).Msg("Failed to report image status")
+	}
+}
+
+// fields returns the status fields reported by this instance.
+func (s *Service) fields(ctx context.Context) []string {
+	prefix := s.cfg.Config().InstanceID + "/"
+	keys, err := s.client.HKeys(ctx, statusKey).Result()
+	if err != nil {
+		return nil
+	}
+	var res []string
+	for _, k := range keys {
+		if strings.HasPrefix(k, prefix) {
+			res = append(res, k)
+		}
+	}
+	return res
+}
+
+// Client is used by the API to read the reported image status and to
+// request re-pulls.
+type Client struct {
+	cfg    *config.EnvProvider
+	client *redis.Client
+	ctx    context.Context
+}
+
+func NewClient(cfg *config.EnvProvider) *Client {
+	return &Client{cfg: cfg, client: newClient(cfg), ctx: context.Background()}
+}
+
+// Statuses returns the latest reports of all workers. Reports of instances
+// which stopped reporting are dropped.
+func (c *Client) Statuses() ([]Status, error) {
+	values, err := c.client.HGetAll(c.ctx, statusKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	interval := time.Duration(c.cfg.Config().Images.StatusIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	staleBefore := time.Now().Add(-3 * interval)
+
+	res := []Status{}
+	var stale []string
+	for field, data := range values {
+		var st Status
+		if err := json.Unmarshal([]byte(data), &st); err != nil || st.ReportedAt.Before(staleBefore) {
+			stale = append(stale, field)
+			continue
+		}
+		res = append(res, st)
+	}
+	if len(stale) > 0 {
+		c.client.HDel(c.ctx, statusKey, stale...)
+	}
+	return res, nil
+}
+
+// RequestPull asks all workers to pull the image of the language again. An
+// empty language re-pulls all images.
+func (c *Client) RequestPull(language string) error {
+	data, err := json.Marshal(pullRequest{Language: language})
+	if err != nil {
+		return err
+	}
+	return c.client.Publish(c.ctx, pullChannel, data).Err()
+}
@@ -0,0 +1,21 @@
+package metrics
+
+import (
+	"expvar"
+	"net/http"
+)
+
+// Counters are published through expvar. The API serves them at
+// /debug/vars, worker-only processes when RUNNER_METRICS_BINDADDRESS is set.
+var (
+	SweeperRuns     = expvar.NewInt("sweeper_runs_total")
+	SweeperRequeued = expvar.NewInt("sweeper_requeued_total")
+	SweeperFailed   = expvar.NewInt("sweeper_failed_total")
+)
+
+// ListenAndServeBlocking serves all published variables at /debug/vars.
+func ListenAndServeBlocking(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,228 @@
+package queue
+
+import (
+	"code-runner/pkg/models"
+	"sync"
+	"time"
+)
+
+// MemoryQueue is an in-process Queue for running the engine without Redis,
+// e.g. in tests. It is not shared between processes.
+type MemoryQueue struct {
+	mu       sync.Mutex
+	jobs     []models.JobPayload
+	payloads map[string]models.JobPayload
+	leases   map[string]lease
+	locks    map[string]lease
+	alive    map[string]lease
+	notify   chan struct{}
+
+	cancelled   map[string]bool
+	subscribers map[chan string]struct{}
+}
+
+type lease struct {
+	owner   string
+	expires time.Time
+}
+
+func (l lease) live() bool { return time.Now().Before(l.expires) }
+
+func NewMemoryQueue() *MemoryQueue {
+	return &MemoryQueue{
+		payloads: make(map[string]models.JobPayload),
+		leases:   make(map[string]lease),
+		locks:    make(map[string]lease),
+		alive:    make(map[string]lease),
+		notify:   make(chan struct{}, 1),
+
+		cancelled:   make(map[string]bool),
+		subscribers: make(map[chan string]struct{}),
+	}
+}
+
+func (q *MemoryQueue) Enqueue(payload models.JobPayload) error {
+	payload.EnqueuedAt = time.Now()
+	q.mu.Lock()
+	q.jobs = append(q.jobs, payload)
+	q.payloads[payload.SubmissionID] = payload
+	q.mu.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (q *MemoryQueue) Dequeue(owner string, ttl, timeout time.Duration) (*models.JobPayload, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		q.mu.Lock()
+		if len(q.jobs) > 0 {
+			payload := q.jobs[0]
+			q.jobs = q.jobs[1:]
+			q.leases[payload.SubmissionID] = lease{owner: owner, expires: time.Now().Add(ttl)}
+			more := len(q.jobs) > 0
+			q.mu.Unlock()
+			if more {
+				// wake up the next waiting worker
+				select {
+				case q.notify <- struct{}{}:
+				default:
+				}
+			}
+			return &payload, nil
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.notify:
+		case <-deadline.C:
+			return nil, ErrNotFound
+		}
+	}
+}
+
+func (q *MemoryQueue) Length() (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return int64(len(q.jobs)), nil
+}
+
+func (q *MemoryQueue) OldestAge() (time.Duration, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.jobs) == 0 {
+		return 0, nil
+	}
+	return time.Since(q.jobs[0].EnqueuedAt), nil
+}
+
+func (q *MemoryQueue) IsQueued(id string) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, j := range q.jobs {
+		if j.SubmissionID == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (q *MemoryQueue) Payload(id string) (*models.JobPayload, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	payload, ok := q.payloads[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &payload, nil
+}
+
+func (q *MemoryQueue) Claim(id, owner string, ttl time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.leases[id] = lease{owner: owner, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (q *MemoryQueue) Owner(id string) (string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if l, ok := q.leases[id]; ok && l.live() {
+		return l.owner, nil
+	}
+	return "", nil
+}
+
+func (q *MemoryQueue) Release(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.leases, id)
+	return nil
+}
+
+func (q *MemoryQueue) Complete(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.leases, id)
+	delete(q.payloads, id)
+	return nil
+}
+
+func (q *MemoryQueue) TryLock(name, owner string, ttl time.Duration) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if l, ok := q.locks[name]; ok && l.live() {
+		return false, nil
+	}
+	q.locks[name] = lease{owner: owner, expires: time.Now().Add(ttl)}
+	return true, nil
+}
+
+func (q *MemoryQueue) Heartbeat(instance string, ttl time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.alive[instance] = lease{owner: instance, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (q *MemoryQueue) IsAlive(instance string) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	l, ok := q.alive[instance]
+	return ok && l.live(), nil
+}
+
+func (q *MemoryQueue) Remove(id string) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, job := range q.jobs {
+		if job.SubmissionID == id {
+			q.jobs = append(q.jobs[:i:i], q.jobs[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (q *MemoryQueue) Cancel(id string) error {
+	q.mu.Lock()
+	q.cancelled[id] = true
+	subs := make([]chan string, 0, len(q.subscribers))
+	for ch := range q.subscribers {
+		subs = append(subs, ch)
+	}
+	q.mu.Unlock()
+
+	for _, ch := range subs {
+		select {
+		case ch <- id:
+		default:
+		}
+	}
+	return nil
+}
+
+func (q *MemoryQueue) IsCancelled(id string) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.cancelled[id], nil
+}
+
+func (q *MemoryQueue) Cancellations(stop <-chan struct{}) <-chan string {
+	ch := make(chan string, 16)
+	q.mu.Lock()
+	q.subscribers[ch] = struct{}{}
+	q.mu.Unlock()
+
+	go func() {
+		<-stop
+		q.mu.Lock()
+		delete(q.subscribers, ch)
+		q.mu.Unlock()
+	}()
+	return ch
+}
@@ -0,0 +1,38 @@
+package queue
+
+import (
+	"code-runner/pkg/models"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// ErrNotFound is returned by Dequeue when no job arrived within the timeout
+// and by Payload for jobs which have already been completed.
+var ErrNotFound = redis.Nil
+
+// Queue hands jobs from the API to the workers and tracks which instance
+// owns a job in flight.
+type Queue interface {
+	Enqueue(payload models.JobPayload) error
+	// Dequeue takes the next job and claims it for owner with a lease of
+	// ttl in the same step, so a job is always either waiting or owned.
+	Dequeue(owner string, ttl, timeout time.Duration) (*models.JobPayload, error)
+	Length() (int64, error)
+	OldestAge() (time.Duration, error)
+	IsQueued(id string) (bool, error)
+	Payload(id string) (*models.JobPayload, error)
+	Claim(id, owner string, ttl time.Duration) error
+	Owner(id string) (string, error)
+	Release(id string) error
+	Complete(id string) error
+	TryLock(name, owner string, ttl time.Duration) (bool, error)
+	Heartbeat(instance string, ttl time.Duration) error
+	IsAlive(instance string) (bool, error)
+
+	Remove(id string) (bool, error)
+	Cancel(id string) error
+	IsCancelled(id string) (bool, error)
+	Cancellations(stop <-chan struct{}) <-chan string
+}
+
+var _ Queue = (*RedisQueue)(nil)
@@ -27,27 +27,246 @@ func NewRedisQueue(addr, pwd string) *RedisQueue {
 	}
 }
 
+// Besides the list itself the queue keeps track of
+//   - the IDs of all jobs currently waiting in the list (queuedKey)
+//   - a token per enqueued job which idle workers block on (signalKey)
+//   - the payload of every job until it is completed (payloadKey)
+//   - a lease per job in flight, holding the owning instance (leaseKey)
+//   - a heartbeat per running instance (instanceKey)
+//   - a flag per cancelled job (cancelKey), announced on cancelChannel
+//
+// so that lost jobs and leftovers of crashed instances can be detected.
+func (q *RedisQueue) queuedKey() string            { return q.key + ":queued" }
+func (q *RedisQueue) signalKey() string            { return q.key + ":signal" }
+func (q *RedisQueue) payloadKey() string           { return q.key + ":payloads" }
+func (q *RedisQueue) leaseKey(id string) string    { return q.key + ":lease:" + id }
+func (q *RedisQueue) instanceKey(id string) string { return q.key + ":instance:" + id }
+func (q *RedisQueue) cancelKey(id string) string   { return q.key + ":cancel:" + id }
+func (q *RedisQueue) cancelChannel() string        { return q.key + ":cancel" }
+
+// cancelTTL bounds how long the cancellation of a job is remembered, it
+// only has to outlive the job.
+const cancelTTL = 24 * time.Hour
+
 func (q *RedisQueue) Enqueue(payload models.JobPayload) error {
+	payload.EnqueuedAt = time.Now()
 	data, err := json.Marshal(payload)
 	if err != nil {
 		return err
 	}
-	return q.client.RPush(q.ctx, q.key, data).Err()
+	_, err = q.client.TxPipelined(q.ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(q.ctx, q.payloadKey(), payload.SubmissionID, data)
+		pipe.SAdd(q.ctx, q.queuedKey(), payload.SubmissionID)
+		pipe.RPush(q.ctx, q.key, data)
+		pipe.RPush(q.ctx, q.signalKey(), 1)
+		return nil
+	})
+	return err
+}
+
+// dequeueScript pops the head of the queue, drops it from the waiting set
+// and leases it to the owner at once. It takes a token off the signal list
+// unless the caller already consumed one, and drops the tokens left over by
+// removed jobs once the queue is empty.
+//
+// KEYS: queue, signal, queued set, lease key prefix
+// ARGV: owner, lease in milliseconds, 1 if a token has been consumed
+var dequeueScript = redis.NewScript(`
+local data = redis.call('LPOP', KEYS[1])
+if not data then
+	redis.call('DEL', KEYS[2])
+	return false
+end
+if ARGV[3] ~= '1' then
+	redis.call('LPOP', KEYS[2])
+end
+if redis.call('LLEN', KEYS[1]) == 0 then
+	redis.call('DEL', KEYS[2])
+end
+local id = cjson.decode(data)['submission_id']
+redis.call('SREM', KEYS[3], id)
+redis.call('SET', KEYS[4] .. id, ARGV[1], 'PX', ARGV[2])
+return data
+`)
+
+func (q *RedisQueue) Dequeue(owner string, ttl, timeout time.Duration) (*models.JobPayload, error) {
+	deadline := time.Now().Add(timeout)
+	woken := "0"
+	for {
+		keys := []string{q.key, q.signalKey(), q.queuedKey(), q.leaseKey("")}
+		data, err := dequeueScript.Run(q.ctx, q.client, keys, owner, ttl.Milliseconds(), woken).Text()
+		if err == nil {
+			payload := new(models.JobPayload)
+			if err := json.Unmarshal([]byte(data), payload); err != nil {
+				return nil, err
+			}
+			return payload, nil
+		}
+		if err != redis.Nil {
+			return nil, err
+		}
+
+		// wait for the token of the next enqueued job
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil, redis.Nil
+		}
+		if err := q.client.BLPop(q.ctx, wait, q.signalKey()).Err(); err != nil {
+			return nil, err
+		}
+		woken = "1"
+	}
 }
 
-func (q *RedisQueue) Dequeue(timeout time.Duration) (*models.JobPayload, error) {
-	res, err := q.client.BLPop(q.ctx, timeout, q.key).Result()
+func (q *RedisQueue) Length() (int64, error) {
+	return q.client.LLen(q.ctx, q.key).Result()
+}
+
+// OldestAge returns how long the job at the head of the queue has been
+// waiting, or zero if the queue is empty.
+func (q *RedisQueue) OldestAge() (time.Duration, error) {
+	data, err := q.client.LIndex(q.ctx, q.key, 0).Bytes()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	payload := new(models.JobPayload)
+	if err := json.Unmarshal(data, payload); err != nil {
+		return 0, err
+	}
+	if payload.EnqueuedAt.IsZero() {
+		return 0, nil
+	}
+	return time.Since(payload.EnqueuedAt), nil
+}
+
+// IsQueued reports whether the job is still waiting in the queue.
+func (q *RedisQueue) IsQueued(id string) (bool, error) {
+	return q.client.SIsMember(q.ctx, q.queuedKey(), id).Result()
+}
+
+// Payload returns the payload the job was enqueued with, or redis.Nil if
+// the job has already been completed.
+func (q *RedisQueue) Payload(id string) (*models.JobPayload, error) {
+	data, err := q.client.HGet(q.ctx, q.payloadKey(), id).Bytes()
 	if err != nil {
 		return nil, err
 	}
-	// res[0] is key, res[1] is value
 	payload := new(models.JobPayload)
-	if err := json.Unmarshal([]byte(res[1]), payload); err != nil {
+	if err := json.Unmarshal(data, payload); err != nil {
 		return nil, err
 	}
 	return payload, nil
 }
 
-func (q *RedisQueue) Length() (int64, error) {
-	return q.client.LLen(q.ctx, q.key).Result()
-}
\ No newline at end of file
+// Claim marks the job as owned by the given instance for ttl. The lease
+// has to be renewed with Claim until the job is completed or released.
+func (q *RedisQueue) Claim(id, owner string, ttl time.Duration) error {
+	return q.client.Set(q.ctx, q.leaseKey(id), owner, ttl).Err()
+}
+
+// Owner returns the instance holding the lease of the job, or an empty
+// string if the job has no live owner.
+func (q *RedisQueue) Owner(id string) (string, error) {
+	owner, err := q.client.Get(q.ctx, q.leaseKey(id)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return owner, err
+}
+
+// Release drops the lease of a job without completing it, e.g. when the
+// job is handed back to the queue.
+func (q *RedisQueue) Release(id string) error {
+	return q.client.Del(q.ctx, q.leaseKey(id)).Err()
+}
+
+// Complete drops the lease and the stored payload of a finished job.
+func (q *RedisQueue) Complete(id string) error {
+	_, err := q.client.TxPipelined(q.ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(q.ctx, q.leaseKey(id))
+		pipe.HDel(q.ctx, q.payloadKey(), id)
+		return nil
+	})
+	return err
+}
+
+// TryLock acquires a named lock shared by all instances for ttl. It returns
+// false if another instance currently holds the lock.
+func (q *RedisQueue) TryLock(name, owner string, ttl time.Duration) (bool, error) {
+	return q.client.SetNX(q.ctx, q.key+":lock:"+name, owner, ttl).Result()
+}
+
+// Heartbeat marks the instance as alive for ttl. Instances renew it for as
+// long as they run, so others can tell which instances crashed.
+func (q *RedisQueue) Heartbeat(instance string, ttl time.Duration) error {
+	return q.client.Set(q.ctx, q.instanceKey(instance), time.Now().Unix(), ttl).Err()
+}
+
+// IsAlive reports whether the instance sent a heartbeat within its ttl.
+func (q *RedisQueue) IsAlive(instance string) (bool, error) {
+	n, err := q.client.Exists(q.ctx, q.instanceKey(instance)).Result()
+	return n > 0, err
+}
+
+// Remove takes a waiting job out of the queue. It returns false if the job
+// is not waiting, e.g. because a worker already picked it up.
+func (q *RedisQueue) Remove(id string) (bool, error) {
+	data, err := q.client.HGet(q.ctx, q.payloadKey(), id).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// the list holds the same encoding of the payload as the hash
+	n, err := q.client.LRem(q.ctx, q.key, 1, data).Result()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	return true, q.client.SRem(q.ctx, q.queuedKey(), id).Err()
+}
+
+// Cancel flags the job as cancelled and notifies all instances, so the one
+// running it can kill its sandbox.
+func (q *RedisQueue) Cancel(id string) error {
+	if err := q.client.Set(q.ctx, q.cancelKey(id), 1, cancelTTL).Err(); err != nil {
+		return err
+	}
+	return q.client.Publish(q.ctx, q.cancelChannel(), id).Err()
+}
+
+func (q *RedisQueue) IsCancelled(id string) (bool, error) {
+	n, err := q.client.Exists(q.ctx, q.cancelKey(id)).Result()
+	return n > 0, err
+}
+
+// Cancellations returns the IDs of jobs cancelled from now on until stop is
+// closed.
+func (q *RedisQueue) Cancellations(stop <-chan struct{}) <-chan string {
+	sub := q.client.Subscribe(q.ctx, q.cancelChannel())
+	ids := make(chan string)
+	go func() {
+		defer close(ids)
+		defer sub.Close()
+		msgs := sub.Channel()
+		for {
+			select {
+			case <-stop:
+				return
+			case msg, ok := <-msgs:
+				if !ok {
+					return
+				}
+				select {
+				case ids <- msg.Payload:
+				case <-stop:
+					return
+				}
+			}
+		}
+	}()
+	return ids
+}
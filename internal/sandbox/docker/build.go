@@ -0,0 +1,116 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"code-runner/pkg/models"
+	"context"
+	"errors"
+	"fmt"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"github.com/zekrotja/rogu/log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBuildLog bounds the build output kept for error messages.
+const maxBuildLog = 4 << 10
+
+// ensureBuilt builds the image of the spec on the host unless an image with
+// its content hash tag already exists.
+func (p *Provider) ensureBuilt(h *host, spec models.Spec) error {
+	mu := p.buildLock(h, spec)
+	mu.Lock()
+	defer mu.Unlock()
+
+	_, err := h.client.InspectImage(spec.ImageRef())
+	if err != dockerclient.ErrNoSuchImage {
+		return err
+	}
+	return p.buildLocked(h, spec, false)
+}
+
+// build builds the image of the spec on the host, even if it exists.
+func (p *Provider) build(h *host, spec models.Spec, noCache bool) error {
+	mu := p.buildLock(h, spec)
+	mu.Lock()
+	defer mu.Unlock()
+	return p.buildLocked(h, spec, noCache)
+}
+
+func (p *Provider) buildLock(h *host, spec models.Spec) *sync.Mutex {
+	v, _ := p.builds.LoadOrStore(h.endpoint+"|"+spec.ImageRef(), &sync.Mutex{})
+	return v.(*sync.Mutex)
+}
+
+func (p *Provider) buildLocked(h *host, spec models.Spec, noCache bool) error {
+	if _, err := h.client.InspectImage(spec.BaseRef()); err == dockerclient.ErrNoSuchImage {
+		if err := p.pull(h, spec); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	dockerfile := spec.Dockerfile()
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "Dockerfile", Mode: 0644, Size: int64(len(dockerfile))}); err != nil {
+		return err
+	}
+	if _, err := tw.Write([]byte(dockerfile)); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	if t := p.cfg.Config().Images.BuildTimeoutSeconds; t > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(t)*time.Second)
+		defer cancel()
+	}
+
+	log.Info().Fields("image", spec.ImageRef(), "language", spec.Language, "host", h.endpoint).Msg("Building image...")
+	start := time.Now()
+	out := &tailBuffer{max: maxBuildLog}
+	err := h.client.BuildImage(dockerclient.BuildImageOptions{
+		Context:        ctx,
+		Name:           spec.ImageRef(),
+		InputStream:    buf,
+		OutputStream:   out,
+		AuthConfigs:    *p.auths,
+		NoCache:        noCache,
+		RmTmpContainer: true,
+		Labels: map[string]string{
+			"code-runner.language": spec.Language,
+			"code-runner.base":     spec.BaseRef(),
+		},
+	})
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("building %s timed out", spec.ImageRef())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to build image for %s: %w\n%s", spec.Language, err, strings.TrimSpace(out.String()))
+	}
+	log.Info().Fields("image", spec.ImageRef(), "host", h.endpoint, "took", time.Since(start).String()).Msg("Image built")
+	return nil
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.max {
+		b.buf = b.buf[len(b.buf)-b.max:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string { return string(b.buf) }
@@ -0,0 +1,214 @@
+package docker
+
+import (
+	"code-runner/internal/config"
+	"errors"
+	"fmt"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"github.com/zekrotja/rogu/log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNoHost = errors.New("no healthy docker host with free capacity")
+
+// host is a single docker daemon sandboxes can be placed on.
+type host struct {
+	endpoint string
+	client   *dockerclient.Client
+	// capacity is the maximum number of containers placed on the host,
+	// zero means unlimited
+	capacity int
+
+	// guarded by hostSet.mu
+	active   int
+	healthy  bool
+	failures int
+}
+
+func (h *host) load() float64 {
+	if h.capacity <= 0 {
+		return float64(h.active) / 1e6
+	}
+	return float64(h.active) / float64(h.capacity)
+}
+
+func (h *host) full() bool { return h.capacity > 0 && h.active >= h.capacity }
+
+// hostSet places containers on the least loaded healthy docker host and
+// periodically health checks all hosts.
+type hostSet struct {
+	cfg *config.EnvProvider
+
+	mu    sync.Mutex
+	hosts []*host
+	freed chan struct{}
+	stop  chan struct{}
+}
+
+// newHostSet connects to all hosts of RUNNER_DOCKER_HOSTS, a comma separated
+// list of endpoints with an optional "=capacity" suffix. Without it the
+// daemon from the DOCKER_* environment is used.
+func newHostSet(cfg *config.EnvProvider) (*hostSet, error) {
+	hs := &hostSet{cfg: cfg, freed: make(chan struct{}, 1), stop: make(chan struct{})}
+
+	spec := strings.TrimSpace(cfg.Config().Docker.Hosts)
+	if spec == "" {
+		client, err := dockerclient.NewClientFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		hs.hosts = append(hs.hosts, &host{endpoint: client.Endpoint(), client: client, healthy: true})
+		return hs, nil
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		endpoint, capacity := strings.TrimSpace(entry), 0
+		if i := strings.LastIndex(endpoint, "="); i >= 0 {
+			n, err := strconv.Atoi(endpoint[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid capacity in docker host %q", entry)
+			}
+			endpoint, capacity = endpoint[:i], n
+		}
+		client, err := newClient(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("docker host %s: %w", endpoint, err)
+		}
+		hs.hosts = append(hs.hosts, &host{endpoint: endpoint, client: client, capacity: capacity, healthy: true})
+
+		if strings.HasPrefix(endpoint, "tcp://") && cfg.Config().Sandbox.Workspace == config.WorkspaceBind {
+			log.Warn().Field("host", endpoint).Msg("Remote docker host with bind mounted workspaces, set RUNNER_SANDBOX_WORKSPACE=copy unless it shares the filesystem")
+		}
+	}
+	return hs, nil
+}
+
+// newClient uses the TLS material from DOCKER_CERT_PATH for tcp endpoints,
+// like the docker CLI does.
+func newClient(endpoint string) (*dockerclient.Client, error) {
+	certPath := os.Getenv("DOCKER_CERT_PATH")
+	if certPath != "" && strings.HasPrefix(endpoint, "tcp://") {
+		return dockerclient.NewTLSClient(endpoint,
+			filepath.Join(certPath, "cert.pem"),
+			filepath.Join(certPath, "key.pem"),
+			filepath.Join(certPath, "ca.pem"))
+	}
+	return dockerclient.NewClient(endpoint)
+}
+
+// start begins health checking the hosts.
+func (hs *hostSet) start() {
+	hs.check()
+	go func() {
+		ticker := time.NewTicker(time.Duration(hs.cfg.Config().Docker.HealthIntervalSeconds) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-hs.stop:
+				return
+			case <-ticker.C:
+				hs.check()
+			}
+		}
+	}()
+}
+
+func (hs *hostSet) close() { close(hs.stop) }
+
+func (hs *hostSet) check() {
+	threshold := hs.cfg.Config().Docker.FailureThreshold
+	for _, h := range hs.hosts {
+		err := h.client.Ping()
+
+		hs.mu.Lock()
+		if err == nil {
+			if !h.healthy {
+				log.Info().Field("host", h.endpoint).Msg("Docker host is healthy again")
+			}
+			h.healthy, h.failures = true, 0
+		} else {
+			h.failures++
+			if h.healthy && h.failures >= threshold {
+				h.healthy = false
+				log.Error().Err(err).Field("host", h.endpoint).Msg("Docker host failed health checks, no longer placing sandboxes on it")
+			}
+		}
+		hs.mu.Unlock()
+	}
+	hs.notify()
+}
+
+// acquire reserves a slot on the least loaded healthy host. If all hosts
+// are full or unhealthy it waits for the placement timeout.
+func (hs *hostSet) acquire() (*host, error) {
+	deadline := time.NewTimer(time.Duration(hs.cfg.Config().Docker.PlacementTimeoutSeconds) * time.Second)
+	defer deadline.Stop()
+	for {
+		if h := hs.tryAcquire(); h != nil {
+			return h, nil
+		}
+		select {
+		case <-hs.freed:
+		case <-time.After(500 * time.Millisecond):
+		case <-deadline.C:
+			return nil, errNoHost
+		}
+	}
+}
+
+func (hs *hostSet) tryAcquire() *host {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	var best *host
+	for _, h := range hs.hosts {
+		if !h.healthy || h.full() {
+			continue
+		}
+		if best == nil || h.load() < best.load() {
+			best = h
+		}
+	}
+	if best != nil {
+		best.active++
+	}
+	return best
+}
+
+// release frees a slot reserved with acquire.
+func (hs *hostSet) release(h *host) {
+	hs.mu.Lock()
+	h.active--
+	hs.mu.Unlock()
+	hs.notify()
+}
+
+func (hs *hostSet) notify() {
+	select {
+	case hs.freed <- struct{}{}:
+	default:
+	}
+}
+
+func (hs *hostSet) isHealthy(h *host) bool {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	return h.healthy
+}
+
+// healthy returns all hosts currently passing their health checks.
+func (hs *hostSet) healthy() []*host {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	var res []*host
+	for _, h := range hs.hosts {
+		if h.healthy {
+			res = append(res, h)
+		}
+	}
+	return res
+}
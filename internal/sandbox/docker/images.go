@@ -0,0 +1,154 @@
+package docker
+
+import (
+	"code-runner/internal/config"
+	"code-runner/internal/sandbox"
+	"code-runner/pkg/models"
+	"context"
+	"errors"
+	"fmt"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"github.com/zekrotja/rogu/log"
+	"strings"
+	"time"
+)
+
+// loadAuths reads the registry credentials of ~/.docker/config.json and
+// adds the ones configured for the runner.
+func loadAuths(cfg *config.EnvProvider) *dockerclient.AuthConfigurations {
+	auths, err := dockerclient.NewAuthConfigurationsFromDockerCfg()
+	if err != nil {
+		auths = &dockerclient.AuthConfigurations{}
+	}
+	if auths.Configs == nil {
+		auths.Configs = make(map[string]dockerclient.AuthConfiguration)
+	}
+
+	r := cfg.Config().Registry
+	if r.Username != "" {
+		auths.Configs[r.Server] = dockerclient.AuthConfiguration{
+			Username:      r.Username,
+			Password:      r.Password,
+			ServerAddress: r.Server,
+		}
+	}
+	return auths
+}
+
+// authFor returns the credentials for the registry hosting repo.
+func (p *Provider) authFor(repo string) dockerclient.AuthConfiguration {
+	registry := registryHost(repo)
+	for server, auth := range p.auths.Configs {
+		s := strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+		s = strings.SplitN(s, "/", 2)[0]
+		if s == registry || (registry == "docker.io" && (s == "index.docker.io" || s == "registry-1.docker.io")) {
+			return auth
+		}
+	}
+	// credentials configured without a server apply to every registry
+	if auth, ok := p.auths.Configs[""]; ok {
+		return auth
+	}
+	return dockerclient.AuthConfiguration{}
+}
+
+func registryHost(repo string) string {
+	parts := strings.SplitN(repo, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return parts[0]
+	}
+	return "docker.io"
+}
+
+// pull fetches the spec image, or the base of a built image, on the host,
+// bounded by the pull timeout.
+func (p *Provider) pull(h *host, spec models.Spec) error {
+	repo, tag := parseImage(spec.BaseRef())
+	log.Info().Fields("image", spec.BaseRef(), "host", h.endpoint).Msg("Pulling image...")
+
+	ctx := context.Background()
+	if t := p.cfg.Config().Registry.PullTimeoutSeconds; t > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(t)*time.Second)
+		defer cancel()
+	}
+
+	err := h.client.PullImage(dockerclient.PullImageOptions{
+		Repository: repo,
+		Tag:        tag,
+		Context:    ctx,
+	}, p.authFor(repo))
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("pulling %s timed out", spec.BaseRef())
+	}
+	return err
+}
+
+// Pull fetches the spec image again on every healthy host. Built images
+// are rebuilt from a freshly pulled base without using the build cache.
+func (p *Provider) Pull(spec models.Spec) error {
+	var errs []error
+	for _, h := range p.hosts.healthy() {
+		err := p.pull(h, spec)
+		if err == nil && spec.Build != nil {
+			err = p.build(h, spec, true)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", h.endpoint, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ImageStatus inspects the spec image on every healthy host.
+func (p *Provider) ImageStatus(spec models.Spec) []sandbox.ImageStatus {
+	var res []sandbox.ImageStatus
+	repo, _ := parseImage(spec.ImageRef())
+	for _, h := range p.hosts.healthy() {
+		st := sandbox.ImageStatus{
+			Language: spec.Language,
+			Backend:  models.BackendDocker,
+			Image:    spec.ImageRef(),
+			Host:     h.endpoint,
+		}
+		img, err := h.client.InspectImage(spec.ImageRef())
+		switch {
+		case err == dockerclient.ErrNoSuchImage:
+		case err != nil:
+			st.Error = err.Error()
+		default:
+			st.Present = true
+			st.Size = img.Size
+			for _, d := range img.RepoDigests {
+				if name, digest, ok := strings.Cut(d, "@"); ok && name == repo {
+					st.Digest = digest
+				}
+			}
+			if st.Digest == "" && len(img.RepoDigests) > 0 {
+				_, st.Digest, _ = strings.Cut(img.RepoDigests[0], "@")
+			}
+			// locally built images have no registry digest
+			if st.Digest == "" {
+				st.Digest = img.ID
+			}
+		}
+		res = append(res, st)
+	}
+	return res
+}
+
+// parseImage splits an image reference into repository and tag. For
+// references pinned by digest the digest is returned as tag, which the
+// daemon accepts for pulls.
+func parseImage(img string) (string, string) {
+	if name, digest, ok := strings.Cut(img, "@"); ok {
+		if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+			name = name[:i]
+		}
+		return name, digest
+	}
+	if i := strings.LastIndex(img, ":"); i > strings.LastIndex(img, "/") {
+		return img[:i], img[i+1:]
+	}
+	return img, "latest"
+}
@@ -4,6 +4,7 @@ import (
 	"code-runner/internal/config"
 	"code-runner/internal/sandbox"
 	"code-runner/pkg/models"
+	"errors"
 	"fmt"
 	dockerclient "github.com/fsouza/go-dockerclient"
 	"github.com/rs/xid"
@@ -11,97 +12,236 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
+// workspaceRoot is the directory inside of containers holding job workspaces
+const workspaceRoot = "/var/tmp/exec"
+
+// Provider runs sandboxes as containers, spread over one or more docker
+// hosts.
 type Provider struct {
-	cfg    *config.EnvProvider
-	client *dockerclient.Client
+	cfg   *config.EnvProvider
+	hosts *hostSet
+	warm  *WarmPool
+	auths *dockerclient.AuthConfigurations
+	// builds serializes builds of the same image on a host
+	builds sync.Map
 }
 
 func NewProvider(cfg *config.EnvProvider) (*Provider, error) {
-	client, err := dockerclient.NewClientFromEnv()
+	hosts, err := newHostSet(cfg)
 	if err != nil {
 		return nil, err
 	}
-	return &Provider{cfg: cfg, client: client}, nil
+	hosts.start()
+
+	p := &Provider{cfg: cfg, hosts: hosts, auths: loadAuths(cfg)}
+	if cfg.Config().WarmPool.Enabled {
+		p.warm = newWarmPool(hosts, cfg, p.prepareOn)
+	}
+	return p, nil
+}
+
+// StartWarmPool begins keeping warm containers ready for the given specs.
+// It is a no-op if the warm pool is disabled.
+func (p *Provider) StartWarmPool(specs []models.Spec) {
+	if p.warm != nil {
+		p.warm.Start(specs)
+	}
+}
+
+// Close removes all containers kept by the provider itself.
+func (p *Provider) Close() {
+	if p.warm != nil {
+		p.warm.Close()
+	}
+	p.hosts.close()
 }
 
+// Prepare pulls the spec image on every healthy host.
 func (p *Provider) Prepare(spec models.Spec) error {
-	repo, tag := parseImage(spec.Image)
-	_, err := p.client.InspectImage(repo + ":" + tag)
+	var errs []error
+	for _, h := range p.hosts.healthy() {
+		if err := p.prepareOn(h, spec); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", h.endpoint, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p *Provider) prepareOn(h *host, spec models.Spec) error {
+	if spec.Build != nil {
+		return p.ensureBuilt(h, spec)
+	}
+	_, err := h.client.InspectImage(spec.ImageRef())
 	if err == dockerclient.ErrNoSuchImage {
-		log.Info().Fields("image", spec.Image).Msg("Pulling image...")
-		return p.client.PullImage(dockerclient.PullImageOptions{
-			Repository: repo, Tag: tag,
-		}, dockerclient.AuthConfiguration{})
+		return p.pull(h, spec)
 	}
 	return err
 }
 
 func (p *Provider) CreateSandbox(spec sandbox.RunSpec) (sandbox.Sandbox, error) {
-	if err := p.Prepare(spec.Spec); err != nil {
+	// warm containers are limited to the default memory
+	if p.warm != nil && (spec.Memory == 0 || spec.Memory == defaultMemory(p.cfg)) {
+		if wc := p.warm.checkout(spec.Spec); wc != nil {
+			return &WarmSandbox{pool: p.warm, wc: wc, spec: spec, client: wc.host.client}, nil
+		}
+	}
+
+	h := p.hosts.tryAcquire()
+	if h == nil && p.warm != nil && p.warm.evict() {
+		// an idle warm container of another language gave up its slot
+		h = p.hosts.tryAcquire()
+	}
+	if h == nil {
+		var err error
+		if h, err = p.hosts.acquire(); err != nil {
+			return nil, err
+		}
+	}
+	sbx, err := p.createOn(h, spec)
+	if err != nil {
+		p.hosts.release(h)
 		return nil, err
 	}
+	sbx.release = func() { p.hosts.release(h) }
+	return sbx, nil
+}
 
-	workingDir := path.Join("/var/tmp/exec", spec.Subdir)
+func (p *Provider) createOn(h *host, spec sandbox.RunSpec) (*Sandbox, error) {
+	if err := p.prepareOn(h, spec.Spec); err != nil {
+		return nil, err
+	}
+
+	workingDir := path.Join(workspaceRoot, spec.Subdir)
 	hostDir, _ := filepath.Abs(spec.GetAssembledHostDir())
 
-	container, err := p.client.CreateContainer(dockerclient.CreateContainerOptions{
+	copyWorkspace := p.cfg.Config().Sandbox.Workspace == config.WorkspaceCopy
+	hostConfig := &dockerclient.HostConfig{}
+	if !copyWorkspace {
+		hostConfig.Binds = []string{hostDir + ":" + workingDir}
+	}
+	memory := spec.Memory
+	if memory == 0 {
+		memory = defaultMemory(p.cfg)
+	}
+	if memory > 0 {
+		// without swap, so the limit holds
+		hostConfig.Memory, hostConfig.MemorySwap = memory, memory
+	}
+
+	container, err := h.client.CreateContainer(dockerclient.CreateContainerOptions{
 		Name: fmt.Sprintf("runner-%s-%s", spec.Language, xid.New().String()),
 		Config: &dockerclient.Config{
-			Image:      spec.Image,
+			Image:      spec.ImageRef(),
 			WorkingDir: workingDir,
 			Entrypoint: spec.GetEntrypoint(),
 			Cmd:        spec.GetCommandWithArgs(),
 			Env:        spec.GetEnv(),
+			OpenStdin:  spec.Stdin != "",
+			StdinOnce:  spec.Stdin != "",
+			Labels: map[string]string{
+				labelInstance:   p.cfg.Config().InstanceID,
+				labelSubmission: spec.Subdir,
+			},
 		},
-		HostConfig: &dockerclient.HostConfig{
-			Binds: []string{hostDir + ":" + workingDir},
-		},
+		HostConfig: hostConfig,
 	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	return &Sandbox{client: p.client, container: container}, nil
+	sbx := &Sandbox{client: h.client, container: container, stdin: spec.Stdin}
+	if copyWorkspace {
+		if err := uploadWorkspace(h.client, container.ID, hostDir, workingDir); err != nil {
+			sbx.Delete()
+			return nil, fmt.Errorf("failed to upload workspace: %w", err)
+		}
+		sbx.hostDir, sbx.workingDir = hostDir, workingDir
+	}
+	return sbx, nil
 }
 
 type Sandbox struct {
 	client    *dockerclient.Client
 	container *dockerclient.Container
+	// hostDir and workingDir are set if the workspace was copied into the
+	// container and outputs have to be copied back
+	hostDir    string
+	workingDir string
+	stdin      string
+
+	// release frees the slot of the container on its host
+	release func()
+	once    sync.Once
+
+	mu     sync.Mutex
+	result sandbox.Result
 }
 
 func (s *Sandbox) ID() string { return s.container.ID }
 
+// Result reports the exit code of the container and the resource usage
+// sampled while it ran.
+func (s *Sandbox) Result() sandbox.Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.result
+}
+
 func (s *Sandbox) Run(stdout, stderr chan []byte, close chan bool) error {
 	go func() {
-		s.client.AttachToContainer(dockerclient.AttachToContainerOptions{
+		usage := watchUsage(s.client, s.container.ID)
+		opts := dockerclient.AttachToContainerOptions{
 			Container:    s.container.ID,
-			OutputStream: &ChanWriter{stdout},
-			ErrorStream:  &ChanWriter{stderr},
+			OutputStream: &sandbox.ChanWriter{C: stdout},
+			ErrorStream:  &sandbox.ChanWriter{C: stderr},
 			Stdout:       true, Stderr: true, Stream: true,
-		})
+		}
+		if s.stdin != "" {
+			// the container closes its stdin once the input is consumed
+			opts.InputStream, opts.Stdin = strings.NewReader(s.stdin), true
+		}
+		s.client.AttachToContainer(opts)
+		code, err := s.client.WaitContainer(s.container.ID)
+		if err == nil {
+			res := sandbox.Result{ExitCode: code}
+			usage.stop(&res)
+			if c, err := s.client.InspectContainer(s.container.ID); err == nil {
+				res.OOMKilled = c.State.OOMKilled
+			}
+			s.mu.Lock()
+			s.result = res
+			s.mu.Unlock()
+		}
+		usage.cancel()
+		if s.workingDir != "" {
+			if err := downloadWorkspace(s.client, s.container.ID, s.workingDir, s.hostDir); err != nil {
+				log.Error().Err(err).Field("ContainerID", s.container.ID).Msg("Failed to download workspace")
+			}
+		}
 		close <- true
 	}()
 	return s.client.StartContainer(s.container.ID, nil)
 }
 
 func (s *Sandbox) Kill() error   { return s.client.KillContainer(dockerclient.KillContainerOptions{ID: s.container.ID}) }
-func (s *Sandbox) Delete() error { return s.client.RemoveContainer(dockerclient.RemoveContainerOptions{ID: s.container.ID}) }
-
-type ChanWriter struct{ C chan []byte }
-func (w *ChanWriter) Write(p []byte) (int, error) {
-	cp := make([]byte, len(p))
-	copy(cp, p)
-	w.C <- cp
-	return len(p), nil
+func (s *Sandbox) Delete() error {
+	err := s.client.RemoveContainer(dockerclient.RemoveContainerOptions{ID: s.container.ID})
+	if s.release != nil {
+		s.once.Do(s.release)
+	}
+	return err
 }
 
-func parseImage(img string) (string, string) {
-	split := strings.SplitN(img, ":", 2)
-	if len(split) == 1 {
-		return split[0], "latest"
+// defaultMemory is the memory limit of runs which do not set their own, or
+// 0 if the sandbox configures none.
+func defaultMemory(cfg *config.EnvProvider) int64 {
+	memory, err := models.ParseMemory(cfg.Config().Sandbox.Memory)
+	if err != nil {
+		return 0
 	}
-	return split[0], split[1]
+	return memory
 }
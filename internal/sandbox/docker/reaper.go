@@ -0,0 +1,76 @@
+package docker
+
+import (
+	"errors"
+	"fmt"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"github.com/zekrotja/rogu/log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Labels put on every container, so containers left behind by a crashed
+// engine can be found again.
+const (
+	labelInstance   = "code-runner.instance"
+	labelSubmission = "code-runner.submission"
+	// labelSlot holds the host directory mounted into a warm container
+	labelSlot = "code-runner.slot"
+)
+
+// reapMinAge protects containers which are still being set up by the
+// instance creating them.
+const reapMinAge = time.Minute
+
+// ReapOrphans removes the labeled containers on all healthy hosts which are
+// not in use by this provider and which orphaned reports as orphaned.
+func (p *Provider) ReapOrphans(orphaned func(instance, runID string) bool) (int, error) {
+	var errs []error
+	n := 0
+	for _, h := range p.hosts.healthy() {
+		containers, err := h.client.ListContainers(dockerclient.ListContainersOptions{
+			All:     true,
+			Filters: map[string][]string{"label": {labelInstance}},
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", h.endpoint, err))
+			continue
+		}
+
+		for _, c := range containers {
+			if time.Since(time.Unix(c.Created, 0)) < reapMinAge {
+				continue
+			}
+			if p.warm != nil && p.warm.owns(c.ID) {
+				continue
+			}
+			if !orphaned(c.Labels[labelInstance], c.Labels[labelSubmission]) {
+				continue
+			}
+
+			err := h.client.RemoveContainer(dockerclient.RemoveContainerOptions{ID: c.ID, Force: true, RemoveVolumes: true})
+			if err != nil {
+				var notFound *dockerclient.NoSuchContainer
+				if !errors.As(err, &notFound) {
+					errs = append(errs, fmt.Errorf("%s: %w", h.endpoint, err))
+				}
+				continue
+			}
+			if slot := c.Labels[labelSlot]; slot != "" && isWarmSlot(slot) {
+				os.RemoveAll(slot)
+			}
+			n++
+			log.Info().Fields("ContainerID", c.ID, "instance", c.Labels[labelInstance], "job_id", c.Labels[labelSubmission], "host", h.endpoint).Msg("Removed orphaned container")
+		}
+	}
+	return n, errors.Join(errs...)
+}
+
+// isWarmSlot guards against removing anything but a warm container slot
+// taken from a label.
+func isWarmSlot(dir string) bool {
+	return filepath.IsAbs(dir) && strings.HasPrefix(filepath.Base(dir), "runner-warm-") &&
+		filepath.Base(filepath.Dir(dir)) == ".warm"
+}
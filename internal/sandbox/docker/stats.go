@@ -0,0 +1,42 @@
+package docker
+
+import (
+	"code-runner/internal/sandbox"
+	"context"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"time"
+)
+
+// usageWatcher follows the resource usage docker samples about once a
+// second while a container runs. Docker drops it as soon as the container
+// stopped, so the last sample counts and runs shorter than the sampling
+// interval report less than they used.
+type usageWatcher struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	cpu    time.Duration
+	peak   int64
+}
+
+func watchUsage(client *dockerclient.Client, id string) *usageWatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &usageWatcher{cancel: cancel, done: make(chan struct{})}
+	stats := make(chan *dockerclient.Stats)
+	go func() {
+		defer close(w.done)
+		for st := range stats {
+			w.cpu = max(w.cpu, time.Duration(st.CPUStats.CPUUsage.TotalUsage))
+			// max_usage is only reported on cgroup v1
+			w.peak = max(w.peak, int64(st.MemoryStats.MaxUsage), int64(st.MemoryStats.Usage))
+		}
+	}()
+	go client.Stats(dockerclient.StatsOptions{ID: id, Stats: stats, Stream: true, Context: ctx})
+	return w
+}
+
+// stop ends watching and fills in the usage seen.
+func (w *usageWatcher) stop(res *sandbox.Result) {
+	w.cancel()
+	<-w.done
+	res.CPUTime, res.MaxMemory = w.cpu, w.peak
+}
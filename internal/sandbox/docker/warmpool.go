@@ -0,0 +1,466 @@
+package docker
+
+import (
+	"code-runner/internal/config"
+	"code-runner/internal/sandbox"
+	"code-runner/pkg/models"
+	"fmt"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"github.com/rs/xid"
+	"github.com/zekrotja/rogu/log"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// idleCmd keeps a warm container alive without doing anything until a job
+// is executed inside of it.
+var idleCmd = []string{"/bin/sh", "-c", "while :; do sleep 3600; done"}
+
+// WarmPool keeps started containers per spec language ready so that jobs
+// only pay for an exec instead of creating and starting a container. Each
+// container runs a single job and is removed afterwards. Each language is
+// sized after the number of jobs seen in the recent demand window.
+type WarmPool struct {
+	hosts   *hostSet
+	cfg     *config.EnvProvider
+	prepare func(*host, models.Spec) error
+
+	mu     sync.Mutex
+	specs  map[string]models.Spec
+	idle   map[string][]*warmContainer
+	demand map[string][]time.Time
+	// owned holds the IDs of all containers created by the pool, idle or
+	// checked out
+	owned  map[string]bool
+	closed bool
+
+	stop chan struct{}
+}
+
+type warmContainer struct {
+	host      *host
+	container *dockerclient.Container
+	spec      models.Spec
+	// slotDir is the host directory mounted at /var/tmp/exec, it is empty
+	// if workspaces are copied into the container
+	slotDir string
+}
+
+func newWarmPool(hosts *hostSet, cfg *config.EnvProvider, prepare func(*host, models.Spec) error) *WarmPool {
+	return &WarmPool{
+		hosts:   hosts,
+		cfg:     cfg,
+		prepare: prepare,
+		specs:   make(map[string]models.Spec),
+		idle:    make(map[string][]*warmContainer),
+		demand:  make(map[string][]time.Time),
+		owned:   make(map[string]bool),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Start registers the given specs and keeps their pools filled.
+func (wp *WarmPool) Start(specs []models.Spec) {
+	wp.mu.Lock()
+	for _, s := range specs {
+		wp.specs[s.Language] = s
+	}
+	wp.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(2 * time.Second)
+		defer ticker.Stop()
+		for {
+			wp.refill()
+			select {
+			case <-wp.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Close stops refilling and removes all idle containers.
+func (wp *WarmPool) Close() {
+	close(wp.stop)
+
+	wp.mu.Lock()
+	idle := wp.idle
+	wp.idle = make(map[string][]*warmContainer)
+	wp.closed = true
+	wp.mu.Unlock()
+
+	for _, wcs := range idle {
+		for _, wc := range wcs {
+			wp.destroy(wc)
+		}
+	}
+}
+
+// checkout takes an idle container for the spec out of the pool. It
+// returns nil if none is ready, the caller then falls back to a cold start.
+func (wp *WarmPool) checkout(spec models.Spec) *warmContainer {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+
+	if _, ok := wp.specs[spec.Language]; !ok {
+		wp.specs[spec.Language] = spec
+	}
+	wp.demand[spec.Language] = append(wp.demand[spec.Language], time.Now())
+
+	idle := wp.idle[spec.Language]
+	for i := len(idle) - 1; i >= 0; i-- {
+		wc := idle[i]
+		if wc.spec.ImageRef() != spec.ImageRef() || !wp.hosts.isHealthy(wc.host) {
+			continue
+		}
+		wp.idle[spec.Language] = append(idle[:i], idle[i+1:]...)
+		return wc
+	}
+	return nil
+}
+
+// evict destroys one idle container, preferring languages with the most
+// idle containers, to free its slot for a cold start. It reports whether a
+// container was evicted.
+func (wp *WarmPool) evict() bool {
+	wp.mu.Lock()
+	var victim *warmContainer
+	lang := ""
+	for l, idle := range wp.idle {
+		if len(idle) > 0 && (victim == nil || len(idle) > len(wp.idle[lang])) {
+			victim, lang = idle[len(idle)-1], l
+		}
+	}
+	if victim != nil {
+		wp.idle[lang] = wp.idle[lang][:len(wp.idle[lang])-1]
+	}
+	wp.mu.Unlock()
+
+	if victim == nil {
+		return false
+	}
+	wp.destroy(victim)
+	return true
+}
+
+// release hands a used container back. It is always destroyed, a job may
+// have written anywhere in the container and the next job must not see it.
+func (wp *WarmPool) release(wc *warmContainer) {
+	go wp.destroy(wc)
+}
+
+// target returns the number of idle containers the language should have,
+// based on how many jobs were run in the recent demand window.
+func (wp *WarmPool) target(lang string, now time.Time) int {
+	c := wp.cfg.Config().WarmPool
+	window := time.Duration(c.WindowSeconds) * time.Second
+
+	recent := wp.demand[lang][:0]
+	for _, t := range wp.demand[lang] {
+		if now.Sub(t) <= window {
+			recent = append(recent, t)
+		}
+	}
+	wp.demand[lang] = recent
+
+	n := len(recent)
+	if n < c.Min {
+		n = c.Min
+	}
+	if n > c.Max {
+		n = c.Max
+	}
+	return n
+}
+
+func (wp *WarmPool) refill() {
+	now := time.Now()
+
+	type delta struct {
+		spec   models.Spec
+		create int
+		excess []*warmContainer
+	}
+	var deltas []delta
+
+	wp.mu.Lock()
+	for lang, spec := range wp.specs {
+		target := wp.target(lang, now)
+		idle := wp.idle[lang][:0]
+		var lost []*warmContainer
+		for _, wc := range wp.idle[lang] {
+			if wp.hosts.isHealthy(wc.host) {
+				idle = append(idle, wc)
+			} else {
+				lost = append(lost, wc)
+			}
+		}
+		wp.idle[lang] = idle
+		d := delta{spec: spec, excess: lost}
+		if len(idle) < target {
+			d.create = target - len(idle)
+		} else if len(idle) > target {
+			d.excess = append(d.excess, idle[target:]...)
+			wp.idle[lang] = idle[:target]
+		}
+		deltas = append(deltas, d)
+	}
+	wp.mu.Unlock()
+
+	for _, d := range deltas {
+		for _, wc := range d.excess {
+			wp.destroy(wc)
+		}
+		for i := 0; i < d.create; i++ {
+			wc, err := wp.create(d.spec)
+			if err == errNoHost {
+				// warm containers never wait for capacity
+				break
+			}
+			if err != nil {
+				log.Error().Err(err).Field("language", d.spec.Language).Msg("Failed to create warm container")
+				break
+			}
+			wp.mu.Lock()
+			closed := wp.closed
+			if !closed {
+				wp.idle[d.spec.Language] = append(wp.idle[d.spec.Language], wc)
+			}
+			wp.mu.Unlock()
+			if closed {
+				wp.destroy(wc)
+				return
+			}
+		}
+	}
+}
+
+func (wp *WarmPool) create(spec models.Spec) (*warmContainer, error) {
+	h := wp.hosts.tryAcquire()
+	if h == nil {
+		return nil, errNoHost
+	}
+	wc, err := wp.createOn(h, spec)
+	if err != nil {
+		wp.hosts.release(h)
+		return nil, err
+	}
+	return wc, nil
+}
+
+func (wp *WarmPool) createOn(h *host, spec models.Spec) (*warmContainer, error) {
+	if err := wp.prepare(h, spec); err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("runner-warm-%s-%s", spec.Language, xid.New().String())
+	hostConfig := &dockerclient.HostConfig{}
+	if memory := defaultMemory(wp.cfg); memory > 0 {
+		hostConfig.Memory, hostConfig.MemorySwap = memory, memory
+	}
+	slotDir := ""
+	if wp.cfg.Config().Sandbox.Workspace != config.WorkspaceCopy {
+		var err error
+		if slotDir, err = filepath.Abs(path.Join(wp.cfg.Config().HostRootDir, ".warm", name)); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(slotDir, 0777); err != nil {
+			return nil, err
+		}
+		hostConfig.Binds = []string{slotDir + ":" + workspaceRoot}
+	}
+
+	container, err := h.client.CreateContainer(dockerclient.CreateContainerOptions{
+		Name: name,
+		Config: &dockerclient.Config{
+			Image:      spec.ImageRef(),
+			Entrypoint: idleCmd,
+			Labels: map[string]string{
+				labelInstance: wp.cfg.Config().InstanceID,
+				labelSlot:     slotDir,
+			},
+		},
+		HostConfig: hostConfig,
+	})
+	if err != nil {
+		os.RemoveAll(slotDir)
+		return nil, err
+	}
+	wp.mu.Lock()
+	wp.owned[container.ID] = true
+	wp.mu.Unlock()
+
+	wc := &warmContainer{host: h, container: container, spec: spec, slotDir: slotDir}
+	if err := h.client.StartContainer(container.ID, nil); err != nil {
+		wp.remove(wc)
+		return nil, err
+	}
+
+	log.Debug().Field("ContainerID", container.ID).Field("language", spec.Language).Msg("Warm container ready")
+	return wc, nil
+}
+
+// destroy removes the container and frees its slot on the host.
+func (wp *WarmPool) destroy(wc *warmContainer) {
+	wp.remove(wc)
+	wp.hosts.release(wc.host)
+}
+
+func (wp *WarmPool) remove(wc *warmContainer) {
+	err := wc.host.client.RemoveContainer(dockerclient.RemoveContainerOptions{ID: wc.container.ID, Force: true})
+	if err != nil {
+		log.Error().Err(err).Field("ContainerID", wc.container.ID).Msg("Failed to remove warm container")
+	}
+	if wc.slotDir != "" {
+		os.RemoveAll(wc.slotDir)
+	}
+	wp.mu.Lock()
+	delete(wp.owned, wc.container.ID)
+	wp.mu.Unlock()
+}
+
+// owns reports whether the container was created by the pool and is still
+// in use by it.
+func (wp *WarmPool) owns(id string) bool {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	return wp.owned[id]
+}
+
+// WarmSandbox executes a job inside a container taken from the WarmPool.
+type WarmSandbox struct {
+	pool   *WarmPool
+	wc     *warmContainer
+	spec   sandbox.RunSpec
+	client *dockerclient.Client
+
+	mu       sync.Mutex
+	finished bool
+	killed   bool
+	result   sandbox.Result
+}
+
+func (s *WarmSandbox) ID() string { return s.wc.container.ID }
+
+func (s *WarmSandbox) Result() sandbox.Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.result
+}
+
+func (s *WarmSandbox) Run(stdout, stderr chan []byte, close chan bool) error {
+	// every job gets a fresh copy of its workspace inside the slot
+	workingDir := path.Join(workspaceRoot, s.spec.Subdir)
+	hostDir, _ := filepath.Abs(s.spec.GetAssembledHostDir())
+	if s.wc.slotDir != "" {
+		if err := copyDir(hostDir, path.Join(s.wc.slotDir, s.spec.Subdir)); err != nil {
+			return err
+		}
+	} else if err := uploadWorkspace(s.client, s.wc.container.ID, hostDir, workingDir); err != nil {
+		return fmt.Errorf("failed to upload workspace: %w", err)
+	}
+
+	exec, err := s.client.CreateExec(dockerclient.CreateExecOptions{
+		Container:    s.wc.container.ID,
+		Cmd:          append(s.spec.GetEntrypoint(), s.spec.GetCommandWithArgs()...),
+		Env:          s.spec.GetEnv(),
+		WorkingDir:   workingDir,
+		AttachStdin:  s.spec.Stdin != "",
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		// the container runs this job only, its usage is the job's
+		usage := watchUsage(s.client, s.wc.container.ID)
+		opts := dockerclient.StartExecOptions{
+			OutputStream: &sandbox.ChanWriter{C: stdout},
+			ErrorStream:  &sandbox.ChanWriter{C: stderr},
+		}
+		if s.spec.Stdin != "" {
+			opts.InputStream = strings.NewReader(s.spec.Stdin)
+		}
+		err := s.client.StartExec(exec.ID, opts)
+		if err != nil {
+			log.Error().Err(err).Field("ContainerID", s.ID()).Msg("Warm exec failed")
+		} else if res, err := s.client.InspectExec(exec.ID); err == nil {
+			result := sandbox.Result{ExitCode: res.ExitCode}
+			usage.stop(&result)
+			s.mu.Lock()
+			s.result = result
+			s.mu.Unlock()
+		}
+		usage.cancel()
+		if s.wc.slotDir == "" {
+			if err := downloadWorkspace(s.client, s.wc.container.ID, workingDir, hostDir); err != nil {
+				log.Error().Err(err).Field("ContainerID", s.ID()).Msg("Failed to download workspace")
+			}
+		} else if err := copyDir(path.Join(s.wc.slotDir, s.spec.Subdir), hostDir); err != nil {
+			log.Error().Err(err).Field("ContainerID", s.ID()).Msg("Failed to copy workspace back")
+		}
+		s.mu.Lock()
+		s.finished = true
+		s.mu.Unlock()
+		close <- true
+	}()
+	return nil
+}
+
+// Kill only stops the container if the job is still running, it is removed
+// by Delete either way.
+func (s *WarmSandbox) Kill() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished || s.killed {
+		return nil
+	}
+	s.killed = true
+	return s.client.KillContainer(dockerclient.KillContainerOptions{ID: s.wc.container.ID})
+}
+
+func (s *WarmSandbox) Delete() error {
+	s.pool.release(s.wc)
+	return nil
+}
+
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0777)
+		}
+		// links created inside the container must not be followed on the host
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		in, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0777)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		_, err = io.Copy(out, in)
+		return err
+	})
+}
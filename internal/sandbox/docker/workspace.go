@@ -0,0 +1,142 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxDownloadBytes bounds the outputs copied back from a container, the
+// workspace content is controlled by the sandboxed code.
+const maxDownloadBytes = 64 << 20
+
+// uploadWorkspace copies the host directory src into the container at the
+// absolute path dest. The container does not need to be running.
+func uploadWorkspace(client *dockerclient.Client, containerID, src, dest string) error {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+
+	// create dest and its parents, they may not exist in the image
+	parts := strings.Split(strings.Trim(dest, "/"), "/")
+	for i := range parts {
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     strings.Join(parts[:i+1], "/") + "/",
+			Mode:     0777,
+		}); err != nil {
+			return err
+		}
+	}
+
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		name := path.Join(strings.Trim(dest, "/"), filepath.ToSlash(rel))
+		if info.IsDir() {
+			return tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: 0777})
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     int64(info.Mode().Perm() | 0666),
+			Size:     info.Size(),
+			ModTime:  info.ModTime(),
+		}); err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to pack workspace: %w", err)
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return client.UploadToContainer(containerID, dockerclient.UploadToContainerOptions{
+		InputStream: buf,
+		Path:        "/",
+	})
+}
+
+// downloadWorkspace copies the container directory src back into the host
+// directory dst, so outputs written by the job are available to the caller.
+// Only regular files and directories are extracted.
+func downloadWorkspace(client *dockerclient.Client, containerID, src, dst string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(client.DownloadFromContainer(containerID, dockerclient.DownloadFromContainerOptions{
+			Path:         src,
+			OutputStream: pw,
+		}))
+	}()
+	defer pr.Close()
+
+	var total int64
+	tr := tar.NewReader(pr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// entries are prefixed with the base name of src
+		name := filepath.Clean("/" + hdr.Name)
+		if i := strings.Index(name[1:], "/"); i >= 0 {
+			name = name[i+1:]
+		} else {
+			continue
+		}
+		target := filepath.Join(dst, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0777); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			total += hdr.Size
+			if total > maxDownloadBytes {
+				return errors.New("workspace outputs exceed the download limit")
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+				return err
+			}
+			// never write through a symlink placed by the job
+			os.Remove(target)
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0666)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package fake
+
+import (
+	"code-runner/internal/sandbox"
+	"code-runner/pkg/models"
+	"errors"
+	"fmt"
+	"github.com/rs/xid"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// Run describes what a fake sandbox does when it is run.
+type Run struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	// CPUTime and MaxMemory are reported as the usage of the run
+	CPUTime   time.Duration
+	MaxMemory int64
+	// Delay is waited before the sandbox finishes. Killing the sandbox
+	// ends the wait early.
+	Delay time.Duration
+	// Err fails the creation of the sandbox
+	Err error
+	// Files are written into the workspace by the run, e.g. test reports
+	Files map[string]string
+}
+
+// Handler decides the outcome of a run. Files holds the workspace the
+// manager created for the job, so a handler can react to the submitted code
+// or the generated test cases.
+type Handler func(spec sandbox.RunSpec, files map[string]string) Run
+
+// Static returns the same run for every job.
+func Static(run Run) Handler {
+	return func(sandbox.RunSpec, map[string]string) Run { return run }
+}
+
+// Sequence returns the given runs one after another and repeats the last
+// one once all have been used.
+func Sequence(runs ...Run) Handler {
+	var mu sync.Mutex
+	i := 0
+	return func(sandbox.RunSpec, map[string]string) Run {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(runs) == 0 {
+			return Run{}
+		}
+		run := runs[i]
+		if i < len(runs)-1 {
+			i++
+		}
+		return run
+	}
+}
+
+// Call records a sandbox created by the provider.
+type Call struct {
+	Spec  sandbox.RunSpec
+	Files map[string]string
+	// Killed is set if the sandbox was killed before its run finished
+	Killed bool
+}
+
+// Provider is a scriptable sandbox.Provider which never executes anything.
+// It lets the worker pipeline run without a container runtime.
+type Provider struct {
+	mu      sync.Mutex
+	handler Handler
+	calls   []*Call
+}
+
+func NewProvider(h Handler) *Provider {
+	return &Provider{handler: h}
+}
+
+// SetHandler replaces the handler used for sandboxes created from now on.
+func (p *Provider) SetHandler(h Handler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.handler = h
+}
+
+// Calls returns the sandboxes created so far.
+func (p *Provider) Calls() []Call {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := make([]Call, len(p.calls))
+	for i, c := range p.calls {
+		res[i] = *c
+	}
+	return res
+}
+
+func (p *Provider) Prepare(spec models.Spec) error { return nil }
+
+func (p *Provider) CreateSandbox(spec sandbox.RunSpec) (sandbox.Sandbox, error) {
+	files, err := readFiles(spec.GetAssembledHostDir())
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	h := p.handler
+	call := &Call{Spec: spec, Files: files}
+	p.calls = append(p.calls, call)
+	p.mu.Unlock()
+
+	run := h(spec, files)
+	if run.Err != nil {
+		return nil, run.Err
+	}
+	return &Sandbox{
+		id:       "fake-" + spec.Language + "-" + xid.New().String(),
+		dir:      spec.GetAssembledHostDir(),
+		run:      run,
+		provider: p,
+		call:     call,
+		kill:     make(chan struct{}),
+	}, nil
+}
+
+func readFiles(dir string) (map[string]string, error) {
+	files := make(map[string]string)
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		entries, err := os.ReadDir(path.Join(dir, rel))
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			name := path.Join(rel, e.Name())
+			if e.IsDir() {
+				if err := walk(name); err != nil {
+					return err
+				}
+				continue
+			}
+			data, err := os.ReadFile(path.Join(dir, name))
+			if err != nil {
+				return err
+			}
+			files[name] = string(data)
+		}
+		return nil
+	}
+	if err := walk(""); err != nil {
+		return nil, fmt.Errorf("failed to read workspace: %w", err)
+	}
+	return files, nil
+}
+
+type Sandbox struct {
+	id       string
+	dir      string
+	run      Run
+	provider *Provider
+	call     *Call
+
+	once     sync.Once
+	kill     chan struct{}
+	started  bool
+	finished bool
+}
+
+func (s *Sandbox) ID() string { return s.id }
+
+// ExitCode returns the exit code the sandbox was scripted with.
+func (s *Sandbox) ExitCode() int { return s.run.ExitCode }
+
+func (s *Sandbox) Result() sandbox.Result {
+	return sandbox.Result{ExitCode: s.run.ExitCode, CPUTime: s.run.CPUTime, MaxMemory: s.run.MaxMemory}
+}
+
+func (s *Sandbox) Run(stdout, stderr chan []byte, close chan bool) error {
+	s.provider.mu.Lock()
+	started := s.started
+	s.started = true
+	s.provider.mu.Unlock()
+	if started {
+		return errors.New("sandbox has already been run")
+	}
+
+	go func() {
+		defer func() {
+			s.provider.mu.Lock()
+			s.finished = true
+			s.provider.mu.Unlock()
+			close <- true
+		}()
+		if s.run.Delay > 0 {
+			t := time.NewTimer(s.run.Delay)
+			select {
+			case <-t.C:
+			case <-s.kill:
+				t.Stop()
+				return
+			}
+		}
+		if s.run.Stdout != "" {
+			stdout <- []byte(s.run.Stdout)
+		}
+		if s.run.Stderr != "" {
+			stderr <- []byte(s.run.Stderr)
+		}
+		for name, content := range s.run.Files {
+			p := path.Join(s.dir, name)
+			os.MkdirAll(path.Dir(p), 0777)
+			os.WriteFile(p, []byte(content), 0666)
+		}
+	}()
+	return nil
+}
+
+func (s *Sandbox) Kill() error {
+	s.once.Do(func() {
+		s.provider.mu.Lock()
+		s.call.Killed = s.started && !s.finished
+		s.provider.mu.Unlock()
+		close(s.kill)
+	})
+	return nil
+}
+
+func (s *Sandbox) Delete() error { return nil }
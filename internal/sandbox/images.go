@@ -0,0 +1,83 @@
+package sandbox
+
+import (
+	"code-runner/pkg/models"
+	"errors"
+	"fmt"
+	"github.com/zekrotja/rogu/log"
+	"sync"
+	"time"
+)
+
+// PrepareAll fetches the images of all specs in parallel, so the first
+// submission of a language does not wait for a pull. ready is called for
+// each spec as soon as its image is done, whether it failed or not.
+func (m *Manager) PrepareAll(ready func(models.Spec)) error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for _, s := range m.spec.All() {
+		provider, ok := m.sandbox[s.GetBackend()]
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		s := s
+		go func() {
+			defer wg.Done()
+			defer ready(s)
+			start := time.Now()
+			if err := provider.Prepare(s); err != nil {
+				log.Error().Err(err).Fields("language", s.Language, "image", s.ImageRef()).Msg("Failed to prepare image")
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", s.Language, err))
+				mu.Unlock()
+				return
+			}
+			log.Info().Fields("language", s.Language, "image", s.ImageRef(), "took", time.Since(start).String()).Msg("Image ready")
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// ImageStatus reports the images of all specs whose provider manages
+// images locally.
+func (m *Manager) ImageStatus() []ImageStatus {
+	var res []ImageStatus
+	for _, s := range m.spec.All() {
+		if im, ok := m.sandbox[s.GetBackend()].(ImageManager); ok {
+			res = append(res, im.ImageStatus(s)...)
+		}
+	}
+	return res
+}
+
+// Pull fetches the image of the language again. lang may be a spec key or
+// a language name, an empty one pulls the images of all specs.
+func (m *Manager) Pull(lang string) error {
+	if s, ok := m.spec.Get(lang); ok {
+		lang = s.Language
+	}
+	var errs []error
+	found := false
+	for _, s := range m.spec.All() {
+		if lang != "" && s.Language != lang {
+			continue
+		}
+		found = true
+		im, ok := m.sandbox[s.GetBackend()].(ImageManager)
+		if !ok {
+			continue
+		}
+		if err := im.Pull(s); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.Language, err))
+		}
+	}
+	if !found {
+		return fmt.Errorf("unsupported language: %s", lang)
+	}
+	return errors.Join(errs...)
+}
@@ -4,32 +4,66 @@ import (
 	"code-runner/internal/config"
 	"code-runner/internal/file"
 	"code-runner/internal/spec"
+	"code-runner/pkg/models"
 	"fmt"
 	"github.com/rs/xid"
 	"github.com/zekrotja/rogu/log"
+	"os"
 	// "path"
+	"path/filepath"
 	"sync"
 	"time"
 	"errors"
 )
 
 type Manager struct {
-	sandbox Provider
+	sandbox map[string]Provider // backend -> provider
 	spec    *spec.BaseProvider
 	file    *file.LocalFileProvider
 	cfg     *config.EnvProvider
 	running sync.Map
+	jobs    sync.Map // submission ID -> Sandbox
+	active  sync.Map // run ID -> struct{}, set while its workspace exists
 }
 
-func NewManager(sb Provider, sp *spec.BaseProvider, fp *file.LocalFileProvider, cfg *config.EnvProvider) (*Manager, error) {
-	return &Manager{sandbox: sb, spec: sp, file: fp, cfg: cfg}, nil
+// NewManager creates a manager running each language on the provider of
+// its spec backend.
+func NewManager(providers map[string]Provider, sp *spec.BaseProvider, fp *file.LocalFileProvider, cfg *config.EnvProvider) (*Manager, error) {
+	for _, s := range sp.All() {
+		if _, ok := providers[s.GetBackend()]; !ok {
+			return nil, fmt.Errorf("no sandbox provider for backend %q of language %s", s.GetBackend(), s.Language)
+		}
+		if s.Build != nil && s.GetBackend() != models.BackendDocker {
+			return nil, fmt.Errorf("language %s: image builds are only supported by the docker backend", s.Language)
+		}
+	}
+	return &Manager{sandbox: providers, spec: sp, file: fp, cfg: cfg}, nil
+}
+
+// Limits describes the resource limits every sandbox currently runs under.
+type Limits struct {
+	TimeoutSeconds int
+	Memory         string
 }
 
-func (m *Manager) RunInSandbox(submissionID string, lang string, files map[string]string, env map[string]string, cout, cerr chan []byte, cstop chan bool) error {
+func (m *Manager) Limits() Limits {
+	c := m.cfg.Config().Sandbox
+	return Limits{TimeoutSeconds: c.TimeoutSeconds, Memory: c.Memory}
+}
+
+// Spec returns the spec of the language.
+func (m *Manager) Spec(lang string) (models.Spec, bool) {
+	return m.spec.Get(lang)
+}
+
+// RunInSandbox runs the files in a new sandbox of the language. The result
+// is only filled if the sandbox finished and its provider reports results.
+func (m *Manager) RunInSandbox(submissionID string, lang string, files map[string]string, opts JobOptions, cout, cerr chan []byte, cstop chan bool) (Result, error) {
+	var res Result
 	spc, ok := m.spec.Get(lang)
 	if !ok {
 		log.Error().Field("language", lang).Msg("Unsupported language specification")
-		return fmt.Errorf("unsupported language: %s", lang)
+		return res, fmt.Errorf("unsupported language: %s", lang)
 	}
 
 	runId := submissionID
@@ -39,11 +73,20 @@ func (m *Manager) RunInSandbox(submissionID string, lang string, files map[strin
 
 	log.Debug().Field("RunID", runId).Field("Language", lang).Msg("Starting code execution job")
 
+	// registered before anything is created so the reaper never sees the
+	// workspace or sandbox of this run as orphaned
+	m.active.Store(runId, struct{}{})
+	defer m.active.Delete(runId)
+
 	runSpc := RunSpec{
 		Spec:        spc,
 		Subdir:      runId,
 		HostDir:     m.cfg.Config().HostRootDir,
-		Environment: env,
+		Arguments:   opts.Arguments,
+		Environment: opts.Environment,
+		Stdin:       opts.Stdin,
+		Command:     opts.Command,
+		Memory:      opts.Memory,
 	}
 
 	if runSpc.Cmd == "" {
@@ -56,17 +99,22 @@ func (m *Manager) RunInSandbox(submissionID string, lang string, files map[strin
 	
 	if err := m.file.CreateFiles(hostDir, files); err != nil {						// Create all files (User Code, Runner, TestCases)
 		m.file.DeleteDirectory(hostDir)
-		return fmt.Errorf("failed to create files: %w", err)
+		return res, fmt.Errorf("failed to create files: %w", err)
 	}
 	
 	defer func() {
 		m.file.DeleteDirectory(hostDir)
 	}()
 
-	sbx, err := m.sandbox.CreateSandbox(runSpc)
+	provider, ok := m.sandbox[spc.GetBackend()]
+	if !ok {
+		return res, fmt.Errorf("no sandbox provider for backend %q", spc.GetBackend())
+	}
+
+	sbx, err := provider.CreateSandbox(runSpc)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to create Docker sandbox")
-		return fmt.Errorf("failed to create sandbox: %w", err)
+		log.Error().Err(err).Field("backend", spc.GetBackend()).Msg("Failed to create sandbox")
+		return res, fmt.Errorf("failed to create sandbox: %w", err)
 	}
 	
 	// clean up
@@ -76,10 +124,17 @@ func (m *Manager) RunInSandbox(submissionID string, lang string, files map[strin
 		m.running.Delete(sbx.ID())
 	}()
 
-	log.Info().Field("ContainerID", sbx.ID()).Msg("Docker container created and started")
+	log.Info().Field("ContainerID", sbx.ID()).Field("backend", spc.GetBackend()).Msg("Sandbox created")
 	m.running.Store(sbx.ID(), sbx)
+	m.jobs.Store(runId, sbx)
+	defer m.jobs.Delete(runId)
+
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = time.Duration(m.cfg.Config().Sandbox.TimeoutSeconds) * time.Second
+	}
 
-	finished := make(chan bool)
+	finished := make(chan bool, 1)
 	go func() {
 		err := sbx.Run(cout, cerr, finished)
 		if err != nil {
@@ -91,7 +146,13 @@ func (m *Manager) RunInSandbox(submissionID string, lang string, files map[strin
 	select {
 	case <-finished:
 		log.Debug().Field("ContainerID", sbx.ID()).Msg("Sandbox finished execution")
-	case <-time.After(time.Duration(m.cfg.Config().Sandbox.TimeoutSeconds) * time.Second):
+		if r, ok := sbx.(Reporter); ok {
+			res = r.Result()
+		}
+		if len(opts.Collect) > 0 {
+			res.Files = collectFiles(hostDir, opts.Collect)
+		}
+	case <-time.After(timeout):
 		log.Warn().Field("ContainerID", sbx.ID()).Msg("Sandbox timed out.")
 		timedOut = true
 	}
@@ -99,10 +160,94 @@ func (m *Manager) RunInSandbox(submissionID string, lang string, files map[strin
 	cstop <- true // signal to stop collection
 
 	if timedOut {
-		return errors.New("execution timed out")
+		return res, errors.New("execution timed out")
 	}
 
-	return nil
+	return res, nil
+}
+
+// maxCollectBytes bounds the size of the files returned by a run.
+const maxCollectBytes = 4 << 20
+
+// collectFiles reads the regular files in dir matching the patterns until
+// maxCollectBytes are reached.
+func collectFiles(dir string, patterns []string) map[string]string {
+	files := make(map[string]string)
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return files
+	}
+	size := 0
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(dir, filepath.FromSlash(pattern)))
+		if err != nil {
+			log.Warn().Err(err).Field("pattern", pattern).Msg("Invalid collect pattern")
+			continue
+		}
+		for _, match := range matches {
+			// symlinks created by the run may not lead out of the workspace
+			real, err := filepath.EvalSymlinks(match)
+			if err != nil {
+				continue
+			}
+			if rel, err := filepath.Rel(root, real); err != nil || !filepath.IsLocal(rel) {
+				continue
+			}
+			info, err := os.Stat(real)
+			if err != nil || !info.Mode().IsRegular() || size+int(info.Size()) > maxCollectBytes {
+				continue
+			}
+			rel, _ := filepath.Rel(dir, match)
+			data, err := os.ReadFile(real)
+			if err != nil {
+				continue
+			}
+			size += len(data)
+			files[filepath.ToSlash(rel)] = string(data)
+		}
+	}
+	return files
+}
+
+// Kill stops the sandbox running the given submission, if any. RunInSandbox
+// returns as soon as the sandbox is gone.
+func (m *Manager) Kill(submissionID string) bool {
+	v, ok := m.jobs.Load(submissionID)
+	if !ok {
+		return false
+	}
+	sbx := v.(Sandbox)
+	log.Info().Field("ContainerID", sbx.ID()).Field("job_id", submissionID).Msg("Killing sandbox")
+	if err := sbx.Kill(); err != nil {
+		log.Error().Err(err).Field("ContainerID", sbx.ID()).Msg("Failed to kill sandbox")
+	}
+	return true
+}
+
+// IsActive reports whether this manager currently runs the given run ID.
+func (m *Manager) IsActive(runID string) bool {
+	_, ok := m.active.Load(runID)
+	return ok
+}
+
+// ReapSandboxes removes the orphaned sandboxes of all providers which can
+// leave sandboxes behind.
+func (m *Manager) ReapSandboxes(orphaned func(instance, runID string) bool) int {
+	n := 0
+	seen := make(map[Provider]bool)
+	for backend, p := range m.sandbox {
+		r, ok := p.(Reaper)
+		if !ok || seen[p] {
+			continue
+		}
+		seen[p] = true
+		reaped, err := r.ReapOrphans(orphaned)
+		if err != nil {
+			log.Error().Err(err).Field("backend", backend).Msg("Failed to reap orphaned sandboxes")
+		}
+		n += reaped
+	}
+	return n
 }
 
 func (m *Manager) Cleanup() {
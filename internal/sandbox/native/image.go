@@ -0,0 +1,410 @@
+package native
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	mediaDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaOCIIndex       = "application/vnd.oci.image.index.v1+json"
+	mediaOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+)
+
+// ImageConfig is the part of an image configuration needed to run its
+// commands without a container runtime.
+type ImageConfig struct {
+	Env        []string `json:"Env"`
+	WorkingDir string   `json:"WorkingDir"`
+	// Digest of the manifest the image was pulled by
+	Digest string `json:"Digest,omitempty"`
+}
+
+type imageRef struct {
+	registry string
+	repo     string
+	ref      string
+}
+
+// parseRef splits an image reference like "python:alpine",
+// "ghcr.io/org/img:tag" or "img@sha256:..." into its parts.
+func parseRef(image string) imageRef {
+	r := imageRef{registry: "registry-1.docker.io", ref: "latest"}
+
+	name := image
+	if i := strings.Index(name, "@"); i >= 0 {
+		r.ref = name[i+1:]
+		name = name[:i]
+	} else if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		r.ref = name[i+1:]
+		name = name[:i]
+	}
+
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		r.registry = parts[0]
+		name = parts[1]
+	}
+	if r.registry == "registry-1.docker.io" && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	r.repo = name
+	return r
+}
+
+type registryClient struct {
+	http     *http.Client
+	ref      imageRef
+	token    string
+	username string
+	password string
+}
+
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Platform  *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform,omitempty"`
+}
+
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Manifests []descriptor `json:"manifests"`
+	Config    descriptor   `json:"config"`
+	Layers    []descriptor `json:"layers"`
+}
+
+// pullImage downloads the image from its registry and extracts the layers
+// into dir/rootfs. The image configuration is returned.
+func pullImage(image, dir, username, password string, timeout time.Duration) (*ImageConfig, error) {
+	rc := &registryClient{
+		http:     &http.Client{Timeout: timeout},
+		ref:      parseRef(image),
+		username: username,
+		password: password,
+	}
+
+	m, digest, err := rc.manifest(rc.ref.ref)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.MediaType == mediaDockerList || m.MediaType == mediaOCIIndex || len(m.Manifests) > 0 {
+		d := ""
+		for _, desc := range m.Manifests {
+			if desc.Platform != nil && desc.Platform.OS == "linux" && desc.Platform.Architecture == runtime.GOARCH {
+				d = desc.Digest
+				break
+			}
+		}
+		if d == "" {
+			return nil, fmt.Errorf("image %s has no linux/%s variant", image, runtime.GOARCH)
+		}
+		if m, _, err = rc.manifest(d); err != nil {
+			return nil, err
+		}
+	}
+
+	cfgBlob, err := rc.blob(m.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	var imgCfg struct {
+		Config ImageConfig `json:"config"`
+	}
+	err = json.NewDecoder(cfgBlob).Decode(&imgCfg)
+	cfgBlob.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image config: %w", err)
+	}
+
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		return nil, err
+	}
+	for _, l := range m.Layers {
+		if err := rc.extractLayer(l, rootfs); err != nil {
+			return nil, fmt.Errorf("failed to extract layer %s: %w", l.Digest, err)
+		}
+	}
+
+	imgCfg.Config.Digest = digest
+	return &imgCfg.Config, nil
+}
+
+func (rc *registryClient) url(kind, ref string) string {
+	return fmt.Sprintf("https://%s/v2/%s/%s/%s", rc.ref.registry, rc.ref.repo, kind, ref)
+}
+
+// manifest fetches a manifest by tag or digest and returns it with its
+// digest. Manifests requested by digest are verified against it.
+func (rc *registryClient) manifest(ref string) (*manifest, string, error) {
+	res, err := rc.get(rc.url("manifests", ref), strings.Join([]string{
+		mediaDockerList, mediaOCIIndex, mediaDockerManifest, mediaOCIManifest}, ", "))
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 4<<20))
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(body)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if strings.HasPrefix(ref, "sha256:") && ref != digest {
+		return nil, "", fmt.Errorf("manifest digest %s does not match %s", digest, ref)
+	}
+
+	m := new(manifest)
+	if err := json.Unmarshal(body, m); err != nil {
+		return nil, "", fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	if m.MediaType == "" {
+		m.MediaType = res.Header.Get("Content-Type")
+	}
+	return m, digest, nil
+}
+
+func (rc *registryClient) blob(digest string) (io.ReadCloser, error) {
+	res, err := rc.get(rc.url("blobs", digest), "")
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// get performs an authenticated GET request, negotiating a bearer token on
+// the first 401 response.
+func (rc *registryClient) get(u, accept string) (*http.Response, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if rc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+rc.token)
+		} else if rc.username != "" {
+			req.SetBasicAuth(rc.username, rc.password)
+		}
+
+		res, err := rc.http.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			challenge := res.Header.Get("WWW-Authenticate")
+			res.Body.Close()
+			if err := rc.authenticate(challenge); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return nil, fmt.Errorf("registry returned %s for %s", res.Status, u)
+		}
+		return res, nil
+	}
+	return nil, errors.New("registry authentication failed")
+}
+
+func (rc *registryClient) authenticate(challenge string) error {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return fmt.Errorf("unsupported registry auth challenge: %q", challenge)
+	}
+	params := map[string]string{}
+	for _, kv := range strings.Split(strings.TrimPrefix(challenge, "Bearer "), ",") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(kv), "="); ok {
+			params[k] = strings.Trim(v, `"`)
+		}
+	}
+
+	q := url.Values{}
+	if s := params["service"]; s != "" {
+		q.Set("service", s)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + rc.ref.repo + ":pull"
+	}
+	q.Set("scope", scope)
+
+	req, err := http.NewRequest(http.MethodGet, params["realm"]+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if rc.username != "" {
+		req.SetBasicAuth(rc.username, rc.password)
+	}
+	res, err := rc.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("registry token request returned %s", res.Status)
+	}
+
+	var tok struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tok); err != nil {
+		return err
+	}
+	rc.token = tok.Token
+	if rc.token == "" {
+		rc.token = tok.AccessToken
+	}
+	return nil
+}
+
+func (rc *registryClient) extractLayer(l descriptor, rootfs string) error {
+	body, err := rc.blob(l.Digest)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	var r io.Reader = body
+	if strings.HasSuffix(l.MediaType, "gzip") {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return extractTar(r, rootfs)
+}
+
+// extractTar unpacks a layer on top of rootfs, applying OCI whiteouts.
+// Device nodes are skipped, they can not be created without privileges.
+func extractTar(r io.Reader, rootfs string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target, err := securePath(rootfs, hdr.Name)
+		if err != nil {
+			return err
+		}
+		dir, base := filepath.Split(target)
+
+		if base == ".wh..wh..opq" {
+			entries, _ := os.ReadDir(dir)
+			for _, e := range entries {
+				os.RemoveAll(filepath.Join(dir, e.Name()))
+			}
+			continue
+		}
+		if strings.HasPrefix(base, ".wh.") {
+			os.RemoveAll(filepath.Join(dir, strings.TrimPrefix(base, ".wh.")))
+			continue
+		}
+
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+
+		mode := os.FileMode(hdr.Mode).Perm() | 0200 // keep files writable for cleanup
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			os.RemoveAll(target)
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			os.RemoveAll(target)
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			src, err := securePath(rootfs, hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			os.RemoveAll(target)
+			if err := os.Link(src, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// securePath joins name to root. Symlinks in the parent directories are
+// resolved as if root was "/", so a layer can never write outside of root.
+// The last element is not followed.
+func securePath(root, name string) (string, error) {
+	dir, base := filepath.Split(filepath.Clean("/" + name))
+	resolved, err := resolveInRoot(root, dir, 0)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolved, base), nil
+}
+
+func resolveInRoot(root, p string, depth int) (string, error) {
+	if depth > 40 {
+		return "", fmt.Errorf("too many levels of symbolic links in %q", p)
+	}
+	cur := root
+	for _, part := range strings.Split(filepath.Clean("/"+p), "/") {
+		if part == "" {
+			continue
+		}
+		next := filepath.Join(cur, part)
+		fi, err := os.Lstat(next)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			cur = next
+			continue
+		}
+		link, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(link) {
+			link = filepath.Join("/", strings.TrimPrefix(cur, root), link)
+		}
+		if cur, err = resolveInRoot(root, link, depth+1); err != nil {
+			return "", err
+		}
+	}
+	return cur, nil
+}
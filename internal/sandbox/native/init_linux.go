@@ -0,0 +1,167 @@
+//go:build linux
+
+package native
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// Init has to be called first thing in main. When the binary was re-executed
+// as sandbox init process it sets up the mounts and the root of the
+// sandbox, drops its privileges and replaces itself with the sandboxed
+// command, otherwise it returns immediately.
+func Init() {
+	if len(os.Args) != 2 || os.Args[0] != initArg {
+		return
+	}
+
+	var c initConfig
+	if err := json.Unmarshal([]byte(os.Args[1]), &c); err != nil {
+		fail(err)
+	}
+	if err := setupRoot(c); err != nil {
+		fail(err)
+	}
+
+	os.Clearenv()
+	for _, kv := range c.Env {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			os.Setenv(k, v)
+		}
+	}
+	if os.Getenv("PATH") == "" {
+		os.Setenv("PATH", "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin")
+	}
+	if len(c.Args) == 0 {
+		fail(fmt.Errorf("no command given"))
+	}
+	bin, err := exec.LookPath(c.Args[0])
+	if err != nil {
+		fail(err)
+	}
+	if err := dropPrivileges(); err != nil {
+		fail(err)
+	}
+	fail(syscall.Exec(bin, c.Args, os.Environ()))
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "sandbox init: %v\n", err)
+	os.Exit(127)
+}
+
+// setupRoot runs inside the new namespaces as the mapped root user.
+func setupRoot(c initConfig) error {
+	root := c.Rootfs
+
+	// keep all following mounts inside of this namespace
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make / private: %w", err)
+	}
+	if err := syscall.Mount(root, root, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind rootfs: %w", err)
+	}
+
+	for _, dir := range []string{"/tmp", "/var/tmp", "/dev", "/proc"} {
+		if err := os.MkdirAll(path.Join(root, dir), 0755); err != nil {
+			return err
+		}
+	}
+
+	// writable scratch space, the image itself stays read-only
+	for _, dir := range []string{"/tmp", "/var/tmp"} {
+		if err := syscall.Mount("tmpfs", path.Join(root, dir), "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "size=64m,mode=1777"); err != nil {
+			return fmt.Errorf("mount %s: %w", dir, err)
+		}
+	}
+
+	workDir := path.Join(root, c.WorkDir)
+	if err := os.MkdirAll(workDir, 0777); err != nil {
+		return err
+	}
+	if err := syscall.Mount(c.Workspace, workDir, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("bind workspace: %w", err)
+	}
+
+	dev := path.Join(root, "/dev")
+	if err := syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_NOEXEC, "size=64k,mode=755"); err != nil {
+		return fmt.Errorf("mount /dev: %w", err)
+	}
+	for _, name := range []string{"null", "zero", "random", "urandom"} {
+		target := path.Join(dev, name)
+		if err := os.WriteFile(target, nil, 0666); err != nil {
+			return err
+		}
+		if err := syscall.Mount("/dev/"+name, target, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("bind /dev/%s: %w", name, err)
+		}
+	}
+
+	if err := syscall.Mount("proc", path.Join(root, "/proc"), "proc", syscall.MS_NOSUID|syscall.MS_NOEXEC|syscall.MS_NODEV, ""); err != nil {
+		return fmt.Errorf("mount /proc: %w", err)
+	}
+
+	// Flags inherited from the host mount are locked inside a user
+	// namespace and have to be repeated on remount.
+	ro := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY)
+	if err := syscall.Mount("", root, "", ro, ""); err != nil {
+		if err := syscall.Mount("", root, "", ro|syscall.MS_NOSUID|syscall.MS_NODEV, ""); err != nil {
+			return fmt.Errorf("remount rootfs read-only: %w", err)
+		}
+	}
+
+	syscall.Sethostname([]byte("sandbox"))
+
+	// Unlike a chroot, the old root is gone from the mount namespace once
+	// it is detached, so it cannot be reached again from inside.
+	if err := syscall.Chdir(root); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivot_root: %w", err)
+	}
+	// the old root is now mounted on top of the new one
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmount old root: %w", err)
+	}
+	if err := syscall.Chdir("/"); err != nil {
+		return err
+	}
+	return syscall.Chdir(c.WorkDir)
+}
+
+// dropPrivileges clears every capability the init process holds in its user
+// namespace, including the bounding and ambient sets, so that the command
+// starts without any. No new privileges keeps it from regaining them through
+// setuid binaries or file capabilities of the image.
+func dropPrivileges() error {
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("set no_new_privs: %w", err)
+	}
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		return fmt.Errorf("clear ambient capabilities: %w", err)
+	}
+	for c := 0; ; c++ {
+		err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(c), 0, 0, 0)
+		if err == unix.EINVAL {
+			// past the last capability known to the kernel
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("drop bounding capability %d: %w", c, err)
+		}
+	}
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capset(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("clear capabilities: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+package native
+
+// initArg is passed as argv[0] when the binary re-executes itself as the
+// init process of a sandbox.
+const initArg = "code-runner-sandbox-init"
+
+// workspaceRoot is the directory inside of sandboxes holding job workspaces
+const workspaceRoot = "/var/tmp/exec"
+
+// initConfig is handed from the provider to the sandbox init process.
+type initConfig struct {
+	Rootfs    string   `json:"rootfs"`
+	Workspace string   `json:"workspace"`
+	WorkDir   string   `json:"workdir"`
+	Args      []string `json:"args"`
+	Env       []string `json:"env"`
+}
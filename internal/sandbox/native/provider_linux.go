@@ -0,0 +1,392 @@
+//go:build linux
+
+package native
+
+import (
+	"code-runner/internal/config"
+	"code-runner/internal/sandbox"
+	"code-runner/pkg/models"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/xid"
+	"github.com/zekrotja/rogu/log"
+	"golang.org/x/sys/unix"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Provider runs sandboxes without a container runtime: every run gets fresh
+// user, mount, PID, network, IPC and UTS namespaces, a cgroup v2 subtree
+// enforcing the limits and the spec image's rootfs as read-only root.
+type Provider struct {
+	cfg *config.EnvProvider
+
+	mu     sync.Mutex
+	images map[string]*preparedImage
+}
+
+type preparedImage struct {
+	once   sync.Once
+	err    error
+	rootfs string
+	config *ImageConfig
+}
+
+func NewProvider(cfg *config.EnvProvider) (*Provider, error) {
+	c := cfg.Config().Native
+	// The sandbox root is mapped to the user running the engine, which must
+	// not be the host's root outside of a cgroup delegated to the engine.
+	if os.Getuid() == 0 {
+		if err := checkDelegated(c.CgroupParent); err != nil {
+			return nil, fmt.Errorf("refusing to run native sandboxes as root: %w", err)
+		}
+	}
+	if err := os.MkdirAll(c.CgroupParent, 0755); err != nil {
+		return nil, fmt.Errorf("cgroup v2 parent %s is not usable: %w", c.CgroupParent, err)
+	}
+	// Children of the parent can only be limited if the controllers are
+	// delegated to them.
+	if err := os.WriteFile(path.Join(c.CgroupParent, "cgroup.subtree_control"), []byte("+cpu +memory +pids"), 0644); err != nil {
+		log.Warn().Err(err).Field("cgroup", c.CgroupParent).Msg("Failed to enable cgroup controllers")
+	}
+	if err := os.MkdirAll(c.RootfsDir, 0755); err != nil {
+		return nil, err
+	}
+	return &Provider{cfg: cfg, images: make(map[string]*preparedImage)}, nil
+}
+
+// checkDelegated makes sure that the engine runs in a cgroup delegated to it,
+// e.g. a systemd unit with Delegate=yes, and that parent lies within it.
+func checkDelegated(parent string) error {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return err
+	}
+	own := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		if p, ok := strings.CutPrefix(line, "0::"); ok {
+			own = path.Join("/sys/fs/cgroup", p)
+		}
+	}
+	if own == "" {
+		return fmt.Errorf("not running in a cgroup v2 hierarchy")
+	}
+
+	delegated := false
+	for _, attr := range []string{"trusted.delegate", "user.delegate"} {
+		buf := make([]byte, 8)
+		if n, err := unix.Getxattr(own, attr, buf); err == nil && string(buf[:n]) == "1" {
+			delegated = true
+		}
+	}
+	if !delegated {
+		return fmt.Errorf("cgroup %s is not delegated", own)
+	}
+
+	abs, err := filepath.Abs(parent)
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(own, abs); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return fmt.Errorf("cgroup parent %s is not within the delegated cgroup %s", parent, own)
+	}
+	return nil
+}
+
+// Prepare makes sure the rootfs of the spec image has been extracted.
+func (p *Provider) Prepare(spec models.Spec) error {
+	_, err := p.image(spec.ImageRef())
+	return err
+}
+
+// Pull extracts the spec image again. The previous rootfs stays in place
+// for runs still using it and is removed later.
+func (p *Provider) Pull(spec models.Spec) error {
+	image := spec.ImageRef()
+	dir, err := p.imageDir(image)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	delete(p.images, image)
+	p.mu.Unlock()
+
+	trash := dir + ".old-" + xid.New().String()
+	if err := os.Rename(dir, trash); err == nil {
+		grace := time.Duration(p.cfg.Config().Sandbox.TimeoutSeconds)*time.Second + time.Minute
+		time.AfterFunc(grace, func() { os.RemoveAll(trash) })
+	}
+
+	_, err = p.image(image)
+	return err
+}
+
+// ImageStatus reports whether the rootfs of the spec image is extracted.
+func (p *Provider) ImageStatus(spec models.Spec) []sandbox.ImageStatus {
+	image := spec.ImageRef()
+	st := sandbox.ImageStatus{Language: spec.Language, Backend: models.BackendNative, Image: image, Host: "local"}
+
+	dir, err := p.imageDir(image)
+	if err != nil {
+		st.Error = err.Error()
+		return []sandbox.ImageStatus{st}
+	}
+	data, err := os.ReadFile(path.Join(dir, "config.json"))
+	if err != nil {
+		return []sandbox.ImageStatus{st}
+	}
+	var imgCfg ImageConfig
+	json.Unmarshal(data, &imgCfg)
+	st.Present = true
+	st.Digest = imgCfg.Digest
+	filepath.Walk(path.Join(dir, "rootfs"), func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			st.Size += info.Size()
+		}
+		return nil
+	})
+	return []sandbox.ImageStatus{st}
+}
+
+func (p *Provider) image(image string) (*preparedImage, error) {
+	p.mu.Lock()
+	img, ok := p.images[image]
+	if !ok {
+		img = &preparedImage{}
+		p.images[image] = img
+	}
+	p.mu.Unlock()
+
+	img.once.Do(func() {
+		img.rootfs, img.config, img.err = p.extract(image)
+	})
+	if img.err != nil {
+		// allow another attempt on the next job
+		p.mu.Lock()
+		delete(p.images, image)
+		p.mu.Unlock()
+	}
+	return img, img.err
+}
+
+func (p *Provider) imageDir(image string) (string, error) {
+	name := strings.NewReplacer("/", "_", ":", "_", "@", "_").Replace(image)
+	return filepath.Abs(path.Join(p.cfg.Config().Native.RootfsDir, name))
+}
+
+func (p *Provider) extract(image string) (string, *ImageConfig, error) {
+	dir, err := p.imageDir(image)
+	if err != nil {
+		return "", nil, err
+	}
+	cfgPath := path.Join(dir, "config.json")
+
+	if data, err := os.ReadFile(cfgPath); err == nil {
+		imgCfg := new(ImageConfig)
+		if err := json.Unmarshal(data, imgCfg); err == nil {
+			return path.Join(dir, "rootfs"), imgCfg, nil
+		}
+	}
+
+	log.Info().Field("image", image).Msg("Extracting image rootfs...")
+	tmp := dir + ".tmp-" + xid.New().String()
+	defer os.RemoveAll(tmp)
+
+	r := p.cfg.Config().Registry
+	username, password := "", ""
+	if r.Server == "" || r.Server == parseRef(image).registry {
+		username, password = r.Username, r.Password
+	}
+	imgCfg, err := pullImage(image, tmp, username, password, time.Duration(r.PullTimeoutSeconds)*time.Second)
+	if err != nil {
+		return "", nil, err
+	}
+	data, _ := json.Marshal(imgCfg)
+	if err := os.WriteFile(path.Join(tmp, "config.json"), data, 0644); err != nil {
+		return "", nil, err
+	}
+	os.RemoveAll(dir)
+	if err := os.Rename(tmp, dir); err != nil {
+		return "", nil, err
+	}
+	return path.Join(dir, "rootfs"), imgCfg, nil
+}
+
+func (p *Provider) CreateSandbox(spec sandbox.RunSpec) (sandbox.Sandbox, error) {
+	img, err := p.image(spec.ImageRef())
+	if err != nil {
+		return nil, err
+	}
+
+	c := p.cfg.Config()
+	id := "runner-" + spec.Language + "-" + xid.New().String()
+	cgroup := path.Join(c.Native.CgroupParent, id)
+	if err := os.Mkdir(cgroup, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cgroup: %w", err)
+	}
+
+	memory := spec.Memory
+	if memory == 0 {
+		if memory, err = models.ParseMemory(c.Sandbox.Memory); err != nil {
+			os.Remove(cgroup)
+			return nil, err
+		}
+	}
+	limits := map[string]string{
+		"memory.max":      strconv.FormatInt(memory, 10),
+		"memory.swap.max": "0",
+		"pids.max":        strconv.Itoa(c.Native.PidsMax),
+		"cpu.max":         fmt.Sprintf("%d 100000", int(c.Native.CPUs*100000)),
+	}
+	for file, v := range limits {
+		if err := os.WriteFile(path.Join(cgroup, file), []byte(v), 0644); err != nil {
+			os.Remove(cgroup)
+			return nil, fmt.Errorf("failed to set %s: %w", file, err)
+		}
+	}
+
+	hostDir, _ := filepath.Abs(spec.GetAssembledHostDir())
+	env := append(append([]string{}, img.config.Env...), spec.GetEnv()...)
+
+	return &Sandbox{
+		id:     id,
+		cgroup: cgroup,
+		stdin:  spec.Stdin,
+		init: initConfig{
+			Rootfs:    img.rootfs,
+			Workspace: hostDir,
+			WorkDir:   path.Join(workspaceRoot, spec.Subdir),
+			Args:      append(spec.GetEntrypoint(), spec.GetCommandWithArgs()...),
+			Env:       env,
+		},
+	}, nil
+}
+
+type Sandbox struct {
+	id     string
+	cgroup string
+	init   initConfig
+	stdin  string
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	result sandbox.Result
+}
+
+func (s *Sandbox) ID() string { return s.id }
+
+func (s *Sandbox) Run(stdout, stderr chan []byte, close chan bool) error {
+	data, err := json.Marshal(s.init)
+	if err != nil {
+		return err
+	}
+
+	cgroupFD, err := syscall.Open(s.cgroup, syscall.O_DIRECTORY|syscall.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open cgroup: %w", err)
+	}
+	defer syscall.Close(cgroupFD)
+
+	uid, gid := os.Getuid(), os.Getgid()
+	cmd := &exec.Cmd{
+		Path:   "/proc/self/exe",
+		Args:   []string{initArg, string(data)},
+		Env:    []string{},
+		Stdin:  strings.NewReader(s.stdin),
+		Stdout: &sandbox.ChanWriter{C: stdout},
+		Stderr: &sandbox.ChanWriter{C: stderr},
+		SysProcAttr: &syscall.SysProcAttr{
+			Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+				syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+			UidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: uid, Size: 1}},
+			GidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: gid, Size: 1}},
+			GidMappingsEnableSetgroups: false,
+			UseCgroupFD:                true,
+			CgroupFD:                   cgroupFD,
+			Pdeathsig:                  syscall.SIGKILL,
+		},
+	}
+
+	s.mu.Lock()
+	s.cmd = cmd
+	err = cmd.Start()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		cmd.Wait()
+		res := sandbox.Result{ExitCode: cmd.ProcessState.ExitCode()}
+		res.MaxMemory, _ = readCgroupInt(path.Join(s.cgroup, "memory.peak"), "")
+		usage, _ := readCgroupInt(path.Join(s.cgroup, "cpu.stat"), "usage_usec")
+		res.CPUTime = time.Duration(usage) * time.Microsecond
+		oom, _ := readCgroupInt(path.Join(s.cgroup, "memory.events"), "oom_kill")
+		res.OOMKilled = oom > 0
+
+		s.mu.Lock()
+		s.result = res
+		s.mu.Unlock()
+		close <- true
+	}()
+	return nil
+}
+
+// Result reports the exit code and the usage accounted in the cgroup.
+func (s *Sandbox) Result() sandbox.Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.result
+}
+
+// readCgroupInt reads a single value file, or the value of key in a flat
+// keyed file like cpu.stat.
+func readCgroupInt(file, key string) (int64, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case key == "" && len(fields) == 1:
+			return strconv.ParseInt(fields[0], 10, 64)
+		case key != "" && len(fields) == 2 && fields[0] == key:
+			return strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("%s not found in %s", key, file)
+}
+
+// Kill stops every process of the sandbox. Killing the init process of the
+// PID namespace takes down all its descendants.
+func (s *Sandbox) Kill() error {
+	os.WriteFile(path.Join(s.cgroup, "cgroup.kill"), []byte("1"), 0644)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cmd == nil || s.cmd.Process == nil || s.cmd.ProcessState != nil {
+		return nil
+	}
+	return s.cmd.Process.Kill()
+}
+
+func (s *Sandbox) Delete() error {
+	var err error
+	// the cgroup can only be removed once all its processes are gone
+	for i := 0; i < 20; i++ {
+		if err = os.Remove(s.cgroup); err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return err
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+package native
+
+import (
+	"code-runner/internal/config"
+	"code-runner/internal/sandbox"
+	"code-runner/pkg/models"
+	"errors"
+)
+
+var errUnsupported = errors.New("the native sandbox requires linux with cgroups v2")
+
+// Init is a no-op on platforms without the native sandbox.
+func Init() {}
+
+type Provider struct{}
+
+func NewProvider(cfg *config.EnvProvider) (*Provider, error) { return nil, errUnsupported }
+
+func (p *Provider) Prepare(spec models.Spec) error { return errUnsupported }
+
+func (p *Provider) CreateSandbox(spec sandbox.RunSpec) (sandbox.Sandbox, error) {
+	return nil, errUnsupported
+}
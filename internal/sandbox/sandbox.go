@@ -5,6 +5,7 @@ import (
 	"strings"
 	"path"
 	"regexp"
+	"time"
 )
 
 type Sandbox interface {
@@ -14,22 +15,107 @@ type Sandbox interface {
 	Delete() error
 }
 
+// Result describes how the process of a sandbox ended. Usage a provider
+// cannot measure is left zero.
+type Result struct {
+	// ExitCode is -1 if the process did not exit by itself, e.g. because it
+	// was killed
+	ExitCode  int
+	OOMKilled bool
+	CPUTime   time.Duration
+	// MaxMemory is the peak memory usage in bytes
+	MaxMemory int64
+	// Files holds the workspace files matching JobOptions.Collect, keyed by
+	// their slash separated path
+	Files map[string]string
+}
+
+// Reporter is implemented by sandboxes which report the Result of their
+// run once it finished.
+type Reporter interface {
+	Result() Result
+}
+
 type Provider interface {
 	Prepare(spec models.Spec) error
 	CreateSandbox(spec RunSpec) (Sandbox, error)
 }
 
+// ImageManager is implemented by providers which keep the images of specs
+// locally, so their state can be inspected and refreshed.
+type ImageManager interface {
+	ImageStatus(spec models.Spec) []ImageStatus
+	// Pull fetches the image of the spec again, even if it is present
+	Pull(spec models.Spec) error
+}
+
+// Reaper is implemented by providers whose sandboxes can outlive the
+// process which created them, e.g. containers of a crashed engine.
+type Reaper interface {
+	// ReapOrphans removes the sandboxes for which orphaned returns true and
+	// returns how many were removed. instance and runID are empty if the
+	// sandbox does not belong to a job.
+	ReapOrphans(orphaned func(instance, runID string) bool) (int, error)
+}
+
+// ImageStatus describes the image of a spec on one host of a provider.
+type ImageStatus struct {
+	Language string `json:"language"`
+	Backend  string `json:"backend"`
+	Image    string `json:"image"`
+	Host     string `json:"host"`
+	Present  bool   `json:"present"`
+	Size     int64  `json:"size"`
+	Digest   string `json:"digest,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
 type RunSpec struct {
 	models.Spec
 	Arguments   []string
 	Environment map[string]string
-	Subdir      string
-	HostDir     string
+	// Stdin is fed to the process, it sees an empty stdin otherwise
+	Stdin string
+	// Command replaces the command of the spec if set
+	Command []string
+	// Memory is the memory limit of the run in bytes. Providers fall back
+	// to the configured limit if it is 0.
+	Memory  int64
+	Subdir  string
+	HostDir string
+}
+
+// JobOptions are the inputs of a single run on top of its files.
+type JobOptions struct {
+	Arguments   []string
+	Environment map[string]string
+	Stdin       string
+	// Command replaces the command of the spec, e.g. to run a test suite
+	Command []string
+	// Collect are glob patterns of workspace files which are returned in
+	// the Result once the run finished, e.g. test reports
+	Collect []string
+	// Timeout and Memory replace the configured limits if set
+	Timeout time.Duration
+	Memory  int64
 }
 
 func (s RunSpec) GetAssembledHostDir() string { return path.Join(s.HostDir, s.Subdir) }
 func (s RunSpec) GetEntrypoint() []string { return splitArgs(s.Entrypoint) }
-func (s RunSpec) GetCommandWithArgs() []string { return append(splitArgs(s.Cmd), s.Arguments...) }
+func (s RunSpec) GetCommandWithArgs() []string {
+	cmd := splitArgs(s.Cmd)
+	if len(s.Command) > 0 {
+		cmd = append([]string(nil), s.Command...)
+	}
+	if len(s.Arguments) == 0 {
+		return cmd
+	}
+	// "sh -c script" drops trailing arguments unless the script forwards them
+	if len(cmd) == 3 && cmd[1] == "-c" {
+		return append([]string{cmd[0], "-c", cmd[2] + ` "$@"`, cmd[0]}, s.Arguments...)
+	}
+	return append(cmd, s.Arguments...)
+}
 func (s RunSpec) GetEnv() []string {
 	env := []string{"RUNNER_HOSTDIR=" + s.HostDir}
 	for k, v := range s.Environment { env = append(env, k+"="+v) }
@@ -42,3 +128,13 @@ func splitArgs(v string) []string {
 	for i, v := range res { res[i] = strings.Replace(v, "\"", "", -1) }
 	return res
 }
+
+// ChanWriter forwards everything written to it to a channel.
+type ChanWriter struct{ C chan []byte }
+
+func (w *ChanWriter) Write(p []byte) (int, error) {
+	cp := make([]byte, len(p))
+	copy(cp, p)
+	w.C <- cp
+	return len(p), nil
+}
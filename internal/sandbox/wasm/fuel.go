@@ -0,0 +1,429 @@
+package wasm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// fuelExport names the global holding the fuel left of a run.
+const fuelExport = "__runner_fuel"
+
+var (
+	wasmHeader = []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+
+	errTruncated = errors.New("truncated module")
+)
+
+// Section ids of the binary format.
+const (
+	secCustom = 0
+	secImport = 2
+	secGlobal = 6
+	secExport = 7
+	secCode   = 10
+)
+
+// sectionOrder is the order non-custom sections have to appear in.
+var sectionOrder = []byte{1, 2, 3, 4, 5, 13, secGlobal, secExport, 8, 9, 12, secCode, 11}
+
+type section struct {
+	id   byte
+	data []byte
+}
+
+// meter instruments the module so that every function call and every
+// iteration of a loop burns one unit of fuel from a mutable global holding
+// fuel at the start of a run. The guest traps with unreachable as soon as
+// the global drops below zero, which also stops loops without any calls.
+// The global is exported as fuelExport to tell exhaustion from other traps.
+func meter(bin []byte, fuel int64) ([]byte, error) {
+	if !bytes.HasPrefix(bin, wasmHeader) {
+		return nil, errors.New("not a wasm core module")
+	}
+
+	var sections []section
+	r := &reader{b: bin, pos: len(wasmHeader)}
+	for r.err == nil && r.pos < len(r.b) {
+		id := r.byte()
+		data := r.bytes(r.u32())
+		sections = append(sections, section{id, data})
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	// the new global is appended to the imported and defined ones
+	var global uint32
+	for _, s := range sections {
+		var (
+			n   uint32
+			err error
+		)
+		switch s.id {
+		case secImport:
+			n, err = importedGlobals(s.data)
+		case secGlobal:
+			n, err = (&reader{b: s.data}).vecLen()
+		}
+		if err != nil {
+			return nil, err
+		}
+		global += n
+	}
+
+	fuelGlobal := []byte{0x7e, 0x01, 0x42} // mutable i64
+	fuelGlobal = appendSLEB(fuelGlobal, fuel)
+	fuelGlobal = append(fuelGlobal, 0x0b)
+	export := appendULEB(nil, uint64(len(fuelExport)))
+	export = append(export, fuelExport...)
+	export = append(export, 0x03) // global
+	export = appendULEB(export, uint64(global))
+
+	var err error
+	if sections, err = appendEntry(sections, secGlobal, fuelGlobal); err != nil {
+		return nil, err
+	}
+	if sections, err = appendEntry(sections, secExport, export); err != nil {
+		return nil, err
+	}
+
+	out := append([]byte{}, wasmHeader...)
+	for _, s := range sections {
+		if s.id == secCode {
+			if s.data, err = meterCode(s.data, global); err != nil {
+				return nil, err
+			}
+		}
+		out = append(out, s.id)
+		out = appendULEB(out, uint64(len(s.data)))
+		out = append(out, s.data...)
+	}
+	return out, nil
+}
+
+// importedGlobals counts the globals of the import section.
+func importedGlobals(data []byte) (uint32, error) {
+	r := &reader{b: data}
+	n := r.u32()
+	var globals uint32
+	for i := uint32(0); i < n && r.err == nil; i++ {
+		r.bytes(r.u32()) // module
+		r.bytes(r.u32()) // name
+		switch kind := r.byte(); kind {
+		case 0x00: // function
+			r.u32()
+		case 0x01: // table
+			r.valtype()
+			r.limits()
+		case 0x02: // memory
+			r.limits()
+		case 0x03: // global
+			r.valtype()
+			r.byte()
+			globals++
+		case 0x04: // tag
+			r.byte()
+			r.u32()
+		default:
+			r.fail(fmt.Errorf("unknown import kind 0x%02x", kind))
+		}
+	}
+	return globals, r.err
+}
+
+// appendEntry adds the entry to the vector of the section, creating the
+// section at its place in the order if the module has none.
+func appendEntry(sections []section, id byte, entry []byte) ([]section, error) {
+	for i, s := range sections {
+		if s.id != id {
+			continue
+		}
+		r := &reader{b: s.data}
+		n, err := r.vecLen()
+		if err != nil {
+			return nil, err
+		}
+		data := appendULEB(nil, uint64(n)+1)
+		data = append(data, s.data[r.pos:]...)
+		sections[i].data = append(data, entry...)
+		return sections, nil
+	}
+
+	at := len(sections)
+	for i, s := range sections {
+		if s.id != secCustom && sectionRank(s.id) > sectionRank(id) {
+			at = i
+			break
+		}
+	}
+	data := append(appendULEB(nil, 1), entry...)
+	sections = append(sections[:at], append([]section{{id, data}}, sections[at:]...)...)
+	return sections, nil
+}
+
+func sectionRank(id byte) int {
+	return bytes.IndexByte(sectionOrder, id)
+}
+
+// burn returns the instructions taking one unit of fuel from the global.
+func burn(global uint32) []byte {
+	g := appendULEB(nil, uint64(global))
+	var b []byte
+	// global.get, i64.const 1, i64.sub, global.set
+	b = append(append(b, 0x23), g...)
+	b = append(append(b, 0x42, 0x01, 0x7d, 0x24), g...)
+	// global.get, i64.const 0, i64.lt_s, if unreachable end
+	b = append(append(b, 0x23), g...)
+	return append(b, 0x42, 0x00, 0x53, 0x04, 0x40, 0x00, 0x0b)
+}
+
+func meterCode(data []byte, global uint32) ([]byte, error) {
+	fuel := burn(global)
+	r := &reader{b: data}
+	n := r.u32()
+	out := appendULEB(nil, uint64(n))
+	for i := uint32(0); i < n && r.err == nil; i++ {
+		body := r.bytes(r.u32())
+		if r.err != nil {
+			break
+		}
+		metered, err := meterBody(body, fuel)
+		if err != nil {
+			return nil, fmt.Errorf("function %d: %w", i, err)
+		}
+		out = appendULEB(out, uint64(len(metered)))
+		out = append(out, metered...)
+	}
+	return out, r.err
+}
+
+// meterBody burns fuel on entry and at the start of every loop, which is
+// where each of its iterations begins.
+func meterBody(body, fuel []byte) ([]byte, error) {
+	r := &reader{b: body}
+	locals := r.u32()
+	for i := uint32(0); i < locals && r.err == nil; i++ {
+		r.u32()
+		r.valtype()
+	}
+	out := append([]byte{}, body[:r.pos]...)
+	out = append(out, fuel...)
+	for r.err == nil && r.pos < len(r.b) {
+		start := r.pos
+		op := r.byte()
+		r.immediates(op)
+		out = append(out, body[start:r.pos]...)
+		if op == 0x03 { // loop
+			out = append(out, fuel...)
+		}
+	}
+	return out, r.err
+}
+
+type reader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (r *reader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+	r.pos = len(r.b)
+}
+
+func (r *reader) byte() byte {
+	if r.pos >= len(r.b) {
+		r.fail(errTruncated)
+		return 0
+	}
+	b := r.b[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *reader) bytes(n uint32) []byte {
+	if r.err != nil || uint64(n) > uint64(len(r.b)-r.pos) {
+		r.fail(errTruncated)
+		return nil
+	}
+	b := r.b[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b
+}
+
+func (r *reader) u32() uint32 {
+	var v uint64
+	for shift := 0; shift < 35; shift += 7 {
+		b := r.byte()
+		v |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return uint32(v)
+		}
+	}
+	r.fail(errors.New("invalid LEB128 number"))
+	return 0
+}
+
+// leb skips a signed or unsigned LEB128 number of up to 64 bits.
+func (r *reader) leb() {
+	for i := 0; i < 10; i++ {
+		if r.byte()&0x80 == 0 {
+			return
+		}
+	}
+	r.fail(errors.New("invalid LEB128 number"))
+}
+
+func (r *reader) vecLen() (uint32, error) {
+	n := r.u32()
+	return n, r.err
+}
+
+// valtype skips a value type, reference types may carry a heap type.
+func (r *reader) valtype() {
+	if b := r.byte(); b == 0x63 || b == 0x64 {
+		r.leb()
+	}
+}
+
+// blocktype skips the empty type, a value type or a type index.
+func (r *reader) blocktype() {
+	if r.pos < len(r.b) && (r.b[r.pos] == 0x63 || r.b[r.pos] == 0x64) {
+		r.valtype()
+		return
+	}
+	r.leb()
+}
+
+func (r *reader) limits() {
+	flags := r.byte()
+	r.leb()
+	if flags&0x01 != 0 {
+		r.leb()
+	}
+}
+
+func (r *reader) memarg() {
+	// bit 6 of the alignment flags a memory index
+	if r.u32()&0x40 != 0 {
+		r.u32()
+	}
+	r.leb()
+}
+
+// immediates skips the immediates of the instruction.
+func (r *reader) immediates(op byte) {
+	switch {
+	case op <= 0x01, op == 0x05, op == 0x0a, op == 0x0b, op == 0x0f, op == 0x19, op == 0x1a, op == 0x1b:
+	case op >= 0x02 && op <= 0x04, op == 0x06:
+		r.blocktype()
+	case op >= 0x07 && op <= 0x09, op == 0x0c, op == 0x0d, op == 0x10, op == 0x12, op == 0x14, op == 0x15, op == 0x18:
+		r.u32()
+	case op == 0x0e: // br_table
+		n := r.u32()
+		for i := uint32(0); i <= n && r.err == nil; i++ {
+			r.u32()
+		}
+	case op == 0x11, op == 0x13: // call_indirect
+		r.u32()
+		r.u32()
+	case op == 0x1c: // select with types
+		n := r.u32()
+		for i := uint32(0); i < n && r.err == nil; i++ {
+			r.valtype()
+		}
+	case op == 0x1f: // try_table
+		r.blocktype()
+		n := r.u32()
+		for i := uint32(0); i < n && r.err == nil; i++ {
+			if r.byte() < 0x02 {
+				r.u32()
+			}
+			r.u32()
+		}
+	case op >= 0x20 && op <= 0x26:
+		r.u32()
+	case op >= 0x28 && op <= 0x3e:
+		r.memarg()
+	case op == 0x3f, op == 0x40:
+		r.u32()
+	case op == 0x41, op == 0x42:
+		r.leb()
+	case op == 0x43:
+		r.bytes(4)
+	case op == 0x44:
+		r.bytes(8)
+	case op >= 0x45 && op <= 0xc4, op == 0xd1, op == 0xd3, op == 0xd4:
+	case op == 0xd0: // ref.null
+		r.leb()
+	case op == 0xd2, op == 0xd5, op == 0xd6:
+		r.u32()
+	case op == 0xfc:
+		r.miscImmediates(r.u32())
+	case op == 0xfd:
+		r.simdImmediates(r.u32())
+	case op == 0xfe:
+		if r.u32() == 0x03 { // atomic.fence
+			r.byte()
+		} else {
+			r.memarg()
+		}
+	default:
+		r.fail(fmt.Errorf("unsupported opcode 0x%02x", op))
+	}
+}
+
+func (r *reader) miscImmediates(op uint32) {
+	switch {
+	case op <= 7:
+	case op == 8, op == 10, op == 12, op == 14:
+		r.u32()
+		r.u32()
+	case op <= 17:
+		r.u32()
+	default:
+		r.fail(fmt.Errorf("unsupported opcode 0xfc %d", op))
+	}
+}
+
+func (r *reader) simdImmediates(op uint32) {
+	switch {
+	case op <= 11, op == 92, op == 93:
+		r.memarg()
+	case op == 12, op == 13:
+		r.bytes(16)
+	case op >= 21 && op <= 34:
+		r.byte()
+	case op >= 84 && op <= 91:
+		r.memarg()
+		r.byte()
+	case op <= 0x113:
+	default:
+		r.fail(fmt.Errorf("unsupported opcode 0xfd %d", op))
+	}
+}
+
+func appendULEB(b []byte, v uint64) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func appendSLEB(b []byte, v int64) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && c&0x40 == 0) || (v == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
@@ -0,0 +1,115 @@
+package wasm
+
+import (
+	"code-runner/internal/config"
+	"code-runner/internal/sandbox"
+	"code-runner/pkg/models"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// module builds a module exporting its memory of one page and _start with
+// the given body.
+func module(body ...byte) []byte {
+	b := append([]byte{}, wasmHeader...)
+	b = append(b, 0x01, 0x04, 0x01, 0x60, 0x00, 0x00) // type () -> ()
+	b = append(b, 0x03, 0x02, 0x01, 0x00)             // func 0
+	b = append(b, 0x05, 0x03, 0x01, 0x00, 0x01)       // memory 1
+	b = append(b, 0x07, 0x13, 0x02)
+	b = append(append(b, 0x06), "_start"...)
+	b = append(b, 0x00, 0x00)
+	b = append(append(b, 0x06), "memory"...)
+	b = append(b, 0x02, 0x00)
+	code := append([]byte{0x01, byte(len(body) + 1), 0x00}, body...)
+	b = append(b, 0x0a, byte(len(code)))
+	return append(b, code...)
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   []byte
+		memory int64
+		stderr string
+		oom    bool
+	}{
+		{
+			name:   "loop without calls runs out of fuel",
+			body:   []byte{0x03, 0x40, 0x0c, 0x00, 0x0b, 0x0b}, // loop br 0 end
+			stderr: "fuel exhausted",
+		},
+		{
+			// memory.grow 100 pages, trap if it failed
+			name:   "memory does not grow beyond the limit of the run",
+			body:   []byte{0x41, 0xe4, 0x00, 0x40, 0x00, 0x41, 0x7f, 0x46, 0x04, 0x40, 0x00, 0x0b, 0x0b},
+			memory: 1 << 20,
+			stderr: "memory limit exceeded",
+			oom:    true,
+		},
+		{
+			name:   "limit of the run above the default",
+			body:   []byte{0x41, 0xe4, 0x00, 0x40, 0x00, 0x41, 0x7f, 0x46, 0x04, 0x40, 0x00, 0x0b, 0x0b},
+			memory: 16 << 20,
+		},
+	}
+
+	var c config.Config
+	c.Sandbox.Memory = "2M"
+	c.Wasm.Fuel = 1000000
+	p, err := NewProvider(config.NewStaticProvider(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			image := filepath.Join(dir, "m.wasm")
+			if err := os.WriteFile(image, module(tt.body...), 0644); err != nil {
+				t.Fatal(err)
+			}
+			sbx, err := p.CreateSandbox(sandbox.RunSpec{
+				Spec:    models.Spec{Image: image, Language: "wasm"},
+				HostDir: dir,
+				Memory:  tt.memory,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stdout, stderr, done := make(chan []byte), make(chan []byte), make(chan bool, 1)
+			if err := sbx.Run(stdout, stderr, done); err != nil {
+				t.Fatal(err)
+			}
+			var errOut strings.Builder
+			timeout := time.After(10 * time.Second)
+		wait:
+			for {
+				select {
+				case <-stdout:
+				case b := <-stderr:
+					errOut.Write(b)
+				case <-done:
+					break wait
+				case <-timeout:
+					t.Fatal("run did not finish")
+				}
+			}
+
+			res := sbx.(*Sandbox).Result()
+			if tt.stderr == "" && res.ExitCode != 0 {
+				t.Errorf("exit code %d, stderr %q", res.ExitCode, errOut.String())
+			}
+			if !strings.Contains(errOut.String(), tt.stderr) {
+				t.Errorf("stderr %q does not contain %q", errOut.String(), tt.stderr)
+			}
+			if res.OOMKilled != tt.oom {
+				t.Errorf("OOMKilled = %v, want %v", res.OOMKilled, tt.oom)
+			}
+		})
+	}
+}
@@ -0,0 +1,364 @@
+package wasm
+
+import (
+	"code-runner/internal/config"
+	"code-runner/internal/sandbox"
+	"code-runner/pkg/models"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/rs/xid"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+	"github.com/zekrotja/rogu/log"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const pageSize = 64 * 1024
+
+// Provider runs WASI modules in an embedded runtime, so no container
+// runtime is needed on the host. The spec image is the path or http(s) URL
+// of the module, e.g. a CPython or QuickJS build for WASI. Modules are
+// compiled once and instantiated per run, which takes milliseconds.
+type Provider struct {
+	cfg     *config.EnvProvider
+	runtime wazero.Runtime
+	// memory is the default memory limit of a run in bytes
+	memory int64
+
+	mu      sync.Mutex
+	modules map[string]*compiledModule
+}
+
+type compiledModule struct {
+	once   sync.Once
+	err    error
+	mod    wazero.CompiledModule
+	size   int64
+	digest string
+}
+
+func NewProvider(cfg *config.EnvProvider) (*Provider, error) {
+	c := cfg.Config()
+
+	memory, err := models.ParseMemory(c.Sandbox.Memory)
+	if err != nil {
+		return nil, err
+	}
+	if pages := memory / pageSize; pages < 1 || pages > 65536 {
+		return nil, fmt.Errorf("memory limit %s is out of range for wasm", c.Sandbox.Memory)
+	}
+
+	// memory is limited per run by the allocator of the run
+	rc := wazero.NewRuntimeConfig().
+		WithCloseOnContextDone(true)
+	if c.Wasm.CacheDir != "" {
+		cache, err := wazero.NewCompilationCacheWithDir(path.Join(c.Wasm.CacheDir, "compiled"))
+		if err != nil {
+			return nil, err
+		}
+		rc = rc.WithCompilationCache(cache)
+	}
+
+	ctx := context.Background()
+	r := wazero.NewRuntimeWithConfig(ctx, rc)
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+		r.Close(ctx)
+		return nil, err
+	}
+
+	return &Provider{cfg: cfg, runtime: r, memory: memory, modules: make(map[string]*compiledModule)}, nil
+}
+
+// Close releases the runtime and all compiled modules.
+func (p *Provider) Close() {
+	p.runtime.Close(context.Background())
+}
+
+// Prepare compiles the module of the spec.
+func (p *Provider) Prepare(spec models.Spec) error {
+	_, err := p.module(spec)
+	return err
+}
+
+// Pull loads and compiles the module of the spec again. Runs in flight
+// keep using the previous module.
+func (p *Provider) Pull(spec models.Spec) error {
+	p.mu.Lock()
+	delete(p.modules, spec.ImageRef())
+	p.mu.Unlock()
+	os.Remove(p.cachePath(spec.Image))
+
+	_, err := p.module(spec)
+	return err
+}
+
+// ImageStatus reports whether the module of the spec is compiled.
+func (p *Provider) ImageStatus(spec models.Spec) []sandbox.ImageStatus {
+	st := sandbox.ImageStatus{Language: spec.Language, Backend: models.BackendWasm, Image: spec.ImageRef(), Host: "local"}
+
+	p.mu.Lock()
+	m, ok := p.modules[spec.ImageRef()]
+	p.mu.Unlock()
+	if ok && m.mod != nil {
+		st.Present, st.Size, st.Digest = true, m.size, m.digest
+	}
+	return []sandbox.ImageStatus{st}
+}
+
+func (p *Provider) module(spec models.Spec) (wazero.CompiledModule, error) {
+	key := spec.ImageRef()
+	p.mu.Lock()
+	m, ok := p.modules[key]
+	if !ok {
+		m = &compiledModule{}
+		p.modules[key] = m
+	}
+	p.mu.Unlock()
+
+	m.once.Do(func() {
+		m.err = p.compile(spec, m)
+	})
+	if m.err != nil {
+		p.mu.Lock()
+		if p.modules[key] == m {
+			delete(p.modules, key)
+		}
+		p.mu.Unlock()
+	}
+	return m.mod, m.err
+}
+
+func (p *Provider) compile(spec models.Spec, m *compiledModule) error {
+	image := spec.Image
+	bin, err := p.load(image)
+	if err != nil {
+		return fmt.Errorf("failed to load wasm module %s: %w", image, err)
+	}
+
+	sum := sha256.Sum256(bin)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if spec.Digest != "" && spec.Digest != digest {
+		return fmt.Errorf("wasm module %s has digest %s, expected %s", image, digest, spec.Digest)
+	}
+	m.size, m.digest = int64(len(bin)), digest
+
+	if fuel := p.cfg.Config().Wasm.Fuel; fuel > 0 {
+		if bin, err = meter(bin, fuel); err != nil {
+			return fmt.Errorf("failed to meter wasm module %s: %w", image, err)
+		}
+	}
+
+	log.Info().Field("module", image).Msg("Compiling wasm module...")
+	m.mod, err = p.runtime.CompileModule(context.Background(), bin)
+	return err
+}
+
+func (p *Provider) cachePath(image string) string {
+	return path.Join(p.cfg.Config().Wasm.CacheDir, strings.NewReplacer("/", "_", ":", "_").Replace(image))
+}
+
+// load reads the module from disk or downloads it once into the cache dir.
+func (p *Provider) load(image string) ([]byte, error) {
+	if !strings.HasPrefix(image, "http://") && !strings.HasPrefix(image, "https://") {
+		return os.ReadFile(image)
+	}
+
+	c := p.cfg.Config().Wasm
+	cached := p.cachePath(image)
+	if bin, err := os.ReadFile(cached); err == nil {
+		return bin, nil
+	}
+
+	client := &http.Client{Timeout: time.Duration(c.DownloadTimeoutSeconds) * time.Second}
+	res, err := client.Get(image)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download returned %s", res.Status)
+	}
+	bin, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(c.CacheDir, 0755); err == nil {
+		tmp := cached + ".tmp-" + xid.New().String()
+		if err := os.WriteFile(tmp, bin, 0644); err == nil {
+			os.Rename(tmp, cached)
+		}
+	}
+	return bin, nil
+}
+
+func (p *Provider) CreateSandbox(spec sandbox.RunSpec) (sandbox.Sandbox, error) {
+	mod, err := p.module(spec.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	hostDir, _ := filepath.Abs(spec.GetAssembledHostDir())
+	ctx, cancel := context.WithCancel(context.Background())
+	memory := spec.Memory
+	if memory == 0 {
+		memory = p.memory
+	}
+
+	return &Sandbox{
+		id:      "runner-" + spec.Language + "-" + xid.New().String(),
+		runtime: p.runtime,
+		mod:     mod,
+		spec:    spec,
+		hostDir: hostDir,
+		ctx:     ctx,
+		cancel:  cancel,
+		memory:  &memoryLimit{limit: uint64(memory)},
+	}, nil
+}
+
+type Sandbox struct {
+	id      string
+	runtime wazero.Runtime
+	mod     wazero.CompiledModule
+	spec    sandbox.RunSpec
+	hostDir string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	memory *memoryLimit
+
+	mu     sync.Mutex
+	result sandbox.Result
+}
+
+func (s *Sandbox) ID() string { return s.id }
+
+// Result reports the exit code and the final size of the linear memory.
+func (s *Sandbox) Result() sandbox.Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.result
+}
+
+func (s *Sandbox) Run(stdout, stderr chan []byte, close chan bool) error {
+	cfg := wazero.NewModuleConfig().
+		// anonymous, so the same module can run concurrently
+		WithName("").
+		WithArgs(append(s.spec.GetEntrypoint(), s.spec.GetCommandWithArgs()...)...).
+		WithStdin(strings.NewReader(s.spec.Stdin)).
+		WithStdout(&sandbox.ChanWriter{C: stdout}).
+		WithStderr(&sandbox.ChanWriter{C: stderr}).
+		WithFSConfig(wazero.NewFSConfig().WithDirMount(s.hostDir, "/")).
+		// _start is called once the memory of the module has been checked
+		WithStartFunctions().
+		WithRandSource(rand.Reader).
+		WithSysWalltime().
+		WithSysNanotime().
+		WithSysNanosleep()
+	for _, kv := range s.spec.GetEnv() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			cfg = cfg.WithEnv(k, v)
+		}
+	}
+
+	go func() {
+		defer func() { close <- true }()
+
+		ctx := experimental.WithMemoryAllocator(s.ctx, s.memory)
+		res := sandbox.Result{ExitCode: -1}
+		m, err := s.runtime.InstantiateModule(ctx, s.mod, cfg)
+		if err == nil && !s.memory.exceeded {
+			if start := m.ExportedFunction("_start"); start != nil {
+				_, err = start.Call(ctx)
+			}
+		}
+		exhausted := false
+		if m != nil {
+			if g := m.ExportedGlobal(fuelExport); g != nil {
+				exhausted = int64(g.Get()) < 0
+			}
+			m.Close(context.Background())
+		}
+		res.MaxMemory = int64(s.memory.peak)
+		res.OOMKilled = s.memory.exceeded
+
+		var exitErr *sys.ExitError
+		switch {
+		case exhausted:
+			stderr <- []byte("\nwasm: fuel exhausted\n")
+		case res.OOMKilled:
+			stderr <- []byte("\nwasm: memory limit exceeded\n")
+		case errors.As(err, &exitErr):
+			// regular exit of the module, unless it was stopped by Kill
+			if s.ctx.Err() == nil {
+				res.ExitCode = int(exitErr.ExitCode())
+			}
+		case err != nil:
+			stderr <- []byte("\nwasm: " + err.Error() + "\n")
+		default:
+			res.ExitCode = 0
+		}
+		s.mu.Lock()
+		s.result = res
+		s.mu.Unlock()
+	}()
+	return nil
+}
+
+func (s *Sandbox) Kill() error {
+	s.cancel()
+	return nil
+}
+
+func (s *Sandbox) Delete() error {
+	s.cancel()
+	return nil
+}
+
+// memoryLimit backs the linear memory of a run and refuses to grow it
+// beyond the memory limit of the run. Modules have a single memory.
+type memoryLimit struct {
+	limit    uint64
+	buf      []byte
+	started  bool
+	peak     uint64
+	exceeded bool
+}
+
+func (l *memoryLimit) Allocate(cap, max uint64) experimental.LinearMemory {
+	l.buf = make([]byte, 0, min(cap, l.limit))
+	return l
+}
+
+func (l *memoryLimit) Reallocate(size uint64) []byte {
+	if size > l.limit {
+		l.exceeded = true
+		// the initial memory has to be allocated, the run is stopped
+		// before it starts
+		if l.started {
+			return nil
+		}
+	}
+	l.started = true
+	if n := uint64(len(l.buf)); size > n {
+		l.buf = append(l.buf, make([]byte, size-n)...)
+	}
+	l.peak = max(l.peak, size)
+	return l.buf
+}
+
+func (l *memoryLimit) Free() { l.buf = nil }
@@ -17,6 +17,11 @@ func NewFileProvider(path string) *BaseProvider {
 	return &BaseProvider{m: m}
 }
 
+// NewProvider serves the given specs, e.g. ones assembled in code.
+func NewProvider(m models.SpecMap) *BaseProvider {
+	return &BaseProvider{m: m}
+}
+
 func (p *BaseProvider) Spec() models.SpecMap { return p.m }
 
 func (p *BaseProvider) Get(key string) (models.Spec, bool) {
@@ -26,3 +31,19 @@ func (p *BaseProvider) Get(key string) (models.Spec, bool) {
 	}
 	return models.Spec{}, false
 }
+
+// All returns every spec with its "use" references resolved. Aliases of the
+// same language are returned once.
+func (p *BaseProvider) All() []models.Spec {
+	seen := make(map[string]bool)
+	var specs []models.Spec
+	for key := range p.m {
+		s, ok := p.Get(key)
+		if !ok || seen[s.Language] {
+			continue
+		}
+		seen[s.Language] = true
+		specs = append(specs, s)
+	}
+	return specs
+}
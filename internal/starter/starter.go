@@ -0,0 +1,160 @@
+// Package starter generates the code students start answering a question
+// with, matching the drivers of the worker.
+package starter
+
+import (
+	"code-runner/pkg/models"
+	"fmt"
+	"strings"
+)
+
+// generators create the starter code of the languages the drivers of the
+// worker run, by spec key.
+var generators = map[string]func(q *models.Question) string{
+	"python3":    python,
+	"python":     python,
+	"node":       javascript,
+	"javascript": javascript,
+}
+
+// ForQuestion returns the starter code of the question for every language
+// in specs. Starter code stored on the question takes precedence over the
+// generated one. Questions not graded by the drivers only get stored code.
+func ForQuestion(q *models.Question, specs models.SpecMap) map[string]string {
+	code := make(map[string]string)
+	for lang := range specs {
+		if c, ok := q.StarterCode[lang]; ok {
+			code[lang] = c
+			continue
+		}
+		gen, ok := generators[lang]
+		if !ok || !usesDriver(q) {
+			continue
+		}
+		code[lang] = gen(q)
+	}
+	return code
+}
+
+// Customized returns the stored starter code of the question which differs
+// from the generated one, so generated code stays in sync with the
+// signature once saved back.
+func Customized(q *models.Question) map[string]string {
+	var code map[string]string
+	for lang, c := range q.StarterCode {
+		if gen, ok := generators[lang]; ok && usesDriver(q) && gen(q) == c {
+			continue
+		}
+		if code == nil {
+			code = make(map[string]string)
+		}
+		code[lang] = c
+	}
+	return code
+}
+
+func usesDriver(q *models.Question) bool {
+	if q.Project != nil || q.UnitTests != nil || q.SQL != nil {
+		return false
+	}
+	return q.Scoring == nil || !q.Scoring.OutputOnly
+}
+
+func python(q *models.Question) string {
+	sig := q.Signature
+	if sig == nil {
+		return "def solve(input):\n    # input is the input of the test case as a string\n    pass\n"
+	}
+
+	var b strings.Builder
+	b.WriteString("from typing import List, Optional\n\n")
+	if usesType(sig, models.TypeTree) {
+		b.WriteString("# class TreeNode:\n#     def __init__(self, val=0, left=None, right=None):\n#         self.val = val\n#         self.left = left\n#         self.right = right\n\n")
+	}
+	if usesType(sig, models.TypeList) {
+		b.WriteString("# class ListNode:\n#     def __init__(self, val=0, next=None):\n#         self.val = val\n#         self.next = next\n\n")
+	}
+	params := make([]string, len(sig.Params))
+	for i, p := range sig.Params {
+		params[i] = p.Name + ": " + pythonType(p.Type)
+	}
+	fmt.Fprintf(&b, "def %s(%s) -> %s:\n    pass\n", sig.Function, strings.Join(params, ", "), pythonType(sig.Returns))
+	return b.String()
+}
+
+func pythonType(t string) string {
+	if elem, ok := models.ElemType(t); ok {
+		return "List[" + pythonType(elem) + "]"
+	}
+	switch t {
+	case models.TypeString:
+		return "str"
+	case models.TypeTree, models.TypeList:
+		return "Optional[" + t + "]"
+	}
+	return t
+}
+
+func javascript(q *models.Question) string {
+	sig := q.Signature
+	if sig == nil {
+		return "// input is the input of the test case, numeric inputs are passed as numbers\nmodule.exports = (input) => {\n\n};\n"
+	}
+
+	var b strings.Builder
+	if usesType(sig, models.TypeTree) {
+		b.WriteString("// class TreeNode {\n//     constructor(val = 0, left = null, right = null) {\n//         this.val = val; this.left = left; this.right = right;\n//     }\n// }\n\n")
+	}
+	if usesType(sig, models.TypeList) {
+		b.WriteString("// class ListNode {\n//     constructor(val = 0, next = null) {\n//         this.val = val; this.next = next;\n//     }\n// }\n\n")
+	}
+	b.WriteString("/**\n")
+	names := make([]string, len(sig.Params))
+	for i, p := range sig.Params {
+		names[i] = p.Name
+		fmt.Fprintf(&b, " * @param {%s} %s\n", jsType(p.Type), p.Name)
+	}
+	fmt.Fprintf(&b, " * @return {%s}\n */\n", jsType(sig.Returns))
+	fmt.Fprintf(&b, "function %s(%s) {\n\n}\n\nmodule.exports = { %s };\n", sig.Function, strings.Join(names, ", "), sig.Function)
+	return b.String()
+}
+
+func jsType(t string) string {
+	if elem, ok := models.ElemType(t); ok {
+		if elem = jsType(elem); strings.Contains(elem, "|") {
+			elem = "(" + elem + ")"
+		}
+		return elem + "[]"
+	}
+	switch t {
+	case models.TypeInt, models.TypeFloat:
+		return "number"
+	case models.TypeBool:
+		return "boolean"
+	case models.TypeTree, models.TypeList:
+		return t + "|null"
+	}
+	return t
+}
+
+// usesType reports whether base is the base type of a parameter or the
+// return value.
+func usesType(sig *models.Signature, base string) bool {
+	types := []string{sig.Returns}
+	for _, p := range sig.Params {
+		types = append(types, p.Type)
+	}
+	for _, t := range types {
+		for {
+			elem, ok := models.ElemType(t)
+			if !ok {
+				break
+			}
+			t = elem
+		}
+		if t == base {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package testreport
+
+import (
+	"code-runner/pkg/models"
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+// junitSuite matches both <testsuites> and <testsuite> elements, suites
+// may be nested.
+type junitSuite struct {
+	Suites []junitSuite `xml:"testsuite"`
+	Cases  []junitCase  `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Failures  []junitResult `xml:"failure"`
+	Errors    []junitResult `xml:"error"`
+	Skipped   *junitResult  `xml:"skipped"`
+}
+
+type junitResult struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// String returns the message and the details, e.g. a stack trace, which
+// often repeat the message.
+func (r junitResult) String() string {
+	msg, text := strings.TrimSpace(r.Message), strings.TrimSpace(r.Text)
+	switch {
+	case text == "":
+		return msg
+	case msg == "" || strings.Contains(text, msg):
+		return text
+	}
+	return msg + "\n" + text
+}
+
+// ParseJUnit reads a JUnit XML report as written by Surefire, Gradle,
+// pytest, jest-junit and most other frameworks.
+func ParseJUnit(data []byte) ([]models.TestResult, error) {
+	var root junitSuite
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("invalid JUnit report: %w", err)
+	}
+	var res []models.TestResult
+	root.collect(&res)
+	return res, nil
+}
+
+func (s junitSuite) collect(res *[]models.TestResult) {
+	for _, c := range s.Cases {
+		r := models.TestResult{TestCaseID: c.Name, Status: StatusPassed}
+		if c.Classname != "" {
+			r.TestCaseID = c.Classname + "." + c.Name
+		}
+		switch {
+		case len(c.Failures) > 0:
+			r.Status, r.Message = StatusFailed, c.Failures[0].String()
+		case len(c.Errors) > 0:
+			r.Status, r.Message = StatusError, c.Errors[0].String()
+		case c.Skipped != nil:
+			r.Status, r.Message = StatusSkipped, c.Skipped.String()
+		}
+		*res = append(*res, r)
+	}
+	for _, sub := range s.Suites {
+		sub.collect(res)
+	}
+}
@@ -0,0 +1,58 @@
+package testreport
+
+import (
+	"code-runner/pkg/models"
+	"regexp"
+	"strings"
+)
+
+var (
+	libtestRx        = regexp.MustCompile(`^test (\S+)(?: - should panic)? \.\.\. (ok|FAILED|ignored)\b`)
+	libtestSectionRx = regexp.MustCompile(`^---- (\S+) stdout ----$`)
+)
+
+// ParseLibtest reads the output of Rust's test harness, as printed by cargo
+// test. Failure messages are taken from the stdout sections of failed tests.
+func ParseLibtest(out string) []models.TestResult {
+	var res []models.TestResult
+	index := make(map[string]int)
+	messages := make(map[string][]string)
+	section := ""
+
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if m := libtestRx.FindStringSubmatch(line); m != nil {
+			r := models.TestResult{TestCaseID: m[1], Status: StatusPassed}
+			switch m[2] {
+			case "FAILED":
+				r.Status = StatusFailed
+			case "ignored":
+				r.Status = StatusSkipped
+			}
+			index[m[1]] = len(res)
+			res = append(res, r)
+			section = ""
+			continue
+		}
+		if m := libtestSectionRx.FindStringSubmatch(line); m != nil {
+			section = m[1]
+			continue
+		}
+		if section == "" {
+			continue
+		}
+		// the sections end with the list of failed tests
+		if line == "failures:" || strings.HasPrefix(line, "test result:") {
+			section = ""
+			continue
+		}
+		messages[section] = append(messages[section], line)
+	}
+
+	for name, lines := range messages {
+		if i, ok := index[name]; ok {
+			res[i].Message = strings.TrimSpace(strings.Join(lines, "\n"))
+		}
+	}
+	return res
+}
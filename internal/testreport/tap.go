@@ -0,0 +1,140 @@
+package testreport
+
+import (
+	"code-runner/pkg/models"
+	"regexp"
+	"strings"
+)
+
+var (
+	tapTestRx  = regexp.MustCompile(`^(not ok|ok)\b\s*(\d*)\s*(?:-\s*)?(.*)$`)
+	tapDirRx   = regexp.MustCompile(`(?i)(?:^|\s+)#\s*(skip|todo)\b.*$`)
+	tapFieldRx = regexp.MustCompile(`^\s*(expected|actual|message|error):\s*(.*)$`)
+)
+
+type tapTest struct {
+	models.TestResult
+	indent int
+}
+
+// ParseTAP reads a TAP stream, e.g. of node --test or tap reporters. Tests
+// with subtests, as nested by node, are replaced by their subtests unless
+// they failed on their own. TODO tests never fail.
+func ParseTAP(out string) []models.TestResult {
+	var (
+		tests  []tapTest
+		last   *tapTest
+		inYAML bool
+		yaml   []string
+		// indent of the previous test line, including dropped parents
+		prevIndent int
+	)
+	endYAML := func() {
+		block := yaml
+		inYAML, yaml = false, nil
+		// diagnostics of passing tests only hold timings
+		if last.Status != StatusFailed {
+			return
+		}
+		msg := ""
+		for _, line := range block {
+			if m := tapFieldRx.FindStringSubmatch(line); m != nil {
+				v := strings.Trim(strings.TrimSpace(m[2]), `'"`)
+				switch m[1] {
+				case "expected":
+					last.Expected = v
+				case "actual":
+					last.Actual = v
+				default:
+					msg = v
+				}
+			}
+		}
+		if msg == "" {
+			msg = strings.Join(block, "\n")
+		}
+		last.Message = strings.TrimSpace(msg)
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+		if inYAML {
+			if trimmed == "..." {
+				endYAML()
+			} else {
+				yaml = append(yaml, strings.TrimPrefix(line, strings.Repeat(" ", last.indent+2)))
+			}
+			continue
+		}
+		if trimmed == "---" && last != nil {
+			inYAML = true
+			continue
+		}
+		if strings.HasPrefix(trimmed, "Bail out!") {
+			tests = append(tests, tapTest{TestResult: models.TestResult{
+				TestCaseID: "bail out",
+				Status:     StatusError,
+				Message:    strings.TrimSpace(strings.TrimPrefix(trimmed, "Bail out!")),
+			}})
+			last = nil
+			continue
+		}
+
+		m := tapTestRx.FindStringSubmatch(trimmed)
+		if m == nil {
+			continue
+		}
+		t := tapTest{indent: len(line) - len(strings.TrimLeft(line, " ")), TestResult: models.TestResult{Status: StatusPassed}}
+		name := m[3]
+		directive := ""
+		if d := tapDirRx.FindStringSubmatch(name); d != nil {
+			directive = strings.ToLower(d[1])
+			name = strings.TrimSpace(name[:len(name)-len(d[0])])
+		}
+		t.TestCaseID = name
+		if name == "" {
+			t.TestCaseID = m[2]
+		}
+		switch {
+		case directive == "skip":
+			t.Status = StatusSkipped
+		case directive == "todo":
+		case m[1] == "not ok":
+			t.Status = StatusFailed
+		}
+
+		// a parent follows its subtests, which are indented deeper. It is
+		// only kept if it failed without a failing subtest.
+		isParent := prevIndent > t.indent
+		prevIndent = t.indent
+		if isParent {
+			if t.Status != StatusFailed || hasFailure(tests, t.indent) {
+				last = nil
+				continue
+			}
+		}
+		tests = append(tests, t)
+		last = &tests[len(tests)-1]
+	}
+	if inYAML {
+		endYAML()
+	}
+
+	res := make([]models.TestResult, len(tests))
+	for i, t := range tests {
+		res[i] = t.TestResult
+	}
+	return res
+}
+
+// hasFailure reports whether one of the subtests indented deeper than
+// indent at the end of tests failed.
+func hasFailure(tests []tapTest, indent int) bool {
+	for i := len(tests) - 1; i >= 0 && tests[i].indent > indent; i-- {
+		if tests[i].Status == StatusFailed {
+			return true
+		}
+	}
+	return false
+}
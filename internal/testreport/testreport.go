@@ -0,0 +1,87 @@
+// Package testreport turns the reports of test frameworks into per-test
+// results.
+package testreport
+
+import (
+	"code-runner/pkg/models"
+	"fmt"
+	"sort"
+)
+
+const (
+	StatusPassed  = "PASSED"
+	StatusFailed  = "FAILED"
+	StatusError   = "ERROR"
+	StatusSkipped = "SKIPPED"
+)
+
+// Parse reads the results of all reports in the format. Reports are parsed
+// in the order of their names. Without reports, output is parsed instead,
+// which only some formats support.
+func Parse(format string, reports map[string]string, output string) ([]models.TestResult, error) {
+	if len(reports) == 0 {
+		switch format {
+		case models.ReportTAP:
+			return ParseTAP(output), nil
+		case models.ReportLibtest:
+			return ParseLibtest(output), nil
+		case models.ReportJUnit:
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unsupported report format %q", format)
+	}
+
+	names := make([]string, 0, len(reports))
+	for name := range reports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var res []models.TestResult
+	for _, name := range names {
+		var (
+			results []models.TestResult
+			err     error
+		)
+		switch format {
+		case models.ReportJUnit:
+			results, err = ParseJUnit([]byte(reports[name]))
+		case models.ReportTAP:
+			results = ParseTAP(reports[name])
+		case models.ReportLibtest:
+			results = ParseLibtest(reports[name])
+		default:
+			return nil, fmt.Errorf("unsupported report format %q", format)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		res = append(res, results...)
+	}
+	return res, nil
+}
+
+// Count returns the number of passed tests and of tests which ran, skipped
+// tests are left out.
+func Count(results []models.TestResult) (passed, total int) {
+	for _, r := range results {
+		switch r.Status {
+		case StatusSkipped:
+			continue
+		case StatusPassed:
+			passed++
+		}
+		total++
+	}
+	return passed, total
+}
+
+// FirstFailure returns the first test which failed or errored.
+func FirstFailure(results []models.TestResult) (models.TestResult, bool) {
+	for _, r := range results {
+		if r.Status == StatusFailed || r.Status == StatusError {
+			return r, true
+		}
+	}
+	return models.TestResult{}, false
+}
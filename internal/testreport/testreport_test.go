@@ -0,0 +1,259 @@
+package testreport
+
+import (
+	"code-runner/pkg/models"
+	"reflect"
+	"testing"
+)
+
+func TestParseTAP(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want []models.TestResult
+	}{
+		{
+			name: "nested subtests with diagnostics",
+			out: `TAP version 13
+# Subtest: math
+    # Subtest: adds
+    ok 1 - adds
+      ---
+      duration_ms: 0.5
+      ...
+    # Subtest: subtracts
+    not ok 2 - subtracts
+      ---
+      duration_ms: 0.7
+      failureType: 'testCodeFailure'
+      error: 'Expected values to be strictly equal'
+      expected: 1
+      actual: 2
+      ...
+    1..2
+not ok 1 - math
+  ---
+  error: '1 subtest of 2 failed'
+  ...
+1..1`,
+			want: []models.TestResult{
+				{TestCaseID: "adds", Status: StatusPassed},
+				{TestCaseID: "subtracts", Status: StatusFailed, Expected: "1", Actual: "2", Message: "Expected values to be strictly equal"},
+			},
+		},
+		{
+			name: "parent failing on its own",
+			out: `    ok 1 - child
+not ok 1 - parent
+  ---
+  error: 'hook failed'
+  ...`,
+			want: []models.TestResult{
+				{TestCaseID: "child", Status: StatusPassed},
+				{TestCaseID: "parent", Status: StatusFailed, Message: "hook failed"},
+			},
+		},
+		{
+			name: "skip and todo directives",
+			out: `ok 1 - not ready # SKIP needs a database
+not ok 2 - later # TODO not implemented
+ok 3 # skip`,
+			want: []models.TestResult{
+				{TestCaseID: "not ready", Status: StatusSkipped},
+				{TestCaseID: "later", Status: StatusPassed},
+				{TestCaseID: "3", Status: StatusSkipped},
+			},
+		},
+		{
+			name: "diagnostics without known fields",
+			out: `not ok 1 - broken
+  ---
+  at: test.js:3
+  ...`,
+			want: []models.TestResult{
+				{TestCaseID: "broken", Status: StatusFailed, Message: "at: test.js:3"},
+			},
+		},
+		{
+			name: "bail out",
+			out: `ok 1 - connects
+Bail out! database went away
+ok 2 - never runs`,
+			want: []models.TestResult{
+				{TestCaseID: "connects", Status: StatusPassed},
+				{TestCaseID: "bail out", Status: StatusError, Message: "database went away"},
+				{TestCaseID: "never runs", Status: StatusPassed},
+			},
+		},
+		{
+			name: "no tests",
+			out:  "hello\n1..0",
+			want: []models.TestResult{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseTAP(tt.out); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseTAP() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLibtest(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want []models.TestResult
+	}{
+		{
+			name: "failure sections",
+			out: `running 4 tests
+test tests::adds ... ok
+test tests::subtracts ... FAILED
+test tests::divides - should panic ... ok
+test tests::slow ... ignored
+
+failures:
+
+---- tests::subtracts stdout ----
+thread 'tests::subtracts' panicked at src/lib.rs:10:9:
+assertion ` + "`left == right`" + ` failed
+  left: 1
+ right: 2
+
+failures:
+    tests::subtracts
+
+test result: FAILED. 2 passed; 1 failed; 1 ignored; 0 measured; 0 filtered out`,
+			want: []models.TestResult{
+				{TestCaseID: "tests::adds", Status: StatusPassed},
+				{TestCaseID: "tests::subtracts", Status: StatusFailed, Message: "thread 'tests::subtracts' panicked at src/lib.rs:10:9:\nassertion `left == right` failed\n  left: 1\n right: 2"},
+				{TestCaseID: "tests::divides", Status: StatusPassed},
+				{TestCaseID: "tests::slow", Status: StatusSkipped},
+			},
+		},
+		{
+			name: "several test binaries",
+			out: `running 1 test
+test unit ... ok
+
+test result: ok. 1 passed; 0 failed
+
+     Running tests/api.rs
+
+running 1 test
+test api ... FAILED
+
+failures:
+
+---- api stdout ----
+boom
+
+failures:
+    api`,
+			want: []models.TestResult{
+				{TestCaseID: "unit", Status: StatusPassed},
+				{TestCaseID: "api", Status: StatusFailed, Message: "boom"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseLibtest(tt.out); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseLibtest() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseJUnit(t *testing.T) {
+	tests := []struct {
+		name    string
+		report  string
+		want    []models.TestResult
+		wantErr bool
+	}{
+		{
+			name: "several and nested suites",
+			report: `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="calc">
+    <testcase classname="CalcTest" name="adds"/>
+    <testcase classname="CalcTest" name="subtracts">
+      <failure message="expected 1 but was 2">org.opentest4j.AssertionFailedError: expected 1 but was 2
+	at CalcTest.subtracts(CalcTest.java:12)</failure>
+    </testcase>
+  </testsuite>
+  <testsuite name="io">
+    <testsuite name="files">
+      <testcase name="reads"><error message="file not found"/></testcase>
+      <testcase name="writes"><skipped message="read-only"/></testcase>
+    </testsuite>
+  </testsuite>
+</testsuites>`,
+			want: []models.TestResult{
+				{TestCaseID: "CalcTest.adds", Status: StatusPassed},
+				{TestCaseID: "CalcTest.subtracts", Status: StatusFailed, Message: "org.opentest4j.AssertionFailedError: expected 1 but was 2\n\tat CalcTest.subtracts(CalcTest.java:12)"},
+				{TestCaseID: "reads", Status: StatusError, Message: "file not found"},
+				{TestCaseID: "writes", Status: StatusSkipped, Message: "read-only"},
+			},
+		},
+		{
+			name:   "single suite with message and details",
+			report: `<testsuite><testcase name="t"><failure message="short">long trace</failure></testcase></testsuite>`,
+			want: []models.TestResult{
+				{TestCaseID: "t", Status: StatusFailed, Message: "short\nlong trace"},
+			},
+		},
+		{
+			name:    "malformed",
+			report:  `<testsuite><testcase name="t">`,
+			wantErr: true,
+		},
+		{
+			name:    "not xml",
+			report:  `all tests passed`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseJUnit([]byte(tt.report))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseJUnit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseJUnit() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	reports := map[string]string{
+		"b.xml": `<testsuite><testcase name="second"/></testsuite>`,
+		"a.xml": `<testsuite><testcase name="first"/></testsuite>`,
+	}
+	got, err := Parse(models.ReportJUnit, reports, "ok 1 - from the output")
+	want := []models.TestResult{
+		{TestCaseID: "first", Status: StatusPassed},
+		{TestCaseID: "second", Status: StatusPassed},
+	}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse() = %+v, %v, want %+v", got, err, want)
+	}
+
+	if _, err := Parse(models.ReportJUnit, map[string]string{"bad.xml": "<"}, ""); err == nil {
+		t.Error("Parse() accepted a malformed report")
+	}
+	if got, err := Parse(models.ReportJUnit, nil, "ok 1 - forged"); err != nil || got != nil {
+		t.Errorf("Parse() read JUnit results from the output: %+v, %v", got, err)
+	}
+	if _, err := Parse("xunit", nil, ""); err == nil {
+		t.Error("Parse() accepted an unsupported format")
+	}
+}
@@ -0,0 +1,91 @@
+package util
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// HostStats samples the CPU and memory headroom of the host from /proc.
+// On systems without /proc every headroom is reported as fully available.
+type HostStats struct {
+	mu        sync.Mutex
+	lastIdle  uint64
+	lastTotal uint64
+}
+
+func NewHostStats() *HostStats {
+	hs := &HostStats{}
+	hs.lastIdle, hs.lastTotal, _ = readCPU()
+	return hs
+}
+
+// CPUHeadroom returns the share of idle CPU time (0..1) since the last call.
+func (hs *HostStats) CPUHeadroom() float64 {
+	idle, total, ok := readCPU()
+	if !ok {
+		return 1
+	}
+
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	dIdle, dTotal := idle-hs.lastIdle, total-hs.lastTotal
+	hs.lastIdle, hs.lastTotal = idle, total
+	if dTotal == 0 {
+		return 1
+	}
+	return float64(dIdle) / float64(dTotal)
+}
+
+// MemoryHeadroom returns the share of available memory (0..1).
+func (hs *HostStats) MemoryHeadroom() float64 {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 1
+	}
+	defer f.Close()
+
+	var total, available uint64
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		v, _ := strconv.ParseUint(fields[1], 10, 64)
+		switch fields[0] {
+		case "MemTotal:":
+			total = v
+		case "MemAvailable:":
+			available = v
+		}
+	}
+	if total == 0 {
+		return 1
+	}
+	return float64(available) / float64(total)
+}
+
+func readCPU() (idle, total uint64, ok bool) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return 0, 0, false
+	}
+	line := strings.SplitN(string(data), "\n", 2)[0]
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, 0, false
+	}
+	for i, f := range fields[1:] {
+		v, _ := strconv.ParseUint(f, 10, 64)
+		total += v
+		// idle and iowait
+		if i == 3 || i == 4 {
+			idle += v
+		}
+	}
+	return idle, total, true
+}
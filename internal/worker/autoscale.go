@@ -0,0 +1,213 @@
+package worker
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScaleMetrics is the snapshot of the current load a ScalingPolicy bases
+// its decision on.
+type ScaleMetrics struct {
+	Workers     int
+	Busy        int
+	QueueLength int64
+	// QueueAge is how long the oldest job has been waiting in the queue.
+	QueueAge time.Duration
+	// JobLatency is the moving average of the time a job takes to process.
+	JobLatency time.Duration
+	// CPUHeadroom and MemoryHeadroom are the idle shares (0..1) of the host.
+	CPUHeadroom    float64
+	MemoryHeadroom float64
+}
+
+// ScalingPolicy returns the number of workers it wants for the given load.
+// The result is clamped to the pool limits by the autoscaler.
+type ScalingPolicy interface {
+	Name() string
+	Desired(m ScaleMetrics) int
+}
+
+// QueueLengthPolicy adds one worker per JobsPerWorker waiting jobs on top
+// of the minimum pool size.
+type QueueLengthPolicy struct {
+	Min           int
+	JobsPerWorker int
+}
+
+func (p QueueLengthPolicy) Name() string { return "queue" }
+
+func (p QueueLengthPolicy) Desired(m ScaleMetrics) int {
+	per := p.JobsPerWorker
+	if per < 1 {
+		per = 1
+	}
+	return p.Min + int(m.QueueLength)/per
+}
+
+// QueueAgePolicy grows the pool while the oldest waiting job exceeds the
+// target wait time and shrinks it back to the busy workers once the queue
+// has been drained.
+type QueueAgePolicy struct {
+	Target time.Duration
+}
+
+func (p QueueAgePolicy) Name() string { return "age" }
+
+func (p QueueAgePolicy) Desired(m ScaleMetrics) int {
+	if m.QueueLength == 0 {
+		return m.Busy
+	}
+	// waiting jobs need at least one worker to grow from
+	workers := max(m.Workers, 1)
+	if p.Target <= 0 || m.QueueAge <= p.Target {
+		return workers
+	}
+	// scale proportionally to how far the target is missed
+	factor := float64(m.QueueAge) / float64(p.Target)
+	return int(math.Ceil(float64(workers) * factor))
+}
+
+// LatencyPolicy sizes the pool so that the waiting jobs can be worked off
+// within the target time, given the average job latency.
+type LatencyPolicy struct {
+	Target time.Duration
+}
+
+func (p LatencyPolicy) Name() string { return "latency" }
+
+func (p LatencyPolicy) Desired(m ScaleMetrics) int {
+	if p.Target <= 0 || m.JobLatency <= 0 {
+		return m.Busy + int(m.QueueLength)
+	}
+	work := float64(m.QueueLength) * float64(m.JobLatency)
+	return m.Busy + int(math.Ceil(work/float64(p.Target)))
+}
+
+// MaxPolicy combines several policies by following the most demanding one.
+type MaxPolicy []ScalingPolicy
+
+func (p MaxPolicy) Name() string {
+	names := make([]string, len(p))
+	for i, sp := range p {
+		names[i] = sp.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+func (p MaxPolicy) Desired(m ScaleMetrics) int {
+	desired := 0
+	for _, sp := range p {
+		if d := sp.Desired(m); d > desired {
+			desired = d
+		}
+	}
+	return desired
+}
+
+// ScalerConfig configures the autoscaler.
+type ScalerConfig struct {
+	Min, Max          int
+	MinCPUHeadroom    float64
+	MinMemoryHeadroom float64
+	UpCooldown        time.Duration
+	DownCooldown      time.Duration
+}
+
+// Scaler turns the decision of a policy into a bounded, rate limited target
+// pool size.
+type Scaler struct {
+	policy ScalingPolicy
+	cfg    ScalerConfig
+
+	lastUp   time.Time
+	lastDown time.Time
+}
+
+func NewScaler(policy ScalingPolicy, cfg ScalerConfig) *Scaler {
+	return &Scaler{policy: policy, cfg: cfg}
+}
+
+// Target returns the pool size to scale to for the given load.
+func (s *Scaler) Target(m ScaleMetrics, now time.Time) int {
+	desired := s.policy.Desired(m)
+	if desired > s.cfg.Max {
+		desired = s.cfg.Max
+	}
+	if desired < s.cfg.Min {
+		desired = s.cfg.Min
+	}
+
+	switch {
+	case desired > m.Workers:
+		// Never grow into an overloaded host, the added sandboxes would only
+		// slow down the running ones.
+		if m.CPUHeadroom < s.cfg.MinCPUHeadroom || m.MemoryHeadroom < s.cfg.MinMemoryHeadroom {
+			if m.Workers < s.cfg.Min {
+				return s.cfg.Min
+			}
+			return m.Workers
+		}
+		if now.Sub(s.lastUp) < s.cfg.UpCooldown {
+			return m.Workers
+		}
+		s.lastUp = now
+	case desired < m.Workers:
+		if now.Sub(s.lastDown) < s.cfg.DownCooldown || now.Sub(s.lastUp) < s.cfg.DownCooldown {
+			return m.Workers
+		}
+		s.lastDown = now
+	}
+	return desired
+}
+
+// NewPolicy builds a policy from a comma separated list of policy names
+// (queue, age, latency).
+func NewPolicy(names string, min, jobsPerWorker int, targetAge, targetLatency time.Duration) (ScalingPolicy, error) {
+	var policies MaxPolicy
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "queue":
+			policies = append(policies, QueueLengthPolicy{Min: min, JobsPerWorker: jobsPerWorker})
+		case "age":
+			policies = append(policies, QueueAgePolicy{Target: targetAge})
+		case "latency":
+			policies = append(policies, LatencyPolicy{Target: targetLatency})
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown scaling policy: %s", name)
+		}
+	}
+	if len(policies) == 0 {
+		return nil, fmt.Errorf("no scaling policy configured")
+	}
+	if len(policies) == 1 {
+		return policies[0], nil
+	}
+	return policies, nil
+}
+
+// latencyTracker keeps an exponentially weighted moving average of job
+// durations.
+type latencyTracker struct {
+	mu  sync.Mutex
+	avg time.Duration
+}
+
+func (t *latencyTracker) Observe(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.avg == 0 {
+		t.avg = d
+		return
+	}
+	t.avg = time.Duration(0.8*float64(t.avg) + 0.2*float64(d))
+}
+
+func (t *latencyTracker) Get() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.avg
+}
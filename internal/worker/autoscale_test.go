@@ -0,0 +1,101 @@
+package worker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPolicies(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy ScalingPolicy
+		m      ScaleMetrics
+		want   int
+	}{
+		{"queue adds a worker per jobs", QueueLengthPolicy{Min: 1, JobsPerWorker: 5}, ScaleMetrics{QueueLength: 12}, 3},
+		{"queue without jobs per worker", QueueLengthPolicy{Min: 0}, ScaleMetrics{QueueLength: 4}, 4},
+		{"queue empty", QueueLengthPolicy{Min: 2, JobsPerWorker: 5}, ScaleMetrics{Workers: 6}, 2},
+
+		{"age shrinks to busy workers once drained", QueueAgePolicy{Target: time.Second}, ScaleMetrics{Workers: 4, Busy: 1}, 1},
+		{"age keeps the pool within target", QueueAgePolicy{Target: time.Second}, ScaleMetrics{Workers: 3, QueueLength: 2, QueueAge: time.Second}, 3},
+		{"age grows with the missed target", QueueAgePolicy{Target: time.Second}, ScaleMetrics{Workers: 2, QueueLength: 5, QueueAge: 2500 * time.Millisecond}, 5},
+		{"age starts an empty pool", QueueAgePolicy{Target: time.Second}, ScaleMetrics{QueueLength: 1, QueueAge: 100 * time.Millisecond}, 1},
+		{"age grows an empty pool", QueueAgePolicy{Target: time.Second}, ScaleMetrics{QueueLength: 1, QueueAge: 3 * time.Second}, 3},
+		{"age without target", QueueAgePolicy{}, ScaleMetrics{Workers: 2, QueueLength: 1, QueueAge: time.Hour}, 2},
+
+		{"latency works off the queue in time", LatencyPolicy{Target: 10 * time.Second}, ScaleMetrics{Busy: 2, QueueLength: 6, JobLatency: 4 * time.Second}, 5},
+		{"latency without measurements", LatencyPolicy{Target: 10 * time.Second}, ScaleMetrics{Busy: 1, QueueLength: 3}, 4},
+
+		{"max follows the most demanding", MaxPolicy{QueueLengthPolicy{Min: 1, JobsPerWorker: 10}, LatencyPolicy{Target: time.Second}}, ScaleMetrics{QueueLength: 3, JobLatency: time.Second}, 3},
+		{"max of nothing", MaxPolicy{}, ScaleMetrics{Workers: 3}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Desired(tt.m); got != tt.want {
+				t.Errorf("Desired() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// fixed is a policy which always wants the same number of workers.
+type fixed int
+
+func (f fixed) Name() string               { return "fixed" }
+func (f fixed) Desired(m ScaleMetrics) int { return int(f) }
+
+func TestScaler(t *testing.T) {
+	cfg := ScalerConfig{Min: 1, Max: 8, MinCPUHeadroom: 0.2, MinMemoryHeadroom: 0.1, UpCooldown: 10 * time.Second, DownCooldown: time.Minute}
+	idle := ScaleMetrics{CPUHeadroom: 1, MemoryHeadroom: 1}
+	with := func(workers int, m ScaleMetrics) ScaleMetrics {
+		m.Workers = workers
+		return m
+	}
+	start := time.Unix(1000, 0)
+
+	type step struct {
+		desired int
+		m       ScaleMetrics
+		after   time.Duration
+		want    int
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"clamped to the maximum", []step{{desired: 20, m: with(2, idle), want: 8}}},
+		{"clamped to the minimum", []step{{desired: 0, m: with(0, idle), want: 1}}},
+		{"no growth without cpu headroom", []step{{desired: 5, m: with(2, ScaleMetrics{CPUHeadroom: 0.1, MemoryHeadroom: 1}), want: 2}}},
+		{"no growth without memory headroom", []step{{desired: 5, m: with(2, ScaleMetrics{CPUHeadroom: 1, MemoryHeadroom: 0.05}), want: 2}}},
+		{"overloaded host still reaches the minimum", []step{{desired: 5, m: with(0, ScaleMetrics{}), want: 1}}},
+		{"growth waits for the up cooldown", []step{
+			{desired: 3, m: with(1, idle), want: 3},
+			{desired: 5, m: with(3, idle), after: 5 * time.Second, want: 3},
+			{desired: 5, m: with(3, idle), after: 10 * time.Second, want: 5},
+		}},
+		{"shrinking waits for the down cooldown since the last growth", []step{
+			{desired: 4, m: with(1, idle), want: 4},
+			{desired: 1, m: with(4, idle), after: 30 * time.Second, want: 4},
+			{desired: 1, m: with(4, idle), after: time.Minute, want: 1},
+		}},
+		{"shrinking waits for the down cooldown since the last shrink", []step{
+			{desired: 4, m: with(6, idle), after: time.Minute, want: 4},
+			{desired: 2, m: with(4, idle), after: time.Minute + 30*time.Second, want: 4},
+			{desired: 2, m: with(4, idle), after: 2 * time.Minute, want: 2},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var policy fixed
+			s := NewScaler(&policy, cfg)
+			for i, st := range tt.steps {
+				policy = fixed(st.desired)
+				if got := s.Target(st.m, start.Add(st.after)); got != st.want {
+					t.Errorf("step %d: Target() = %d, want %d", i, got, st.want)
+				}
+			}
+		})
+	}
+}
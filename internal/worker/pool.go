@@ -1,10 +1,12 @@
 package worker
 
 import (
+	"code-runner/internal/cache"
 	"code-runner/internal/config"
 	"code-runner/internal/database"
 	"code-runner/internal/queue"
 	"code-runner/internal/sandbox"
+	"code-runner/internal/util"
 	"github.com/zekrotja/rogu/log"
 	"sync"
 	"time"
@@ -12,76 +14,155 @@ import (
 
 type Pool struct {
 	cfg     *config.EnvProvider
-	queue   *queue.RedisQueue
-	db      *database.PostgresDB
+	queue   queue.Queue
+	db      database.Database
 	mgr     *sandbox.Manager
+	cache   *cache.RedisVerdictCache
 	
 	workers map[int]*Worker
 	mu      sync.Mutex
 	nextID  int
+	stop    chan struct{}
+
+	// workers removed by the autoscaler which are still finishing a job
+	retiring map[int]*Worker
+
+	scaler  *Scaler
+	host    *util.HostStats
+	latency *latencyTracker
 }
 
-func NewPool(cfg *config.EnvProvider, q *queue.RedisQueue, db *database.PostgresDB, mgr *sandbox.Manager) *Pool {
+func NewPool(cfg *config.EnvProvider, q queue.Queue, db database.Database, mgr *sandbox.Manager, vc *cache.RedisVerdictCache) (*Pool, error) {
+	wc := cfg.Config().Worker
+	policy, err := NewPolicy(wc.Policy, wc.Min, wc.JobsPerWorker,
+		time.Duration(wc.TargetQueueAgeSeconds)*time.Second, time.Duration(wc.TargetLatencySeconds)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Pool{
 		cfg:     cfg,
 		queue:   q,
 		db:      db,
 		mgr:     mgr,
+		cache:   vc,
 		workers: make(map[int]*Worker),
 		nextID:  1,
-	}
+		stop:    make(chan struct{}),
+
+		retiring: make(map[int]*Worker),
+
+		scaler: NewScaler(policy, ScalerConfig{
+			Min:               wc.Min,
+			Max:               wc.Max,
+			MinCPUHeadroom:    wc.MinCPUHeadroom,
+			MinMemoryHeadroom: wc.MinMemoryHeadroom,
+			UpCooldown:        time.Duration(wc.UpCooldownSeconds) * time.Second,
+			DownCooldown:      time.Duration(wc.DownCooldownSeconds) * time.Second,
+		}),
+		host:    util.NewHostStats(),
+		latency: &latencyTracker{},
+	}, nil
 }
 
 func (p *Pool) Start() {
 	min := p.cfg.Config().Worker.Min
-	log.Info().Msgf("Starting Worker Pool (Min: %d, Max: %d)", min, p.cfg.Config().Worker.Max)
+	log.Info().Msgf("Starting Worker Pool (Min: %d, Max: %d, Policy: %s)", min, p.cfg.Config().Worker.Max, p.scaler.policy.Name())
 
 	for i := 0; i < min; i++ {
 		p.addWorker()
 	}
 
 	go p.autoscaler()
+	go p.watchCancellations()
+}
+
+// watchCancellations kills the sandbox of every cancelled job running in
+// this process. Jobs of other processes are ignored by Manager.Kill.
+func (p *Pool) watchCancellations() {
+	ids := p.queue.Cancellations(p.stop)
+	for {
+		select {
+		case <-p.stop:
+			return
+		case id, ok := <-ids:
+			if !ok {
+				return
+			}
+			if p.mgr.Kill(id) {
+				log.Info().Field("job_id", id).Msg("Killed sandbox of cancelled job")
+			}
+		}
+	}
 }
 
 func (p *Pool) autoscaler() {
-	ticker := time.NewTicker(3 * time.Second)
-	for range ticker.C {
-		qLen, err := p.queue.Length()
+	interval := time.Duration(p.cfg.Config().Worker.IntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = 3 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		m, err := p.metrics()
 		if err != nil {
-			log.Error().Err(err).Msg("Failed to check queue length")
+			log.Error().Err(err).Msg("Failed to collect scaling metrics")
 			continue
 		}
 
-		p.mu.Lock()
-		currentCount := len(p.workers)
-		p.mu.Unlock()
+		desired := p.scaler.Target(m, time.Now())
 
-		// Simple Algo: 1 worker per 2 pending jobs + buffer, clamped by Min/Max
-		desired := p.cfg.Config().Worker.Min + int(qLen/2)
-		if desired > p.cfg.Config().Worker.Max {
-			desired = p.cfg.Config().Worker.Max
-		}
-
-		// 3. Scale Up or Down
-		if desired > currentCount {
-			log.Info().Msgf("Scaling UP: Queue=%d, Current=%d, Desired=%d", qLen, currentCount, desired)
-			toAdd := desired - currentCount
-			for i := 0; i < toAdd; i++ {
+		if desired > m.Workers {
+			log.Info().Msgf("Scaling UP: Queue=%d, Age=%s, Latency=%s, Current=%d, Desired=%d",
+				m.QueueLength, m.QueueAge.Round(time.Second), m.JobLatency.Round(time.Millisecond), m.Workers, desired)
+			for i := 0; i < desired-m.Workers; i++ {
 				p.addWorker()
 			}
-		} else if desired < currentCount && currentCount > p.cfg.Config().Worker.Min {
-			log.Info().Msgf("Scaling DOWN: Queue=%d, Current=%d, Desired=%d", qLen, currentCount, desired)
-			toRemove := currentCount - desired
-			if currentCount-toRemove < p.cfg.Config().Worker.Min {
-				toRemove = currentCount - p.cfg.Config().Worker.Min
-			}
-			for i := 0; i < toRemove; i++ {
-				p.removeWorker()
+		} else if desired < m.Workers {
+			removed := p.removeIdleWorkers(m.Workers - desired)
+			if removed > 0 {
+				log.Info().Msgf("Scaling DOWN: Queue=%d, Current=%d, Desired=%d, Removed=%d", m.QueueLength, m.Workers, desired, removed)
 			}
 		}
 	}
 }
 
+func (p *Pool) metrics() (ScaleMetrics, error) {
+	qLen, err := p.queue.Length()
+	if err != nil {
+		return ScaleMetrics{}, err
+	}
+	qAge, err := p.queue.OldestAge()
+	if err != nil {
+		return ScaleMetrics{}, err
+	}
+
+	m := ScaleMetrics{
+		QueueLength:    qLen,
+		QueueAge:       qAge,
+		JobLatency:     p.latency.Get(),
+		CPUHeadroom:    p.host.CPUHeadroom(),
+		MemoryHeadroom: p.host.MemoryHeadroom(),
+	}
+
+	p.mu.Lock()
+	m.Workers = len(p.workers)
+	for _, w := range p.workers {
+		if w.Busy() {
+			m.Busy++
+		}
+	}
+	p.mu.Unlock()
+
+	return m, nil
+}
+
 func (p *Pool) addWorker() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -89,18 +170,80 @@ func (p *Pool) addWorker() {
 	id := p.nextID
 	p.nextID++
 	
-	w := NewWorker(id, p.queue, p.db, p.mgr)
+	w := NewWorker(id, p.cfg.Config().InstanceID, p.queue, p.db, p.mgr, p.cache)
+	w.latency = p.latency
 	p.workers[id] = w
 	go w.Start()
 }
 
-func (p *Pool) removeWorker() {
+// removeIdleWorkers stops up to n workers which are not processing a job
+// and returns how many were stopped. Busy workers are never picked, so a
+// scale down can not interrupt a running job.
+func (p *Pool) removeIdleWorkers(n int) int {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	removed := 0
 	for id, w := range p.workers {
+		if removed >= n {
+			break
+		}
+		if w.Busy() {
+			continue
+		}
 		w.Stop()
 		delete(p.workers, id)
-		return
+		p.retiring[id] = w
+		go func(id int, w *Worker) {
+			<-w.Done()
+			p.mu.Lock()
+			delete(p.retiring, id)
+			p.mu.Unlock()
+		}(id, w)
+		removed++
 	}
-}
\ No newline at end of file
+	return removed
+}
+
+// Shutdown stops the autoscaler and all workers. Workers finish their
+// in-flight jobs for up to grace, jobs still running afterwards are aborted
+// and put back into the queue.
+func (p *Pool) Shutdown(grace time.Duration) {
+	close(p.stop)
+
+	p.mu.Lock()
+	workers := make([]*Worker, 0, len(p.workers))
+	for id, w := range p.workers {
+		w.Stop()
+		workers = append(workers, w)
+		delete(p.workers, id)
+	}
+	for _, w := range p.retiring {
+		workers = append(workers, w)
+	}
+	p.mu.Unlock()
+
+	log.Info().Msgf("Draining %d workers (grace period %s)", len(workers), grace)
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+drain:
+	for _, w := range workers {
+		select {
+		case <-w.Done():
+		case <-timer.C:
+			break drain
+		}
+	}
+
+	for _, w := range workers {
+		select {
+		case <-w.Done():
+		default:
+			w.Abort()
+			<-w.Done()
+		}
+	}
+
+	log.Info().Msg("Worker Pool stopped")
+}
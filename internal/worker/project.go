@@ -0,0 +1,219 @@
+package worker
+
+import (
+	"code-runner/internal/cache"
+	"code-runner/internal/sandbox"
+	"code-runner/internal/testreport"
+	"code-runner/pkg/models"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/zekrotja/rogu/log"
+	"path"
+	"strings"
+	"time"
+)
+
+// processProject runs the test command of the question on the submitted
+// repository and judges it by the parsed test reports.
+func (w *Worker) processProject(payload *models.JobPayload, question *models.Question, cacheKey string) bool {
+	spec, ok := w.manager.Spec(payload.Language)
+	if !ok {
+		w.db.UpdateResult(payload.SubmissionID, "ERROR", "", "Unsupported language: "+payload.Language, 0, 0, 0)
+		return true
+	}
+	project := question.Project.WithDefaults()
+	reportDir, err := newReportName()
+	if err != nil {
+		w.db.UpdateResult(payload.SubmissionID, "ERROR", "", "Failed to generate runner: "+err.Error(), 0, 0, 0)
+		return true
+	}
+	reports := make([]string, len(project.Reports))
+	for i, pattern := range project.Reports {
+		reports[i] = strings.ReplaceAll(pattern, models.ReportDir, reportDir)
+	}
+
+	files := submissionFiles(payload, spec.FileName)
+	if len(files) == 0 {
+		w.db.UpdateResult(payload.SubmissionID, "ERROR", "", "The submission contains no files.", 0, 0, 0)
+		return true
+	}
+	// code loaded by the framework could rewrite the reports of all tests
+	if name, ok := project.SubmittedFrameworkFile(files); ok {
+		w.db.UpdateResult(payload.SubmissionID, "ERROR", "", fmt.Sprintf("The submission must not contain %s, it configures the test framework.", name), 0, 0, 0)
+		return true
+	}
+	dropReports(files, reports)
+	for name, content := range project.Files {
+		files[name] = content
+	}
+	if w.isAborted() {
+		return false
+	}
+
+	opts := inputOptions(payload)
+	opts.Command = []string{"/bin/sh", "-c", strings.ReplaceAll(project.TestCommand, models.ReportDir, reportDir)}
+	opts.Collect = reports
+	output, stderr, res, execTime, err := w.run(payload, files, opts, w.limits(payload, question))
+
+	if w.cancelled(payload.SubmissionID) {
+		w.finishCancelled(payload, output, stderr)
+		return true
+	}
+	if w.isAborted() {
+		return false
+	}
+
+	status, results := judgeReports(project.ReportFormat, output, &stderr, res.Files, res.ExitCode, err)
+	if results != nil {
+		status, results = checkExpected(project, status, &stderr, results)
+	}
+	w.finishReports(payload, cacheKey, status, output, stderr, res, execTime, results, nil)
+	return true
+}
+
+// finishReports stores the result of a run judged by its test reports and
+// the score of scored questions, if any.
+func (w *Worker) finishReports(payload *models.JobPayload, cacheKey, status, output, stderr string, res sandbox.Result, execTime time.Duration, results []models.TestResult, score *float64) {
+	passed, total := testreport.Count(results)
+
+	w.updateRunStats(payload, res)
+	if results != nil {
+		w.db.UpdateTestResults(payload.SubmissionID, results)
+	}
+	if score != nil {
+		w.db.UpdateScore(payload.SubmissionID, *score)
+	}
+	w.db.UpdateResult(payload.SubmissionID, status, output, stderr, int(execTime.Milliseconds()), passed, total)
+	log.Info().Field("job_id", payload.SubmissionID).Field("status", status).Field("passed", passed).Field("total", total).Msg("Job finished")
+
+	w.storeVerdict(payload, cacheKey, &cache.Verdict{
+		Status:      status,
+		StdOut:      output,
+		StdErr:      stderr,
+		ExecTimeMS:  int(execTime.Milliseconds()),
+		PassedCount: passed,
+		TotalCount:  total,
+		Results:     results,
+		Score:       score,
+	})
+}
+
+// newReportName returns a random name for the reports of a run, so reports
+// cannot be submitted along with the code. Code running inside the test
+// process still learns it from the framework's configuration.
+func newReportName() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return ".report-" + hex.EncodeToString(b), nil
+}
+
+// dropReports removes the files matching the report patterns, which the
+// run has to write itself.
+func dropReports(files map[string]string, patterns []string) {
+	for name := range files {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, name); ok {
+				delete(files, name)
+				break
+			}
+		}
+	}
+}
+
+// judgeReports derives the status of a run from the test results in its
+// reports. stderr is replaced by the description of the first failure.
+func judgeReports(format, output string, stderr *string, reports map[string]string, exitCode int, runErr error) (string, []models.TestResult) {
+	if runErr != nil {
+		if runErr.Error() == "execution timed out" {
+			return "TIMEOUT", nil
+		}
+		*stderr = appendLine(*stderr, runErr.Error())
+		return "ERROR", nil
+	}
+
+	// JUnit results are only read from reports the run wrote, never from
+	// its output
+	if format == models.ReportJUnit && len(reports) == 0 {
+		*stderr = appendLine(*stderr, withExitCode("Judge Error: the tests wrote no report.", exitCode))
+		return "ERROR", nil
+	}
+	results, err := testreport.Parse(format, reports, output)
+	if err != nil {
+		*stderr = appendLine(*stderr, "Judge Error: "+err.Error())
+		return "ERROR", nil
+	}
+	if len(results) == 0 {
+		*stderr = appendLine(*stderr, withExitCode("Judge Error: no test results found.", exitCode))
+		return "ERROR", nil
+	}
+
+	if failure, ok := testreport.FirstFailure(results); ok {
+		*stderr = describeFailure(failure)
+		return "FAILURE", results
+	}
+	if exitCode != 0 {
+		*stderr = appendLine(*stderr, fmt.Sprintf("All tests passed, but the test command exited with code %d.", exitCode))
+		return "FAILURE", results
+	}
+	return "SUCCESS", results
+}
+
+// checkExpected fails a run whose reports lack any of the expected tests or
+// hold fewer tests than required. Missing tests are added as errors.
+func checkExpected(project models.Project, status string, stderr *string, results []models.TestResult) (string, []models.TestResult) {
+	reported := make(map[string]bool, len(results))
+	for _, r := range results {
+		reported[r.TestCaseID] = true
+	}
+	var missing []string
+	for _, name := range project.ExpectedTests {
+		if !reported[name] {
+			missing = append(missing, name)
+			results = append(results, models.TestResult{TestCaseID: name, Status: testreport.StatusError, Message: "The test was not reported."})
+		}
+	}
+
+	failed := false
+	if len(missing) > 0 {
+		*stderr = appendLine(*stderr, "Missing tests: "+strings.Join(missing, ", ")+".")
+		failed = true
+	}
+	if len(reported) < project.MinTests {
+		*stderr = appendLine(*stderr, fmt.Sprintf("Only %d tests were reported, at least %d are expected.", len(reported), project.MinTests))
+		failed = true
+	}
+	if failed && status == "SUCCESS" {
+		status = "FAILURE"
+	}
+	return status, results
+}
+
+// describeFailure formats a failed test like the failures of the driver.
+func describeFailure(r models.TestResult) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Failed Case %s:", r.TestCaseID)
+	if r.Message != "" {
+		b.WriteString("\n\n" + r.Message)
+	}
+	if r.Expected != "" || r.Actual != "" {
+		fmt.Fprintf(&b, "\n\nExpected Output:\n%s\n\nActual Output:\n%s", r.Expected, r.Actual)
+	}
+	return b.String()
+}
+
+func withExitCode(msg string, exitCode int) string {
+	if exitCode != 0 {
+		msg += fmt.Sprintf(" The test command exited with code %d.", exitCode)
+	}
+	return msg
+}
+
+func appendLine(s, line string) string {
+	if s != "" {
+		s += "\n"
+	}
+	return s + line
+}
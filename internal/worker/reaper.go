@@ -0,0 +1,178 @@
+package worker
+
+import (
+	"code-runner/internal/config"
+	"code-runner/internal/queue"
+	"code-runner/internal/sandbox"
+	"github.com/zekrotja/rogu/log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	heartbeatInterval = 10 * time.Second
+	// heartbeatTTL is how long an instance counts as alive after its last
+	// heartbeat
+	heartbeatTTL = 30 * time.Second
+)
+
+// Reaper removes sandboxes and workspace directories which no live job owns
+// anymore, e.g. because the instance running them crashed before it could
+// clean up. It also keeps the heartbeat of this instance, which tells other
+// instances that its sandboxes are still in use.
+type Reaper struct {
+	cfg   *config.EnvProvider
+	queue queue.Queue
+	mgr   *sandbox.Manager
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func NewReaper(cfg *config.EnvProvider, q queue.Queue, mgr *sandbox.Manager) *Reaper {
+	return &Reaper{
+		cfg:   cfg,
+		queue: q,
+		mgr:   mgr,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// Start sends the first heartbeat, reaps once in the background and then
+// keeps reaping periodically.
+func (r *Reaper) Start() {
+	r.heartbeat()
+
+	interval := time.Duration(r.cfg.Config().Reaper.IntervalSeconds) * time.Second
+	if interval <= 0 {
+		log.Info().Msg("Orphan reaper disabled")
+	}
+
+	go func() {
+		defer close(r.done)
+		if interval > 0 {
+			r.reap()
+		}
+
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+		var reap <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			reap = ticker.C
+		}
+
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-heartbeat.C:
+				r.heartbeat()
+			case <-reap:
+				r.reap()
+			}
+		}
+	}()
+}
+
+func (r *Reaper) Stop() {
+	close(r.stop)
+	<-r.done
+}
+
+func (r *Reaper) heartbeat() {
+	if err := r.queue.Heartbeat(r.cfg.Config().InstanceID, heartbeatTTL); err != nil {
+		log.Error().Err(err).Msg("Failed to send heartbeat")
+	}
+}
+
+func (r *Reaper) reap() {
+	alive := make(map[string]bool)
+	if n := r.mgr.ReapSandboxes(func(instance, runID string) bool {
+		return r.orphaned(instance, runID, alive)
+	}); n > 0 {
+		log.Warn().Field("count", n).Msg("Reaper: removed orphaned sandboxes")
+	}
+	if n := r.reapWorkspaces(alive); n > 0 {
+		log.Warn().Field("count", n).Msg("Reaper: removed orphaned workspaces")
+	}
+}
+
+// orphaned decides whether the sandbox or workspace of a run may be removed.
+// Runs of this instance are orphaned once the manager no longer runs them,
+// runs of other instances once neither the instance nor the owner of the
+// job is alive. alive caches liveness for the duration of one reap.
+func (r *Reaper) orphaned(instance, runID string, alive map[string]bool) bool {
+	me := r.cfg.Config().InstanceID
+	if instance == me {
+		return runID == "" || !r.mgr.IsActive(runID)
+	}
+	if instance != "" && r.isAlive(instance, alive) {
+		return false
+	}
+	if runID == "" {
+		return true
+	}
+	owner, err := r.queue.Owner(runID)
+	if err != nil {
+		log.Error().Err(err).Field("job_id", runID).Msg("Reaper: failed to check job owner")
+		return false
+	}
+	if owner == me {
+		return !r.mgr.IsActive(runID)
+	}
+	return owner == "" || !r.isAlive(owner, alive)
+}
+
+func (r *Reaper) isAlive(instance string, alive map[string]bool) bool {
+	if v, ok := alive[instance]; ok {
+		return v
+	}
+	v, err := r.queue.IsAlive(instance)
+	if err != nil {
+		log.Error().Err(err).Field("instance", instance).Msg("Reaper: failed to check instance heartbeat")
+		// keep everything of instances whose state is unknown
+		v = true
+	}
+	alive[instance] = v
+	return v
+}
+
+// reapWorkspaces removes job directories in HostRootDir. Directories don't
+// record the instance which created them, so unless the job is known to be
+// orphaned they are kept for the grace period.
+func (r *Reaper) reapWorkspaces(alive map[string]bool) int {
+	c := r.cfg.Config()
+	entries, err := os.ReadDir(c.HostRootDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error().Err(err).Msg("Reaper: failed to list workspaces")
+		}
+		return 0
+	}
+
+	grace := time.Duration(c.Reaper.GraceSeconds) * time.Second
+	n := 0
+	for _, e := range entries {
+		// dot directories hold images, caches and warm container slots
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") || r.mgr.IsActive(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < grace {
+			continue
+		}
+		if !r.orphaned("", e.Name(), alive) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(c.HostRootDir, e.Name())); err != nil {
+			log.Error().Err(err).Field("job_id", e.Name()).Msg("Reaper: failed to remove workspace")
+			continue
+		}
+		n++
+	}
+	return n
+}
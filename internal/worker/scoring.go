@@ -0,0 +1,227 @@
+package worker
+
+import (
+	"code-runner/internal/sandbox"
+	"code-runner/pkg/models"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Files the scorer finds in its workspace.
+const (
+	scorerInput  = "input.txt"
+	scorerOutput = "output.txt"
+	scorerAnswer = "answer.txt"
+)
+
+// processScoring rates the output of every test case with the scorer of
+// the question and stores the aggregated score. The outputs are either
+// submitted directly or produced by running the solution.
+func (w *Worker) processScoring(payload *models.JobPayload, question *models.Question, cacheKey string) bool {
+	scoring := question.Scoring
+	scorerSpec, ok := w.manager.Spec(scoring.ScorerLang)
+	if !ok {
+		w.db.UpdateResult(payload.SubmissionID, "ERROR", "", "Unsupported scorer language: "+scoring.ScorerLang, 0, 0, 0)
+		return true
+	}
+
+	var (
+		outputs  []string
+		errs     []string
+		res      sandbox.Result
+		execTime time.Duration
+	)
+	if scoring.OutputOnly {
+		outputs = make([]string, len(question.TestCases))
+		errs = make([]string, len(question.TestCases))
+		for i, t := range question.TestCases {
+			out, ok := payload.Files[models.OutputFile(t.ID)]
+			if !ok {
+				errs[i] = "No output submitted as " + models.OutputFile(t.ID) + "."
+			}
+			outputs[i] = out
+		}
+	} else {
+		var (
+			output, stderr string
+			err            error
+			done, ok       bool
+		)
+		output, stderr, res, execTime, done, err = w.runSolution(payload, question)
+		if done {
+			return true
+		}
+		if w.isAborted() {
+			return false
+		}
+		if err != nil {
+			status := "ERROR"
+			if err.Error() == "execution timed out" {
+				status = "TIMEOUT"
+			} else {
+				stderr = appendLine(stderr, err.Error())
+			}
+			w.finishReports(payload, cacheKey, status, output, stderr, res, execTime, nil, nil)
+			return true
+		}
+		if outputs, errs, ok = parseGenerated(output, len(question.TestCases)); !ok {
+			stderr = appendLine(stderr, "Judge Error: Output format invalid.\nOriginal: "+output)
+			w.finishReports(payload, cacheKey, "ERROR", output, stderr, res, execTime, nil, nil)
+			return true
+		}
+	}
+
+	results := make([]models.TestResult, len(question.TestCases))
+	scores := make([]float64, len(question.TestCases))
+	for i, t := range question.TestCases {
+		r := models.TestResult{TestCaseID: t.ID, Status: "ERROR", Message: errs[i]}
+		if errs[i] == "" {
+			if w.cancelled(payload.SubmissionID) {
+				w.finishCancelled(payload, "", "")
+				return true
+			}
+			if w.isAborted() {
+				return false
+			}
+			var err error
+			r, err = w.score(payload, scorerSpec.FileName, scoring, t, outputs[i])
+			if err != nil {
+				w.finishReports(payload, cacheKey, "ERROR", "", "Judge Error: "+err.Error(), res, execTime, nil, nil)
+				return true
+			}
+		}
+		if r.Score != nil {
+			scores[i] = *r.Score
+			if scoring.Normalize {
+				scores[i] = scoring.Normalized(*r.Score, *t.BestScore)
+			}
+		}
+		results[i] = r
+	}
+
+	total := scoring.Total(scores)
+	status := "SUCCESS"
+	stderr := ""
+	for _, r := range results {
+		if r.Status != "PASSED" {
+			status = "FAILURE"
+			stderr = describeFailure(r)
+			break
+		}
+	}
+	w.finishReports(payload, cacheKey, status, formatScores(results, scores, total, scoring.Normalize), stderr, res, execTime, results, &total)
+	return true
+}
+
+// runSolution runs the solution on the inputs of all test cases in
+// generation mode, which prints every output instead of comparing it. done
+// is set if the job has been cancelled meanwhile.
+func (w *Worker) runSolution(payload *models.JobPayload, question *models.Question) (string, string, sandbox.Result, time.Duration, bool, error) {
+	gen := *question
+	gen.TestCases = make([]models.TestCase, len(question.TestCases))
+	for i, t := range question.TestCases {
+		gen.TestCases[i] = models.TestCase{ID: t.ID, Input: t.Input, Args: t.Args, ExpectedOutput: "__GENERATE__"}
+	}
+	files, _, err := w.generateFiles(payload, &gen)
+	if err == nil {
+		err = addFiles(files, payload.Files)
+	}
+	if err != nil {
+		w.db.UpdateResult(payload.SubmissionID, "ERROR", "", "Failed to generate runner: "+err.Error(), 0, 0, 0)
+		return "", "", sandbox.Result{}, 0, true, nil
+	}
+	if w.cancelled(payload.SubmissionID) {
+		w.finishCancelled(payload, "", "")
+		return "", "", sandbox.Result{}, 0, true, nil
+	}
+
+	output, stderr, res, execTime, err := w.run(payload, files, inputOptions(payload), w.limits(payload, question))
+	if w.cancelled(payload.SubmissionID) {
+		w.finishCancelled(payload, output, stderr)
+		return "", "", sandbox.Result{}, 0, true, nil
+	}
+	return output, stderr, res, execTime, false, err
+}
+
+// parseGenerated reads the outputs of a generation run. Failed test cases
+// have their error set instead.
+func parseGenerated(output string, n int) ([]string, []string, bool) {
+	var gen struct {
+		Generated []models.TestCase `json:"generated"`
+	}
+	if err := json.Unmarshal([]byte(extractJSON(output)), &gen); err != nil || len(gen.Generated) != n {
+		return nil, nil, false
+	}
+	outputs := make([]string, n)
+	errs := make([]string, n)
+	for i, t := range gen.Generated {
+		if msg, ok := strings.CutPrefix(t.ExpectedOutput, "ERROR: "); ok {
+			errs[i] = msg
+			continue
+		}
+		outputs[i] = t.ExpectedOutput
+	}
+	return outputs, errs, true
+}
+
+// score runs the scorer on the output of a test case in a sandbox of its
+// own. Errors are failures of the scorer, not of the submission.
+func (w *Worker) score(payload *models.JobPayload, entry string, scoring *models.Scoring, t models.TestCase, output string) (models.TestResult, error) {
+	files := map[string]string{
+		entry:        scoring.Scorer,
+		scorerInput:  t.Input,
+		scorerOutput: output,
+		scorerAnswer: t.ExpectedOutput,
+	}
+	job := *payload
+	job.Language = scoring.ScorerLang
+	stdout, stderr, res, _, err := w.run(&job, files, sandbox.JobOptions{}, defaultLimits)
+	if err != nil {
+		return models.TestResult{}, fmt.Errorf("the scorer failed on case %s: %v", t.ID, err)
+	}
+
+	r := models.TestResult{TestCaseID: t.ID, Actual: output, Expected: t.ExpectedOutput}
+	first, rest, _ := strings.Cut(strings.TrimSpace(stdout), "\n")
+	switch res.ExitCode {
+	case 0:
+		score, err := strconv.ParseFloat(strings.TrimSpace(first), 64)
+		if err != nil {
+			return r, fmt.Errorf("the scorer printed no score for case %s: %q", t.ID, first)
+		}
+		r.Status = "PASSED"
+		r.Score = &score
+		r.Message = strings.TrimSpace(rest)
+	case 1:
+		r.Status = "FAILED"
+		r.Message = strings.TrimSpace(appendLine(strings.TrimSpace(stdout), strings.TrimSpace(stderr)))
+	default:
+		msg := fmt.Sprintf("the scorer exited with code %d on case %s", res.ExitCode, t.ID)
+		if stderr = strings.TrimSpace(stderr); stderr != "" {
+			msg += ": " + stderr
+		}
+		return r, errors.New(msg)
+	}
+	return r, nil
+}
+
+// formatScores lists the score of every test case, normalized if set, and
+// the total.
+func formatScores(results []models.TestResult, scores []float64, total float64, normalized bool) string {
+	var b strings.Builder
+	for i, r := range results {
+		fmt.Fprintf(&b, "Case %s: %s", r.TestCaseID, r.Status)
+		if r.Score != nil {
+			fmt.Fprintf(&b, ", score %s", strconv.FormatFloat(*r.Score, 'g', -1, 64))
+			if normalized {
+				fmt.Fprintf(&b, " (%s)", strconv.FormatFloat(scores[i], 'g', 4, 64))
+			}
+		}
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "Score: %s", strconv.FormatFloat(total, 'g', -1, 64))
+	return b.String()
+}
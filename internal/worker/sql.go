@@ -0,0 +1,277 @@
+package worker
+
+import (
+	"code-runner/pkg/models"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	// sqlLanguage is the language of specs answering SQL questions
+	sqlLanguage = "sql"
+	// sqlResult is written by the SQL driver instead of stdout, which is
+	// capped too low for larger result sets
+	sqlResult = "result.json"
+	// sqlTableRows bounds the rows shown of a result set
+	sqlTableRows = 20
+)
+
+type sqlResultSet struct {
+	Columns []string `json:"columns"`
+	// Rows hold the values as text, NULL is nil
+	Rows      [][]*string `json:"rows"`
+	Truncated bool        `json:"truncated"`
+	// Count, Digest and Bag cover all rows, including those left out of
+	// truncated Rows. Digest hashes them in order, Bag regardless of it.
+	Count  int    `json:"count"`
+	Digest string `json:"digest"`
+	Bag    string `json:"bag"`
+	Error  string `json:"error"`
+}
+
+type sqlRun struct {
+	SetupError string       `json:"setup_error"`
+	Reference  sqlResultSet `json:"reference"`
+	Submission sqlResultSet `json:"submission"`
+}
+
+// processSQL runs the reference query and the submitted one on databases
+// set up by the question and compares their result sets.
+func (w *Worker) processSQL(payload *models.JobPayload, question *models.Question, cacheKey string) bool {
+	if spec, ok := w.manager.Spec(payload.Language); !ok || spec.Language != sqlLanguage {
+		w.db.UpdateResult(payload.SubmissionID, "ERROR", "", fmt.Sprintf("Question %s has to be answered in %s, not %s.", question.ID, sqlLanguage, payload.Language), 0, 0, 0)
+		return true
+	}
+	if w.isAborted() {
+		return false
+	}
+
+	files := map[string]string{
+		"schema.sql":     question.SQL.Schema,
+		"seed.sql":       question.SQL.Seed,
+		"reference.sql":  question.SQL.Reference,
+		"submission.sql": payload.Code,
+		"driver.py":      sqlDriverTemplate,
+	}
+	opts := inputOptions(payload)
+	opts.Command = []string{"python3", "driver.py"}
+	opts.Collect = []string{sqlResult}
+	output, stderr, res, execTime, err := w.run(payload, files, opts, w.limits(payload, question))
+
+	if w.cancelled(payload.SubmissionID) {
+		w.finishCancelled(payload, output, stderr)
+		return true
+	}
+	if w.isAborted() {
+		return false
+	}
+
+	status, results := judgeSQL(question.SQL, &output, &stderr, res.Files, err)
+	w.finishReports(payload, cacheKey, status, output, stderr, res, execTime, results, nil)
+	return true
+}
+
+// judgeSQL derives the status from the result sets written by the driver.
+// output is replaced by the result set of the submission.
+func judgeSQL(q *models.SQLQuestion, output, stderr *string, files map[string]string, runErr error) (string, []models.TestResult) {
+	if runErr != nil {
+		if runErr.Error() == "execution timed out" {
+			return "TIMEOUT", nil
+		}
+		*stderr = appendLine(*stderr, runErr.Error())
+		return "ERROR", nil
+	}
+
+	var run sqlRun
+	if err := json.Unmarshal([]byte(files[sqlResult]), &run); err != nil {
+		*stderr = appendLine(*stderr, "Judge Error: the SQL driver wrote no result.")
+		return "ERROR", nil
+	}
+	switch {
+	case run.SetupError != "":
+		*stderr = appendLine(*stderr, "Judge Error: setting up the database failed: "+run.SetupError)
+		return "ERROR", nil
+	case run.Reference.Error != "":
+		*stderr = appendLine(*stderr, "Judge Error: the reference query failed: "+run.Reference.Error)
+		return "ERROR", nil
+	case run.Submission.Error != "":
+		*stderr = appendLine(*stderr, "SQL Error: "+run.Submission.Error)
+		return "ERROR", []models.TestResult{{TestCaseID: "1", Status: "ERROR", Message: run.Submission.Error}}
+	}
+
+	*output = formatResultSet(run.Submission)
+	reason := compareResultSets(run.Reference, run.Submission, q.Ordered)
+	if reason == "" {
+		return "SUCCESS", []models.TestResult{{TestCaseID: "1", Status: "PASSED"}}
+	}
+	r := models.TestResult{
+		TestCaseID: "1",
+		Status:     "FAILED",
+		Message:    reason,
+		Expected:   formatResultSet(run.Reference),
+		Actual:     *output,
+	}
+	*stderr = describeFailure(r)
+	return "FAILURE", []models.TestResult{r}
+}
+
+// compareResultSets returns why got differs from want, or an empty string
+// if they are equal. Column names are not compared, as aliases may differ.
+func compareResultSets(want, got sqlResultSet, ordered bool) string {
+	if len(want.Columns) != len(got.Columns) {
+		return fmt.Sprintf("Expected %d columns, got %d.", len(want.Columns), len(got.Columns))
+	}
+	if want.Truncated || got.Truncated {
+		return compareDigests(want, got, ordered)
+	}
+	if len(want.Rows) != len(got.Rows) {
+		return fmt.Sprintf("Expected %d rows, got %d.", len(want.Rows), len(got.Rows))
+	}
+
+	if ordered {
+		for i := range want.Rows {
+			if rowKey(want.Rows[i]) != rowKey(got.Rows[i]) {
+				return fmt.Sprintf("Row %d differs, expected %s.", i+1, formatRow(want.Rows[i]))
+			}
+		}
+		return ""
+	}
+
+	counts := make(map[string]int)
+	for _, r := range got.Rows {
+		counts[rowKey(r)]++
+	}
+	for _, r := range want.Rows {
+		k := rowKey(r)
+		if counts[k] == 0 {
+			return fmt.Sprintf("Row %s is missing.", formatRow(r))
+		}
+		counts[k]--
+	}
+	return ""
+}
+
+// compareDigests compares result sets of which only the first rows were
+// kept by the hashes of all their rows.
+func compareDigests(want, got sqlResultSet, ordered bool) string {
+	if want.Count != got.Count {
+		return fmt.Sprintf("Expected %d rows, got %d.", want.Count, got.Count)
+	}
+	if ordered {
+		for i := 0; i < len(want.Rows) && i < len(got.Rows); i++ {
+			if rowKey(want.Rows[i]) != rowKey(got.Rows[i]) {
+				return fmt.Sprintf("Row %d differs, expected %s.", i+1, formatRow(want.Rows[i]))
+			}
+		}
+		if want.Digest == "" || want.Digest != got.Digest {
+			return fmt.Sprintf("The rows differ after the first %d.", len(want.Rows))
+		}
+		return ""
+	}
+	if want.Bag == "" || want.Bag != got.Bag {
+		return "The rows differ."
+	}
+	return ""
+}
+
+func rowKey(row []*string) string {
+	data, _ := json.Marshal(row)
+	return string(data)
+}
+
+func formatValues(row []*string) []string {
+	values := make([]string, len(row))
+	for i, v := range row {
+		if v == nil {
+			values[i] = "NULL"
+		} else {
+			values[i] = *v
+		}
+	}
+	return values
+}
+
+func formatRow(row []*string) string {
+	return "(" + strings.Join(formatValues(row), ", ") + ")"
+}
+
+// formatResultSet renders the columns and the first rows as a table.
+func formatResultSet(rs sqlResultSet) string {
+	var b strings.Builder
+	b.WriteString(strings.Join(rs.Columns, " | "))
+	rows := rs.Rows
+	if len(rows) > sqlTableRows {
+		rows = rows[:sqlTableRows]
+	}
+	for _, r := range rows {
+		b.WriteString("\n" + strings.Join(formatValues(r), " | "))
+	}
+	count := len(rs.Rows)
+	if rs.Truncated {
+		count = rs.Count
+	}
+	if count > len(rows) {
+		fmt.Fprintf(&b, "\n... (%d more rows)", count-len(rows))
+	}
+	return b.String()
+}
+
+const sqlDriverTemplate = `
+import hashlib
+import json
+import sqlite3
+
+MAX_ROWS = 10000
+
+def canon(v):
+    if v is None: return None
+    if isinstance(v, bytes): return v.hex()
+    if isinstance(v, float):
+        if v.is_integer(): return str(int(v))
+        return repr(round(v, 6))
+    return str(v)
+
+def setup():
+    db = sqlite3.connect(":memory:")
+    for name in ("schema.sql", "seed.sql"):
+        with open(name) as f: db.executescript(f.read())
+    return db
+
+def query(name):
+    try:
+        db = setup()
+    except Exception as e:
+        raise RuntimeError(str(e))
+    try:
+        with open(name) as f: cur = db.execute(f.read().strip())
+        # all rows are hashed, only the first are kept
+        rows, count, digest, bag = [], 0, hashlib.sha256(), 0
+        while True:
+            batch = cur.fetchmany(1000)
+            if not batch: break
+            for r in batch:
+                row = [canon(v) for v in r]
+                h = hashlib.sha256(json.dumps(row, separators=(",", ":")).encode()).digest()
+                digest.update(h)
+                bag = (bag + int.from_bytes(h, "big")) % (1 << 256)
+                count += 1
+                if count <= MAX_ROWS: rows.append(row)
+        return {
+            "columns": [d[0] for d in cur.description or []],
+            "rows": rows,
+            "truncated": count > MAX_ROWS,
+            "count": count,
+            "digest": digest.hexdigest(),
+            "bag": "%064x" % bag,
+        }
+    except Exception as e:
+        return {"error": str(e)}
+
+if __name__ == "__main__":
+    try:
+        result = {"reference": query("reference.sql"), "submission": query("submission.sql")}
+    except RuntimeError as e:
+        result = {"setup_error": str(e)}
+    with open("result.json", "w") as f: json.dump(result, f)
+`
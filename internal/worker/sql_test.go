@@ -0,0 +1,151 @@
+package worker
+
+import (
+	"code-runner/pkg/models"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func row(values ...any) []*string {
+	r := make([]*string, len(values))
+	for i, v := range values {
+		if s, ok := v.(string); ok {
+			r[i] = &s
+		}
+	}
+	return r
+}
+
+func TestCompareResultSets(t *testing.T) {
+	ab := sqlResultSet{Columns: []string{"a", "b"}, Rows: [][]*string{row("1", "x"), row("2", nil)}}
+	ba := sqlResultSet{Columns: []string{"a", "b"}, Rows: [][]*string{row("2", nil), row("1", "x")}}
+	truncated := func(digest, bag string, rows ...[]*string) sqlResultSet {
+		return sqlResultSet{Columns: []string{"a"}, Rows: rows, Truncated: true, Count: 10001, Digest: digest, Bag: bag}
+	}
+
+	tests := []struct {
+		name      string
+		want, got sqlResultSet
+		ordered   bool
+		reason    string
+	}{
+		{"equal", ab, ab, true, ""},
+		{"other order", ab, ba, false, ""},
+		{"other order when ordered", ab, ba, true, "Row 1 differs, expected (1, x)."},
+		{"column names are ignored", ab, sqlResultSet{Columns: []string{"x", "y"}, Rows: ab.Rows}, false, ""},
+		{"columns", ab, sqlResultSet{Columns: []string{"a"}, Rows: [][]*string{row("1"), row("2")}}, false, "Expected 2 columns, got 1."},
+		{"rows", ab, sqlResultSet{Columns: []string{"a", "b"}, Rows: ab.Rows[:1]}, false, "Expected 2 rows, got 1."},
+		{"null is not the text NULL", ab, sqlResultSet{Columns: []string{"a", "b"}, Rows: [][]*string{row("1", "x"), row("2", "NULL")}}, false, "Row (2, NULL) is missing."},
+		{"duplicates count", sqlResultSet{Columns: []string{"a"}, Rows: [][]*string{row("1"), row("1")}}, sqlResultSet{Columns: []string{"a"}, Rows: [][]*string{row("1"), row("2")}}, false, "Row (1) is missing."},
+		{"truncated equal", truncated("d", "b", row("1")), truncated("d", "b", row("1")), true, ""},
+		{"truncated differing beyond the kept rows", truncated("d1", "b1", row("1")), truncated("d2", "b2", row("1")), false, "The rows differ."},
+		{"truncated differing beyond the kept rows when ordered", truncated("d1", "b", row("1")), truncated("d2", "b", row("1")), true, "The rows differ after the first 1."},
+		{"truncated in other order", truncated("d1", "b", row("1")), truncated("d2", "b", row("2")), false, ""},
+		{"truncated without hashes", truncated("", "", row("1")), truncated("", "", row("1")), false, "The rows differ."},
+		{"only one truncated", truncated("d", "b", row("1")), sqlResultSet{Columns: []string{"a"}, Rows: [][]*string{row("1")}, Count: 1}, false, "Expected 10001 rows, got 1."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if reason := compareResultSets(tt.want, tt.got, tt.ordered); reason != tt.reason {
+				t.Errorf("compareResultSets() = %q, want %q", reason, tt.reason)
+			}
+		})
+	}
+}
+
+// runSQLDriver runs the SQL driver with the local python3, as the sandbox
+// would.
+func runSQLDriver(t *testing.T, schema, seed, reference, submission string) map[string]string {
+	t.Helper()
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("python3 is not installed")
+	}
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"schema.sql":     schema,
+		"seed.sql":       seed,
+		"reference.sql":  reference,
+		"submission.sql": submission,
+		"driver.py":      sqlDriverTemplate,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command(python, "driver.py")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("driver failed: %v\n%s", err, out)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, sqlResult))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]string{sqlResult: string(data)}
+}
+
+func TestJudgeSQL(t *testing.T) {
+	const schema = "CREATE TABLE t (id INTEGER, name TEXT, score REAL);"
+	const seed = "INSERT INTO t VALUES (1, 'ada', 1.0), (2, 'bob', NULL), (3, NULL, 0.1);"
+	// more rows than the driver keeps
+	const many = "WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 10050) "
+
+	tests := []struct {
+		name       string
+		ordered    bool
+		reference  string
+		submission string
+		status     string
+		stderr     string
+	}{
+		{name: "same rows", reference: "SELECT id, name FROM t", submission: "SELECT id AS x, name FROM t", status: "SUCCESS"},
+		{name: "other order", reference: "SELECT id FROM t ORDER BY id", submission: "SELECT id FROM t ORDER BY id DESC", status: "SUCCESS"},
+		{name: "other order when ordered", ordered: true, reference: "SELECT id FROM t ORDER BY id", submission: "SELECT id FROM t ORDER BY id DESC", status: "FAILURE", stderr: "Row 1 differs, expected (1)."},
+		{name: "null", reference: "SELECT name FROM t", submission: "SELECT COALESCE(name, 'NULL') FROM t", status: "FAILURE", stderr: "Row (NULL) is missing."},
+		{name: "integral floats", reference: "SELECT 1.0, 2.5", submission: "SELECT 1, 2.5", status: "SUCCESS"},
+		{name: "float rounding", reference: "SELECT 0.3", submission: "SELECT 0.1 + 0.2", status: "SUCCESS"},
+		{name: "real column", reference: "SELECT score FROM t WHERE id = 1", submission: "SELECT 1", status: "SUCCESS"},
+		{name: "columns", reference: "SELECT id, name FROM t", submission: "SELECT id FROM t", status: "FAILURE", stderr: "Expected 2 columns, got 1."},
+		{name: "truncated equal", reference: many + "SELECT i FROM n", submission: many + "SELECT i FROM n ORDER BY i DESC", status: "SUCCESS"},
+		{name: "truncated differing in the last row", reference: many + "SELECT i FROM n", submission: many + "SELECT CASE WHEN i = 10050 THEN 0 ELSE i END FROM n", status: "FAILURE", stderr: "The rows differ."},
+		{name: "truncated ordered differing in the last row", ordered: true, reference: many + "SELECT i FROM n", submission: many + "SELECT CASE WHEN i = 10050 THEN 0 ELSE i END FROM n", status: "FAILURE", stderr: "The rows differ after the first 10000."},
+		{name: "truncated with more rows", reference: many + "SELECT i FROM n", submission: many + "SELECT i FROM n UNION ALL SELECT 1", status: "FAILURE", stderr: "Expected 10050 rows, got 10051."},
+		{name: "query error", reference: "SELECT id FROM t", submission: "SELECT nope FROM t", status: "ERROR", stderr: "SQL Error: no such column: nope"},
+		{name: "reference error", reference: "SELECT nope FROM t", submission: "SELECT id FROM t", status: "ERROR", stderr: "Judge Error: the reference query failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := runSQLDriver(t, schema, seed, tt.reference, tt.submission)
+			var output, stderr string
+			status, results := judgeSQL(&models.SQLQuestion{Ordered: tt.ordered}, &output, &stderr, files, nil)
+			if status != tt.status {
+				t.Errorf("status %s, want %s (stderr %q)", status, tt.status, stderr)
+			}
+			if !strings.Contains(stderr, tt.stderr) {
+				t.Errorf("stderr %q does not contain %q", stderr, tt.stderr)
+			}
+			if status != "ERROR" || tt.name == "query error" {
+				if len(results) != 1 {
+					t.Errorf("%d results, want 1", len(results))
+				}
+			}
+		})
+	}
+
+	var output, stderr string
+	if status, _ := judgeSQL(&models.SQLQuestion{}, &output, &stderr, nil, nil); status != "ERROR" || !strings.Contains(stderr, "wrote no result") {
+		t.Errorf("missing result judged %s, stderr %q", status, stderr)
+	}
+	data, _ := json.Marshal(sqlRun{SetupError: "near \"CREAT\": syntax error"})
+	stderr = ""
+	if status, _ := judgeSQL(&models.SQLQuestion{}, &output, &stderr, map[string]string{sqlResult: string(data)}, nil); status != "ERROR" || !strings.Contains(stderr, "setting up the database failed") {
+		t.Errorf("setup error judged %s, stderr %q", status, stderr)
+	}
+}
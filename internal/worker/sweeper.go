@@ -0,0 +1,147 @@
+package worker
+
+import (
+	"code-runner/internal/config"
+	"code-runner/internal/database"
+	"code-runner/internal/metrics"
+	"code-runner/internal/queue"
+	"code-runner/pkg/models"
+	"fmt"
+	"github.com/zekrotja/rogu/log"
+	"time"
+)
+
+// Sweeper periodically looks for submissions which stay PENDING or RUNNING
+// although no queue entry and no worker owns them anymore, e.g. because a
+// worker crashed. Those are requeued until they exceed the attempt limit.
+type Sweeper struct {
+	cfg   *config.EnvProvider
+	queue queue.Queue
+	db    database.Database
+	stop  chan struct{}
+}
+
+func NewSweeper(cfg *config.EnvProvider, q queue.Queue, db database.Database) *Sweeper {
+	return &Sweeper{
+		cfg:   cfg,
+		queue: q,
+		db:    db,
+		stop:  make(chan struct{}),
+	}
+}
+
+func (s *Sweeper) Start() {
+	interval := time.Duration(s.cfg.Config().Sweeper.IntervalSeconds) * time.Second
+	if interval <= 0 {
+		log.Info().Msg("Stuck submission sweeper disabled")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				s.sweep(interval)
+			}
+		}
+	}()
+}
+
+func (s *Sweeper) Stop() { close(s.stop) }
+
+func (s *Sweeper) sweep(interval time.Duration) {
+	c := s.cfg.Config()
+
+	// Only one instance sweeps per interval
+	ok, err := s.queue.TryLock("sweeper", c.InstanceID, interval)
+	if err != nil {
+		log.Error().Err(err).Msg("Sweeper: failed to acquire lock")
+		return
+	}
+	if !ok {
+		return
+	}
+	metrics.SweeperRuns.Add(1)
+
+	threshold := time.Duration(c.Sweeper.ThresholdSeconds) * time.Second
+	subs, err := s.db.GetStaleSubmissions(time.Now().Add(-threshold))
+	if err != nil {
+		log.Error().Err(err).Msg("Sweeper: failed to query stale submissions")
+		return
+	}
+
+	for _, sub := range subs {
+		owned, err := s.hasOwner(sub.ID)
+		if err != nil {
+			log.Error().Err(err).Field("job_id", sub.ID).Msg("Sweeper: failed to check job owner")
+			continue
+		}
+		if owned {
+			continue
+		}
+
+		if sub.Attempts >= c.Sweeper.MaxAttempts {
+			msg := fmt.Sprintf("Submission was lost %d times while being processed and has been given up.", sub.Attempts)
+			// a worker may have finished the job meanwhile
+			failed, err := s.db.MarkFailed(sub.ID, "INTERNAL_ERROR", msg)
+			if err != nil {
+				log.Error().Err(err).Field("job_id", sub.ID).Msg("Sweeper: failed to fail submission")
+				continue
+			}
+			s.queue.Complete(sub.ID)
+			if !failed {
+				continue
+			}
+			metrics.SweeperFailed.Add(1)
+			log.Warn().Field("job_id", sub.ID).Field("attempts", sub.Attempts).Msg("Sweeper: marked stuck submission as INTERNAL_ERROR")
+			continue
+		}
+
+		payload, err := s.queue.Payload(sub.ID)
+		if err == queue.ErrNotFound {
+			// enqueued before payloads were kept, rebuild it from the submission
+			payload = &models.JobPayload{
+				SubmissionID: sub.ID,
+				Language:     sub.Language,
+				Code:         sub.Code,
+				QuestionID:   sub.QuestionID,
+				Playground:   sub.Playground,
+				Files:        sub.Files,
+				Arguments:    sub.Arguments,
+				Environment:  sub.Environment,
+				Stdin:        sub.Stdin,
+			}
+		} else if err != nil {
+			log.Error().Err(err).Field("job_id", sub.ID).Msg("Sweeper: failed to load job payload")
+			continue
+		}
+
+		// a worker may have finished the job since the stale list was read
+		reset, err := s.db.MarkPending(sub.ID)
+		if err != nil {
+			log.Error().Err(err).Field("job_id", sub.ID).Msg("Sweeper: failed to reset submission")
+			continue
+		}
+		if !reset {
+			continue
+		}
+		if err := s.queue.Enqueue(*payload); err != nil {
+			log.Error().Err(err).Field("job_id", sub.ID).Msg("Sweeper: failed to requeue submission")
+			continue
+		}
+		metrics.SweeperRequeued.Add(1)
+		log.Warn().Field("job_id", sub.ID).Field("status", sub.Status).Field("attempts", sub.Attempts).Msg("Sweeper: requeued stuck submission")
+	}
+}
+
+func (s *Sweeper) hasOwner(id string) (bool, error) {
+	queued, err := s.queue.IsQueued(id)
+	if err != nil || queued {
+		return queued, err
+	}
+	owner, err := s.queue.Owner(id)
+	return owner != "", err
+}
@@ -0,0 +1,244 @@
+package worker
+
+// signatureFile holds the signature of typed questions for their drivers.
+const signatureFile = "signature.json"
+
+// The typed drivers call the function of the signature with the arguments
+// of the test cases decoded to native values. Return values are encoded
+// back to JSON and compared with the expected output as values, floats
+// with a tolerance of 1e-6. Their output matches the untyped drivers.
+
+const typedPythonDriverTemplate = `
+import builtins
+import json
+import math
+from collections import deque
+
+class TreeNode:
+    def __init__(self, val=0, left=None, right=None):
+        self.val = val
+        self.left = left
+        self.right = right
+
+class ListNode:
+    def __init__(self, val=0, next=None):
+        self.val = val
+        self.next = next
+
+# solutions may refer to the node classes without defining them
+builtins.TreeNode = TreeNode
+builtins.ListNode = ListNode
+
+def decode(t, v):
+    if v is None: return None
+    if t.endswith("[]"): return [decode(t[:-2], x) for x in v]
+    if t == "float": return float(v)
+    if t == "ListNode":
+        head = None
+        for x in reversed(v): head = ListNode(x, head)
+        return head
+    if t == "TreeNode":
+        if not v: return None
+        root = TreeNode(v[0])
+        queue, i = deque([root]), 1
+        while queue and i < len(v):
+            node = queue.popleft()
+            for side in ("left", "right"):
+                if i < len(v) and v[i] is not None:
+                    child = TreeNode(v[i])
+                    setattr(node, side, child)
+                    queue.append(child)
+                i += 1
+        return root
+    return v
+
+def encode(t, v):
+    if v is None: return None
+    if t.endswith("[]"): return [encode(t[:-2], x) for x in v]
+    if t == "float": return float(v)
+    if t == "ListNode":
+        out = []
+        while v is not None and len(out) <= 100000:
+            out.append(v.val)
+            v = v.next
+        return out
+    if t == "TreeNode":
+        out, queue = [], deque([v])
+        while queue:
+            node = queue.popleft()
+            if node is None:
+                out.append(None)
+                continue
+            out.append(node.val)
+            queue.append(node.left)
+            queue.append(node.right)
+        while out and out[-1] is None: out.pop()
+        return out
+    return v
+
+def equal(a, b):
+    if isinstance(a, list) and isinstance(b, list):
+        return len(a) == len(b) and all(equal(x, y) for x, y in zip(a, b))
+    if isinstance(a, bool) or isinstance(b, bool):
+        return a is b
+    if isinstance(a, (int, float)) and isinstance(b, (int, float)):
+        return math.isclose(a, b, rel_tol=1e-6, abs_tol=1e-6)
+    return a == b
+
+def dumps(v): return json.dumps(v, separators=(",", ":"))
+
+def load_function(name):
+    import solution
+    if hasattr(solution, name): return getattr(solution, name)
+    if hasattr(solution, "Solution"): return getattr(solution.Solution(), name)
+    raise AttributeError("solution does not define " + name)
+
+def run():
+    try:
+        with open("signature.json") as f: sig = json.load(f)
+        with open("tests.json") as f: tests = json.load(f)
+        fn = load_function(sig["function"])
+        types = [p["type"] for p in sig["params"]]
+        results = []
+        is_gen = len(tests) > 0 and tests[0].get("expected_output") == "__GENERATE__"
+        failed_result = None
+        for i, t in enumerate(tests):
+            res = {"test_case_id": str(i+1), "status": "FAILED", "expected": t["expected_output"], "actual": ""}
+            try:
+                args = [decode(ty, a) for ty, a in zip(types, t.get("args") or [])]
+                val = encode(sig["returns"], fn(*args))
+                actual = dumps(val)
+                if is_gen:
+                    results.append({"input": t.get("input", ""), "args": t.get("args"), "expected_output": actual})
+                    continue
+                res["actual"] = actual
+                if equal(val, json.loads(t["expected_output"])): res["status"] = "PASSED"
+            except Exception as e:
+                if is_gen:
+                    results.append({"input": t.get("input", ""), "args": t.get("args"), "expected_output": "ERROR: " + str(e)})
+                    continue
+                res["status"] = "ERROR"
+                res["actual"] = str(e)
+            if not is_gen and res["status"] != "PASSED":
+                failed_result = res
+                break
+
+        if is_gen: print(json.dumps({"generated": results}))
+        elif failed_result: print(json.dumps([failed_result]))
+        else: print(json.dumps([]))
+    except Exception as e:
+        print(json.dumps([{"test_case_id": "0", "status": "ERROR", "actual": str(e), "expected": ""}]))
+if __name__ == "__main__": run()
+`
+
+const typedNodeDriverTemplate = `
+const fs = require('fs');
+
+class TreeNode {
+    constructor(val = 0, left = null, right = null) { this.val = val; this.left = left; this.right = right; }
+}
+class ListNode {
+    constructor(val = 0, next = null) { this.val = val; this.next = next; }
+}
+// solutions may refer to the node classes without defining them
+global.TreeNode = TreeNode;
+global.ListNode = ListNode;
+
+function decode(t, v) {
+    if (v === null || v === undefined) return null;
+    if (t.endsWith('[]')) return v.map((x) => decode(t.slice(0, -2), x));
+    if (t === 'ListNode') {
+        let head = null;
+        for (let i = v.length - 1; i >= 0; i--) head = new ListNode(v[i], head);
+        return head;
+    }
+    if (t === 'TreeNode') {
+        if (v.length === 0) return null;
+        const root = new TreeNode(v[0]);
+        const queue = [root];
+        let i = 1;
+        while (queue.length > 0 && i < v.length) {
+            const node = queue.shift();
+            for (const side of ['left', 'right']) {
+                if (i < v.length && v[i] !== null) {
+                    node[side] = new TreeNode(v[i]);
+                    queue.push(node[side]);
+                }
+                i++;
+            }
+        }
+        return root;
+    }
+    return v;
+}
+
+function encode(t, v) {
+    if (v === null || v === undefined) return null;
+    if (t.endsWith('[]')) return Array.from(v, (x) => encode(t.slice(0, -2), x));
+    if (t === 'ListNode') {
+        const out = [];
+        while (v && out.length <= 100000) { out.push(v.val); v = v.next; }
+        return out;
+    }
+    if (t === 'TreeNode') {
+        const out = [];
+        const queue = [v];
+        while (queue.length > 0) {
+            const node = queue.shift();
+            if (!node) { out.push(null); continue; }
+            out.push(node.val);
+            queue.push(node.left, node.right);
+        }
+        while (out.length > 0 && out[out.length - 1] === null) out.pop();
+        return out;
+    }
+    return v;
+}
+
+function equal(a, b) {
+    if (Array.isArray(a) && Array.isArray(b)) return a.length === b.length && a.every((x, i) => equal(x, b[i]));
+    if (typeof a === 'number' && typeof b === 'number') return Math.abs(a - b) <= 1e-6 * Math.max(1, Math.abs(a), Math.abs(b));
+    return a === b;
+}
+
+function loadFunction(name) {
+    const userMod = require('./solution');
+    if (typeof userMod === 'function') return userMod;
+    if (userMod && typeof userMod[name] === 'function') return userMod[name];
+    throw new Error('solution does not export ' + name);
+}
+
+try {
+    const sig = JSON.parse(fs.readFileSync('signature.json', 'utf8'));
+    const tests = JSON.parse(fs.readFileSync('tests.json', 'utf8'));
+    const fn = loadFunction(sig.function);
+    const types = sig.params.map((p) => p.type);
+    let failedResult = null;
+    let isGen = tests.length > 0 && tests[0].expected_output === "__GENERATE__";
+    let results = [];
+    tests.forEach((t, i) => {
+        if (failedResult) return;
+        const res = { test_case_id: String(i + 1), status: "FAILED", expected: t.expected_output, actual: "" };
+        try {
+            const args = (t.args || []).map((a, j) => decode(types[j], a));
+            const val = encode(sig.returns, fn(...args));
+            res.actual = JSON.stringify(val === undefined ? null : val);
+            if (isGen) {
+                results.push({input: t.input || "", args: t.args, expected_output: res.actual});
+                return;
+            }
+            if (equal(val, JSON.parse(t.expected_output))) res.status = "PASSED";
+        } catch (e) {
+            if (isGen) {
+                results.push({input: t.input || "", args: t.args, expected_output: "ERROR: " + e.message});
+                return;
+            }
+            res.status = "ERROR"; res.actual = e.message;
+        }
+        if (!isGen && res.status !== "PASSED") failedResult = res;
+    });
+    if (isGen) console.log(JSON.stringify({generated: results}));
+    else if (failedResult) console.log(JSON.stringify([failedResult]));
+    else console.log(JSON.stringify([]));
+} catch (e) { console.log(JSON.stringify([{test_case_id: "0", status: "ERROR", actual: e.message, expected: ""}])); }
+`
@@ -0,0 +1,108 @@
+package worker
+
+import (
+	"code-runner/pkg/models"
+	"fmt"
+	"strings"
+)
+
+// reportPlaceholder in the unit test drivers is replaced by the path of the
+// JUnit report of the run.
+const reportPlaceholder = "__REPORT__"
+
+// processUnitTests runs the test suite of the question against the solution
+// and judges it by the report of the suite.
+func (w *Worker) processUnitTests(payload *models.JobPayload, question *models.Question, cacheKey string) bool {
+	report, err := newReportName()
+	report += ".xml"
+	var files map[string]string
+	if err == nil {
+		files, err = unitTestFiles(payload, question.UnitTests, report)
+	}
+	if err == nil {
+		err = addFiles(files, payload.Files)
+	}
+	if err != nil {
+		w.db.UpdateResult(payload.SubmissionID, "ERROR", "", "Failed to generate runner: "+err.Error(), 0, 0, 0)
+		return true
+	}
+	// only the run may write the report
+	delete(files, report)
+
+	if w.cancelled(payload.SubmissionID) {
+		w.finishCancelled(payload, "", "")
+		return true
+	}
+	if w.isAborted() {
+		return false
+	}
+
+	opts := inputOptions(payload)
+	opts.Collect = []string{report}
+	output, stderr, res, execTime, err := w.run(payload, files, opts, w.limits(payload, question))
+
+	if w.cancelled(payload.SubmissionID) {
+		w.finishCancelled(payload, output, stderr)
+		return true
+	}
+	if w.isAborted() {
+		return false
+	}
+
+	status, results := judgeReports(models.ReportJUnit, output, &stderr, res.Files, res.ExitCode, err)
+	w.finishReports(payload, cacheKey, status, output, stderr, res, execTime, results, nil)
+	return true
+}
+
+// unitTestFiles lays out the solution next to the test suite and a driver
+// running it, which writes its report to the given path. The driver deletes
+// itself before the suite runs, so a solution exiting early finds the path in
+// no file. The solution runs in the same pytest or jest process, though, and
+// can read the path from its configuration, e.g. config.option.xmlpath, or
+// patch the reporter.
+func unitTestFiles(payload *models.JobPayload, suite *models.UnitTests, report string) (map[string]string, error) {
+	layout, ok := layoutFor(payload.Language)
+	if !ok || layout.framework != suite.Framework {
+		return nil, fmt.Errorf("%s tests do not run language %s", suite.Framework, payload.Language)
+	}
+	return map[string]string{
+		layout.solution: payload.Code,
+		layout.suite:    suite.Code,
+		layout.driver:   strings.ReplaceAll(layout.suiteDriverTemplate, reportPlaceholder, report),
+	}, nil
+}
+
+const pytestDriverTemplate = `
+import os
+import sys
+
+os.remove(__file__)
+
+try:
+    import pytest
+except ImportError:
+    print("pytest is not installed in the sandbox image", file=sys.stderr)
+    sys.exit(2)
+
+if __name__ == "__main__":
+    sys.exit(pytest.main(["-q", "-p", "no:cacheprovider", "--junitxml=__REPORT__", "test_solution.py"]))
+`
+
+const jestDriverTemplate = `
+require('fs').unlinkSync(__filename);
+
+let jest;
+try {
+    jest = require('jest');
+    require.resolve('jest-junit');
+} catch (e) {
+    console.error('jest and jest-junit have to be installed in the sandbox image');
+    process.exit(2);
+}
+// the options of the reporter stay in this process, unlike the environment
+const config = {
+    rootDir: __dirname,
+    reporters: ['default', ['jest-junit', {outputFile: '__REPORT__', classNameTemplate: '{classname}', titleTemplate: '{title}'}]],
+};
+jest.run(['--ci', '--config', JSON.stringify(config), 'solution.test.js']);
+`
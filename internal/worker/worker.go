@@ -1,61 +1,124 @@
 package worker
 
 import (
+	"code-runner/internal/cache"
 	"code-runner/internal/database"
 	"code-runner/internal/queue"
 	"code-runner/internal/sandbox"
 	"code-runner/internal/util"
 	"code-runner/pkg/cappedbuffer"
 	"code-runner/pkg/models"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
-	"github.com/redis/go-redis/v9"
 	"github.com/zekrotja/rogu/log"
 )
 
 type Worker struct {
 	id      int
-	queue   *queue.RedisQueue
-	db      *database.PostgresDB
+	owner   string
+	queue   queue.Queue
+	db      database.Database
 	manager *sandbox.Manager
-	quit    chan bool
+	cache   *cache.RedisVerdictCache
+	quit    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+
+	mu      sync.Mutex
+	current *models.JobPayload
+	aborted bool
+
+	latency *latencyTracker
 }
 
-func NewWorker(id int, q *queue.RedisQueue, db *database.PostgresDB, mgr *sandbox.Manager) *Worker {
+const (
+	maxStdOutBytes = 100 * 1024
+	maxStdErrBytes = 20 * 1024
+
+	// leaseTTL bounds how long a job stays owned by a worker which stopped
+	// renewing its lease, e.g. because the process died.
+	leaseTTL = 30 * time.Second
+)
+
+// NewWorker creates a worker consuming jobs from q. owner identifies the
+// process the worker runs in and is recorded as the owner of its jobs.
+func NewWorker(id int, owner string, q queue.Queue, db database.Database, mgr *sandbox.Manager, vc *cache.RedisVerdictCache) *Worker {
 	return &Worker{
 		id:      id,
+		owner:   owner,
 		queue:   q,
 		db:      db,
 		manager: mgr,
-		quit:    make(chan bool),
+		cache:   vc,
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
 	}
 }
 
-// Stop signals the worker to finish the current loop and exit
+// Stop signals the worker to finish the current job and exit
 func (w *Worker) Stop() {
-	go func() {
-		w.quit <- true
-	}()
+	w.once.Do(func() { close(w.quit) })
+}
+
+// Done is closed once the worker loop has exited.
+func (w *Worker) Done() <-chan struct{} { return w.done }
+
+// Abort kills the sandbox of the job currently in flight. The job is put
+// back into the queue instead of being marked as failed.
+func (w *Worker) Abort() {
+	w.mu.Lock()
+	w.aborted = true
+	cur := w.current
+	w.mu.Unlock()
+
+	if cur != nil {
+		log.Warn().Field("worker_id", w.id).Field("job_id", cur.SubmissionID).Msg("Aborting in-flight job")
+		w.manager.Kill(cur.SubmissionID)
+	}
+}
+
+// Busy reports whether the worker is currently processing a job.
+func (w *Worker) Busy() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.current != nil
+}
+
+func (w *Worker) isAborted() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.aborted
+}
+
+func (w *Worker) stopping() bool {
+	select {
+	case <-w.quit:
+		return true
+	default:
+		return false
+	}
 }
 
 func (w *Worker) Start() {
+	defer close(w.done)
 	log.Info().Field("worker_id", w.id).Msg("Worker started")
 	
 	for {
 		// Check for stop signal before polling
-		select {
-		case <-w.quit:
+		if w.stopping() {
 			log.Info().Field("worker_id", w.id).Msg("Worker stopping (signal received)")
 			return
-		default:
 		}
  
-		payload, err := w.queue.Dequeue(2 * time.Second)
+		payload, err := w.queue.Dequeue(w.owner, leaseTTL, 2*time.Second)
 		if err != nil {
-			if err == redis.Nil {
+			if err == queue.ErrNotFound {
 				continue
 			}
 			log.Error().Err(err).Msg("Redis error")
@@ -63,125 +126,576 @@ func (w *Worker) Start() {
 			continue
 		}
 
+		// The job was popped while shutting down, hand it to another worker
+		if w.stopping() {
+			w.requeue(payload)
+			log.Info().Field("worker_id", w.id).Msg("Worker stopping (signal received)")
+			return
+		}
+
 		log.Info().Field("worker_id", w.id).Field("job_id", payload.SubmissionID).Msg("Processing job")
 
-		files, totalTestCases, err := w.generateFiles(payload)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to generate files")
-			w.db.UpdateResult(payload.SubmissionID, "ERROR", "", "Failed to generate runner: "+err.Error(), 0, 0, 0)
-			continue
+		w.mu.Lock()
+		w.current = payload
+		w.mu.Unlock()
+
+		stopHeartbeat := w.claim(payload)
+		var finished bool
+		took := util.MeasureTime(func() {
+			finished = w.process(payload)
+		})
+		stopHeartbeat()
+
+		if w.latency != nil {
+			w.latency.Observe(took)
 		}
 
-		cStdOut := make(chan []byte)
-		cStdErr := make(chan []byte)
-		cStop := make(chan bool, 1)
-
-		stdOutBuf := cappedbuffer.New([]byte{}, 100*1024) 
-		stdErrBuf := cappedbuffer.New([]byte{}, 20*1024)
-
-		go func() {
-			for {
-				select {
-				case <-cStop:
-					return
-				case p := <-cStdOut:
-					stdOutBuf.Write(p)
-				case p := <-cStdErr:
-					stdErrBuf.Write(p)
+		if finished {
+			w.queue.Complete(payload.SubmissionID)
+		} else {
+			w.requeue(payload)
+		}
+
+		w.mu.Lock()
+		w.current = nil
+		w.mu.Unlock()
+	}
+}
+
+// claim marks the job dequeued for this worker's process as running and
+// keeps renewing its lease until the returned function is called.
+func (w *Worker) claim(payload *models.JobPayload) func() {
+	id := payload.SubmissionID
+	if err := w.db.MarkRunning(id); err != nil {
+		log.Error().Err(err).Field("job_id", id).Msg("Failed to mark job as running")
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(leaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := w.queue.Claim(id, w.owner, leaseTTL); err != nil {
+					log.Error().Err(err).Field("job_id", id).Msg("Failed to renew job lease")
 				}
 			}
-		}()
+		}
+	}()
 
-		execTime := util.MeasureTime(func() {
-			err = w.manager.RunInSandbox(payload.SubmissionID, payload.Language, files, nil, cStdOut, cStdErr, cStop)
-		})
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
 
-		status := "SUCCESS"
-		output := stdOutBuf.String()
-		stderr := stdErrBuf.String()
-		passedCount := 0
+func (w *Worker) requeue(payload *models.JobPayload) {
+	reset, err := w.db.MarkPending(payload.SubmissionID)
+	if err != nil {
+		// the job has no owner anymore, the sweeper will pick it up again
+		log.Error().Err(err).Field("job_id", payload.SubmissionID).Msg("Failed to requeue job")
+		w.queue.Release(payload.SubmissionID)
+		return
+	}
+	if !reset {
+		// the job was cancelled or has finished in the meantime
+		w.queue.Complete(payload.SubmissionID)
+		return
+	}
+	w.queue.Release(payload.SubmissionID)
+	if err := w.queue.Enqueue(*payload); err != nil {
+		// the job has no owner anymore, the sweeper will pick it up again
+		log.Error().Err(err).Field("job_id", payload.SubmissionID).Msg("Failed to requeue job")
+		return
+	}
+	log.Info().Field("worker_id", w.id).Field("job_id", payload.SubmissionID).Msg("Job requeued")
+}
+
+// process runs and judges the job. It returns false if the job was aborted
+// and has to be put back into the queue.
+func (w *Worker) process(payload *models.JobPayload) bool {
+	if w.cancelled(payload.SubmissionID) {
+		w.finishCancelled(payload, "", "")
+		return true
+	}
+	if payload.Playground {
+		return w.processPlayground(payload)
+	}
 
+	// Only plain solver runs against stored question tests are cacheable.
+	// Admin generation and input generator runs always execute.
+	var question *models.Question
+	if payload.QuestionID != "" && len(payload.AdminInputs) == 0 && !payload.IsInputGenerator {
+		q, err := w.db.GetQuestion(payload.QuestionID)
 		if err != nil {
-			if err.Error() == "execution timed out" {
-				status = "TIMEOUT"
+			log.Error().Err(err).Field("job_id", payload.SubmissionID).Msg("Failed to load question")
+			w.db.UpdateResult(payload.SubmissionID, "ERROR", "", fmt.Sprintf("Failed to generate runner: failed to load tests for question %s: %v", payload.QuestionID, err), 0, 0, 0)
+			return true
+		}
+		question = q
+	}
+
+	cacheKey := ""
+	if question != nil && w.cache != nil {
+		cacheKey = w.verdictKey(payload, question)
+		if !payload.BypassCache {
+			v, ok, err := w.cache.Get(payload.QuestionID, cacheKey)
+			if err != nil {
+				log.Warn().Err(err).Field("job_id", payload.SubmissionID).Msg("Verdict cache lookup failed")
+			} else if ok {
+				if len(v.Results) > 0 {
+					w.db.UpdateTestResults(payload.SubmissionID, v.Results)
+				}
+				if v.Score != nil {
+					w.db.UpdateScore(payload.SubmissionID, *v.Score)
+				}
+				w.db.UpdateResult(payload.SubmissionID, v.Status, v.StdOut, v.StdErr, v.ExecTimeMS, v.PassedCount, v.TotalCount)
+				log.Info().Field("job_id", payload.SubmissionID).Field("status", v.Status).Msg("Job finished (cached verdict)")
+				return true
+			}
+		}
+	}
+
+	if question != nil && question.Project != nil {
+		return w.processProject(payload, question, cacheKey)
+	}
+	if question != nil && question.UnitTests != nil {
+		return w.processUnitTests(payload, question, cacheKey)
+	}
+	if question != nil && question.SQL != nil {
+		return w.processSQL(payload, question, cacheKey)
+	}
+	if question != nil && question.Scoring != nil {
+		return w.processScoring(payload, question, cacheKey)
+	}
+
+	files, totalTestCases, err := w.generateFiles(payload, question)
+	if err == nil {
+		err = addFiles(files, payload.Files)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to generate files")
+		w.db.UpdateResult(payload.SubmissionID, "ERROR", "", "Failed to generate runner: "+err.Error(), 0, 0, 0)
+		return true
+	}
+
+	if w.cancelled(payload.SubmissionID) {
+		w.finishCancelled(payload, "", "")
+		return true
+	}
+	if w.isAborted() {
+		return false
+	}
+
+	output, stderr, runRes, execTime, err := w.run(payload, files, inputOptions(payload), w.limits(payload, question))
+
+	// the sandbox was killed because the job has been cancelled
+	if w.cancelled(payload.SubmissionID) {
+		w.finishCancelled(payload, output, stderr)
+		return true
+	}
+	if w.isAborted() {
+		return false
+	}
+
+	status := "SUCCESS"
+	passedCount := 0
+
+	if err != nil {
+		if err.Error() == "execution timed out" {
+			status = "TIMEOUT"
+		} else {
+			status = "ERROR"
+		}
+	}
+
+	if status == "SUCCESS" {
+		if payload.IsInputGenerator {
+			var rawInputs []string
+			if jsonErr := json.Unmarshal([]byte(output), &rawInputs); jsonErr == nil {
+				status = "SUCCESS"
+				passedCount = len(rawInputs)
 			} else {
 				status = "ERROR"
+				stderr = "Failed to parse generated inputs as JSON array of strings.\nOutput was:\n" + output
 			}
-		}
+		} else {
+			jsonStr := extractJSON(output)
 
-		if status == "SUCCESS" {
-			if payload.IsInputGenerator {
-				var rawInputs []string
-				if jsonErr := json.Unmarshal([]byte(output), &rawInputs); jsonErr == nil {
-					status = "SUCCESS"
-					passedCount = len(rawInputs)
-				} else {
-					status = "ERROR"
-					stderr = "Failed to parse generated inputs as JSON array of strings.\nOutput was:\n" + output
+			parsed := false
+
+			// 1. Try as Admin Test Generation Result (Object with "generated" key)
+			if strings.Contains(jsonStr, "\"generated\"") {
+				var genResult struct {
+					Generated []models.TestCase `json:"generated"`
 				}
-			} else {
-				jsonStr := strings.TrimSpace(output)
-				// If the full output isn't valid JSON, scan from last line backwards
-				if !json.Valid([]byte(jsonStr)) {
-					lines := strings.Split(jsonStr, "\n")
-					for i := len(lines) - 1; i >= 0; i-- {
-						line := strings.TrimSpace(lines[i])
-						if len(line) > 0 && json.Valid([]byte(line)) {
-							jsonStr = line
-							break
-						}
-					}
+				if err := json.Unmarshal([]byte(jsonStr), &genResult); err == nil {
+					status = "SUCCESS"
+					passedCount = totalTestCases
+					output = jsonStr
+					parsed = true
 				}
+			}
 
-				parsed := false
-
-				// 1. Try as Admin Test Generation Result (Object with "generated" key)
-				if strings.Contains(jsonStr, "\"generated\"") {
-					var genResult struct {
-						Generated []models.TestCase `json:"generated"`
-					}
-					if err := json.Unmarshal([]byte(jsonStr), &genResult); err == nil {
+			// 2. Try as Standard Solver Result (Array of TestResults)
+			if !parsed {
+				var results []models.TestResult
+				if err := json.Unmarshal([]byte(jsonStr), &results); err == nil {
+					output = jsonStr
+					if len(results) > 0 {
+						failure := results[0]
+						status = "FAILURE"
+						if idVal, err := strconv.Atoi(failure.TestCaseID); err == nil {
+							passedCount = idVal - 1
+						}
+						stderr = fmt.Sprintf("Failed Case %s:\n\nExpected Output:\n%s\n\nActual Output:\n%s",
+							failure.TestCaseID, failure.Expected, failure.Actual)
+					} else {
 						status = "SUCCESS"
 						passedCount = totalTestCases
-						output = jsonStr
-						parsed = true
 					}
+					parsed = true
 				}
+			}
 
-				// 2. Try as Standard Solver Result (Array of TestResults)
-				if !parsed {
-					var results []models.TestResult
-					if err := json.Unmarshal([]byte(jsonStr), &results); err == nil {
-						output = jsonStr
-						if len(results) > 0 {
-							failure := results[0]
-							status = "FAILURE"
-							if idVal, err := strconv.Atoi(failure.TestCaseID); err == nil {
-								passedCount = idVal - 1
-							}
-							stderr = fmt.Sprintf("Failed Case %s:\n\nExpected Output:\n%s\n\nActual Output:\n%s",
-								failure.TestCaseID, failure.Expected, failure.Actual)
-						} else {
-							status = "SUCCESS"
-							passedCount = totalTestCases
-						}
-						parsed = true
-					}
-				}
+			if !parsed {
+				status = "ERROR"
+				stderr += fmt.Sprintf("\nJudge Error: Output format invalid.\nExtracted: %s\nOriginal: %s", jsonStr, output)
+			}
+		}
+	}
 
-				if !parsed {
-					status = "ERROR"
-					stderr += fmt.Sprintf("\nJudge Error: Output format invalid.\nExtracted: %s\nOriginal: %s", jsonStr, output)
-				}
+	w.updateRunStats(payload, runRes)
+	w.db.UpdateResult(payload.SubmissionID, status, output, stderr, int(execTime.Milliseconds()), passedCount, totalTestCases)
+	log.Info().Field("job_id", payload.SubmissionID).Field("status", status).Msg("Job finished")
+
+	w.storeVerdict(payload, cacheKey, &cache.Verdict{
+		Status:      status,
+		StdOut:      output,
+		StdErr:      stderr,
+		ExecTimeMS:  int(execTime.Milliseconds()),
+		PassedCount: passedCount,
+		TotalCount:  totalTestCases,
+	})
+
+	return true
+}
+
+// extractJSON returns the output if it is valid JSON, otherwise its last
+// line which is.
+func extractJSON(output string) string {
+	jsonStr := strings.TrimSpace(output)
+	// If the full output isn't valid JSON, scan from last line backwards
+	if !json.Valid([]byte(jsonStr)) {
+		lines := strings.Split(jsonStr, "\n")
+		for i := len(lines) - 1; i >= 0; i-- {
+			line := strings.TrimSpace(lines[i])
+			if len(line) > 0 && json.Valid([]byte(line)) {
+				jsonStr = line
+				break
 			}
 		}
+	}
+	return jsonStr
+}
+
+// storeVerdict caches the verdict of a judged run under cacheKey, if set.
+func (w *Worker) storeVerdict(payload *models.JobPayload, cacheKey string, v *cache.Verdict) {
+	// Only deterministic verdicts are cached, timeouts and errors may be
+	// caused by the host rather than by the submitted code.
+	if cacheKey == "" || (v.Status != "SUCCESS" && v.Status != "FAILURE") {
+		return
+	}
+	if err := w.cache.Set(payload.QuestionID, cacheKey, v); err != nil {
+		log.Warn().Err(err).Field("job_id", payload.SubmissionID).Msg("Failed to store verdict in cache")
+	}
+}
+
+// inputOptions passes the inputs of the request to the run.
+func inputOptions(payload *models.JobPayload) sandbox.JobOptions {
+	return sandbox.JobOptions{
+		Arguments:   payload.Arguments,
+		Environment: payload.Environment,
+		Stdin:       payload.Stdin,
+	}
+}
+
+// runLimits are the limits a run of a submission is held to. Zero time and
+// memory keep the configured limits of the sandbox.
+type runLimits struct {
+	timeout time.Duration
+	memory  int64
+	stdout  int
+	stderr  int
+}
+
+var defaultLimits = runLimits{stdout: maxStdOutBytes, stderr: maxStdErrBytes}
+
+// limits resolves the limits of the question for the language of the
+// submission. Multipliers scale the limits of the question, or the
+// configured ones if the question sets none.
+func (w *Worker) limits(payload *models.JobPayload, q *models.Question) runLimits {
+	lim := defaultLimits
+	if q == nil || q.Limits == nil {
+		return lim
+	}
+	l := q.Limits
+	if l.StdoutBytes > 0 {
+		lim.stdout = l.StdoutBytes
+	}
+	if l.StderrBytes > 0 {
+		lim.stderr = l.StderrBytes
+	}
+
+	sbx := w.manager.Limits()
+	timeout := time.Duration(sbx.TimeoutSeconds) * time.Second
+	if l.TimeMS > 0 {
+		timeout = time.Duration(l.TimeMS) * time.Millisecond
+	}
+	memory, err := models.ParseMemory(sbx.Memory)
+	if l.Memory != "" {
+		memory, err = models.ParseMemory(l.Memory)
+	}
+	m := l.Multiplier(payload.Language)
+	if l.TimeMS > 0 || m != 1 {
+		lim.timeout = time.Duration(float64(timeout) * m)
+	}
+	if err == nil && (l.Memory != "" || m != 1) {
+		lim.memory = int64(float64(memory) * m)
+	}
+	return lim
+}
+
+// apply sets the time and memory limits on the options of a run.
+func (l runLimits) apply(opts sandbox.JobOptions) sandbox.JobOptions {
+	opts.Timeout = l.timeout
+	opts.Memory = l.memory
+	return opts
+}
+
+// run executes the files in a sandbox and collects the capped output.
+func (w *Worker) run(payload *models.JobPayload, files map[string]string, opts sandbox.JobOptions, lim runLimits) (string, string, sandbox.Result, time.Duration, error) {
+	cStdOut := make(chan []byte)
+	cStdErr := make(chan []byte)
+	cStop := make(chan bool, 1)
+
+	stdOutBuf := cappedbuffer.New([]byte{}, lim.stdout)
+	stdErrBuf := cappedbuffer.New([]byte{}, lim.stderr)
 
-		w.db.UpdateResult(payload.SubmissionID, status, output, stderr, int(execTime.Milliseconds()), passedCount, totalTestCases)
-		log.Info().Field("job_id", payload.SubmissionID).Field("status", status).Msg("Job finished")
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for {
+			select {
+			case <-cStop:
+				return
+			case p := <-cStdOut:
+				stdOutBuf.Write(p)
+			case p := <-cStdErr:
+				stdErrBuf.Write(p)
+			}
+		}
+	}()
+
+	var (
+		res sandbox.Result
+		err error
+	)
+	execTime := util.MeasureTime(func() {
+		res, err = w.manager.RunInSandbox(payload.SubmissionID, payload.Language, files, lim.apply(opts), cStdOut, cStdErr, cStop)
+	})
+	// the manager only signals the stop if the sandbox ran. The buffers are
+	// read once the last received output has been written.
+	select {
+	case cStop <- true:
+	default:
+	}
+	<-collected
+	return stdOutBuf.String(), stdErrBuf.String(), res, execTime, err
+}
+
+// processPlayground runs the code as-is, without a driver or tests, and
+// stores its raw output, exit code and resource usage.
+func (w *Worker) processPlayground(payload *models.JobPayload) bool {
+	spec, ok := w.manager.Spec(payload.Language)
+	if !ok {
+		w.db.UpdateResult(payload.SubmissionID, "ERROR", "", "Unsupported language: "+payload.Language, 0, 0, 0)
+		return true
+	}
+	if w.isAborted() {
+		return false
+	}
+
+	files := submissionFiles(payload, spec.FileName)
+	if _, ok := files[spec.FileName]; !ok {
+		w.db.UpdateResult(payload.SubmissionID, "ERROR", "", "Missing code or file "+spec.FileName, 0, 0, 0)
+		return true
+	}
+
+	output, stderr, res, execTime, err := w.run(payload, files, inputOptions(payload), defaultLimits)
+
+	if w.cancelled(payload.SubmissionID) {
+		w.finishCancelled(payload, output, stderr)
+		return true
+	}
+	if w.isAborted() {
+		return false
+	}
+
+	status := "SUCCESS"
+	switch {
+	case err != nil && err.Error() == "execution timed out":
+		status = "TIMEOUT"
+	case err != nil:
+		status = "ERROR"
+		if stderr != "" {
+			stderr += "\n"
+		}
+		stderr += err.Error()
+	case res.ExitCode != 0:
+		status = "ERROR"
+	}
+	if res.OOMKilled {
+		if stderr != "" {
+			stderr += "\n"
+		}
+		stderr += "Memory limit exceeded."
+	}
+
+	w.updateRunStats(payload, res)
+	w.db.UpdateResult(payload.SubmissionID, status, output, stderr, int(execTime.Milliseconds()), 0, 0)
+	log.Info().Field("job_id", payload.SubmissionID).Field("status", status).Field("exit_code", res.ExitCode).Msg("Playground job finished")
+	return true
+}
+
+func (w *Worker) updateRunStats(payload *models.JobPayload, res sandbox.Result) {
+	err := w.db.UpdateRunStats(payload.SubmissionID, res.ExitCode, int(res.CPUTime.Milliseconds()), int(res.MaxMemory/1024))
+	if err != nil {
+		log.Warn().Err(err).Field("job_id", payload.SubmissionID).Msg("Failed to store resource usage")
 	}
 }
 
-func (w *Worker) generateFiles(payload *models.JobPayload) (map[string]string, int, error) {
+// cancelled reports whether the job has been cancelled through the API.
+func (w *Worker) cancelled(id string) bool {
+	ok, err := w.queue.IsCancelled(id)
+	if err != nil {
+		log.Warn().Err(err).Field("job_id", id).Msg("Failed to check for cancellation")
+		return false
+	}
+	return ok
+}
+
+// finishCancelled stores the final state of a cancelled job together with
+// the output it produced so far.
+func (w *Worker) finishCancelled(payload *models.JobPayload, stdout, stderr string) {
+	if stderr != "" {
+		stderr += "\n"
+	}
+	w.db.UpdateCancelled(payload.SubmissionID, stdout, stderr+"Submission was cancelled.")
+	log.Info().Field("job_id", payload.SubmissionID).Msg("Job cancelled")
+}
+
+// driverVersion changes with any driver, so verdicts judged by an older
+// driver are not served anymore.
+var driverVersion = cache.Hash(
+	pythonDriverTemplate,
+	nodeDriverTemplate,
+	typedPythonDriverTemplate,
+	typedNodeDriverTemplate,
+	pytestDriverTemplate,
+	jestDriverTemplate,
+	sqlDriverTemplate,
+)
+
+// verdictKey hashes everything that can influence the verdict of a
+// submission: language, code, the version of the question's test set, the
+// drivers and image judging it, the limits the code runs under and the
+// arguments, environment and stdin.
+func (w *Worker) verdictKey(payload *models.JobPayload, q *models.Question) string {
+	sbx := w.manager.Limits()
+	spec, _ := w.manager.Spec(payload.Language)
+	parts := []string{
+		payload.Language,
+		payload.Code,
+		q.TestsVersion(),
+		strconv.Itoa(sbx.TimeoutSeconds),
+		sbx.Memory,
+		strconv.Itoa(maxStdOutBytes),
+		strconv.Itoa(maxStdErrBytes),
+		driverVersion,
+		spec.ImageRef(),
+		spec.Cmd,
+	}
+	if q.Limits != nil {
+		limits, _ := json.Marshal(q.Limits)
+		parts = append(parts, string(limits))
+	}
+	// appended only if present, so keys of plain submissions stay the same
+	if len(payload.Arguments) > 0 || len(payload.Environment) > 0 || payload.Stdin != "" {
+		inputs, _ := json.Marshal(struct {
+			Args  []string          `json:"a"`
+			Env   map[string]string `json:"e"`
+			Stdin string            `json:"i"`
+		}{payload.Arguments, payload.Environment, payload.Stdin})
+		parts = append(parts, string(inputs))
+	}
+	if len(payload.Files) > 0 {
+		files, _ := json.Marshal(payload.Files)
+		parts = append(parts, string(files))
+	}
+	return cache.Hash(parts...)
+}
+
+// submissionFiles returns the submitted files with the code, if any, stored
+// as entry.
+func submissionFiles(payload *models.JobPayload, entry string) map[string]string {
+	files := make(map[string]string, len(payload.Files)+1)
+	for name, content := range payload.Files {
+		files[name] = content
+	}
+	if payload.Code != "" {
+		files[entry] = payload.Code
+	}
+	return files
+}
+
+// addFiles adds the files of the submission to the generated ones, which
+// they may not replace.
+func addFiles(files, extra map[string]string) error {
+	for name, content := range extra {
+		if _, ok := files[name]; ok {
+			return fmt.Errorf("file %s is reserved", name)
+		}
+		files[name] = content
+	}
+	return nil
+}
+
+// signature returns the signature of the question, which admin generation
+// runs load themselves.
+func (w *Worker) signature(payload *models.JobPayload, question *models.Question) (*models.Signature, error) {
+	if question != nil {
+		return question.Signature, nil
+	}
+	if len(payload.AdminInputs) == 0 || payload.QuestionID == "" {
+		return nil, nil
+	}
+	q, err := w.db.GetQuestion(payload.QuestionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load question %s: %v", payload.QuestionID, err)
+	}
+	return q.Signature, nil
+}
+
+func (w *Worker) generateFiles(payload *models.JobPayload, question *models.Question) (map[string]string, int, error) {
 	files := make(map[string]string)
 	
 	if payload.IsInputGenerator {
@@ -200,6 +714,11 @@ func (w *Worker) generateFiles(payload *models.JobPayload) (map[string]string, i
 	var testsJSON []byte
 	var tests []models.TestCase
 
+	signature, err := w.signature(payload, question)
+	if err != nil {
+		return nil, 0, err
+	}
+
 	if len(payload.AdminInputs) > 0 {
 		tests = make([]models.TestCase, len(payload.AdminInputs))
 		for i, inp := range payload.AdminInputs {
@@ -208,16 +727,22 @@ func (w *Worker) generateFiles(payload *models.JobPayload) (map[string]string, i
 				Input:          inp,
 				ExpectedOutput: "__GENERATE__",
 			}
+			// inputs of typed questions are JSON arrays of the arguments
+			if signature != nil {
+				if err := json.Unmarshal([]byte(inp), &tests[i].Args); err != nil {
+					return nil, 0, fmt.Errorf("input %d is not a JSON array of arguments", i+1)
+				}
+				if err := signature.CheckArgs(tests[i].Args); err != nil {
+					return nil, 0, fmt.Errorf("input %d: %v", i+1, err)
+				}
+			}
 		}
 		testsJSON, _ = json.Marshal(tests)
-	} else if payload.QuestionID != "" {
-		q, err := w.db.GetQuestion(payload.QuestionID)
-		if err != nil {
-			return nil, 0, fmt.Errorf("failed to load tests for question %s: %v", payload.QuestionID, err)
-		}
-		testsJSON, err = json.Marshal(q.TestCases)
+	} else if question != nil {
+		var err error
+		testsJSON, err = json.Marshal(question.TestCases)
 		if err != nil {
-			return nil, 0, fmt.Errorf("failed to encode tests for question %s: %v", payload.QuestionID, err)
+			return nil, 0, fmt.Errorf("failed to encode tests for question %s: %v", question.ID, err)
 		}
 	} else {
 		defaultTests := []models.TestCase{{ID: "1", Input: "test", ExpectedOutput: "test"}}
@@ -229,22 +754,53 @@ func (w *Worker) generateFiles(payload *models.JobPayload) (map[string]string, i
 	}
 	
 	files["tests.json"] = string(testsJSON)
+	if signature != nil {
+		signatureJSON, _ := json.Marshal(signature)
+		files[signatureFile] = string(signatureJSON)
+	}
 
-	switch payload.Language {
-	case "python3", "python":
-		files["solution.py"] = payload.Code
-		files["driver.py"] = pythonDriverTemplate
-	case "node", "javascript":
-		files["solution.js"] = payload.Code
-		files["driver.js"] = nodeDriverTemplate
-	default:
+	layout, ok := layoutFor(payload.Language)
+	if !ok {
 		files["main.code"] = payload.Code
 		return nil, 0, fmt.Errorf("language %s not fully supported", payload.Language)
 	}
+	files[layout.solution] = payload.Code
+	files[layout.driver] = layout.driverTemplate
+	if signature != nil {
+		files[layout.driver] = layout.typedDriverTemplate
+	}
 
 	return files, len(tests), nil
 }
 
+// solutionLayout is how the solution of a language is laid out next to the
+// driver judging it. Drivers and test suites import it as module solution.
+type solutionLayout struct {
+	solution, driver                    string
+	driverTemplate, typedDriverTemplate string
+	// unit test suites of the framework are written as suite and run by
+	// suiteDriverTemplate instead of the driver
+	framework, suite, suiteDriverTemplate string
+}
+
+func layoutFor(language string) (solutionLayout, bool) {
+	switch language {
+	case "python3", "python":
+		return solutionLayout{
+			solution: "solution.py", driver: "driver.py",
+			driverTemplate: pythonDriverTemplate, typedDriverTemplate: typedPythonDriverTemplate,
+			framework: models.FrameworkPytest, suite: "test_solution.py", suiteDriverTemplate: pytestDriverTemplate,
+		}, true
+	case "node", "javascript":
+		return solutionLayout{
+			solution: "solution.js", driver: "driver.js",
+			driverTemplate: nodeDriverTemplate, typedDriverTemplate: typedNodeDriverTemplate,
+			framework: models.FrameworkJest, suite: "solution.test.js", suiteDriverTemplate: jestDriverTemplate,
+		}, true
+	}
+	return solutionLayout{}, false
+}
+
 const pythonDriverTemplate = `
 import json
 import sys
@@ -319,7 +875,13 @@ try {
                 continue;
             }
             if (res.actual.trim() === t.expected_output.trim()) res.status = "PASSED";
-        } catch (e) { res.status = "ERROR"; res.actual = e.message; }
+        } catch (e) {
+            if (isGen) {
+                results.push({input: String(t.input), expected_output: "ERROR: " + e.message});
+                continue;
+            }
+            res.status = "ERROR"; res.actual = e.message;
+        }
         if (!isGen && res.status !== "PASSED") { failedResult = res; break; }
     }
     if (isGen) console.log(JSON.stringify({generated: results}));
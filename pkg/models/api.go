@@ -1,26 +1,146 @@
 package models
 
-import "time"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
 
 type TestCase struct {
 	ID             string `json:"id"`
 	Input          string `json:"input"`
 	ExpectedOutput string `json:"expected_output"`
+	// Args are the arguments of questions with a signature, one JSON value
+	// per parameter. Their expected output is the JSON of the return value.
+	Args []json.RawMessage `json:"args,omitempty"`
+	// BestScore is the best known score of the test case, see Scoring
+	BestScore *float64 `json:"best_score,omitempty"`
 }
 
 type TestResult struct {
 	TestCaseID string `json:"test_case_id"`
-	Status     string `json:"status"` // PASSED, FAILED, ERROR
+	Status     string `json:"status"` // PASSED, FAILED, ERROR, SKIPPED
 	Actual     string `json:"actual"`
 	Expected   string `json:"expected"`
+	// Message is the failure or error message of the test, if any
+	Message string `json:"message,omitempty"`
+	// Score is the raw score the scorer gave an accepted output
+	Score *float64 `json:"score,omitempty"`
 }
 
 type ExecutionRequest struct {
-	Language    string            `json:"language"`
-	Code        string            `json:"code"`
-	QuestionID  string            `json:"question_id"`
-	Arguments   []string          `json:"arguments"`
-	Environment map[string]string `json:"environment"`
+	Language    string            `json:"language" form:"language"`
+	Code        string            `json:"code" form:"code"`
+	QuestionID  string            `json:"question_id" form:"question_id"`
+	Arguments   []string          `json:"arguments" form:"arguments"`
+	Environment map[string]string `json:"environment" form:"-"`
+	Stdin       string            `json:"stdin" form:"stdin"`
+	// Files maps slash separated paths relative to the workspace to their
+	// contents. They are written next to the code.
+	Files map[string]string `json:"files" form:"-"`
+}
+
+// Limits of the per-request inputs of an execution.
+const (
+	MaxArguments      = 64
+	MaxArgumentsBytes = 16 << 10
+	MaxEnvironment    = 64
+	MaxEnvironBytes   = 16 << 10
+	MaxStdinBytes     = 1 << 20
+
+	MaxFiles      = 256
+	MaxFilesBytes = 4 << 20
+	MaxPathLength = 255
+)
+
+var envNameRx = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// reservedEnv are variables the sandbox relies on, requests may not set them.
+// Every name starting with RUNNER_ is reserved as well.
+var reservedEnv = map[string]bool{
+	"PATH":            true,
+	"HOME":            true,
+	"HOSTNAME":        true,
+	"LD_PRELOAD":      true,
+	"LD_LIBRARY_PATH": true,
+}
+
+// ValidateInputs checks arguments, environment and stdin of the request
+// against the limits.
+func (r *ExecutionRequest) ValidateInputs() error {
+	if len(r.Arguments) > MaxArguments {
+		return fmt.Errorf("at most %d arguments are allowed", MaxArguments)
+	}
+	size := 0
+	for _, a := range r.Arguments {
+		if strings.IndexByte(a, 0) >= 0 {
+			return errors.New("arguments may not contain NUL bytes")
+		}
+		size += len(a)
+	}
+	if size > MaxArgumentsBytes {
+		return fmt.Errorf("arguments may not exceed %d bytes", MaxArgumentsBytes)
+	}
+
+	if len(r.Environment) > MaxEnvironment {
+		return fmt.Errorf("at most %d environment variables are allowed", MaxEnvironment)
+	}
+	size = 0
+	for k, v := range r.Environment {
+		if !envNameRx.MatchString(k) {
+			return fmt.Errorf("invalid environment variable name %q", k)
+		}
+		if reservedEnv[strings.ToUpper(k)] || strings.HasPrefix(strings.ToUpper(k), "RUNNER_") {
+			return fmt.Errorf("environment variable %s is reserved", k)
+		}
+		if strings.IndexByte(v, 0) >= 0 {
+			return fmt.Errorf("environment variable %s may not contain NUL bytes", k)
+		}
+		size += len(k) + len(v)
+	}
+	if size > MaxEnvironBytes {
+		return fmt.Errorf("environment may not exceed %d bytes", MaxEnvironBytes)
+	}
+
+	if len(r.Stdin) > MaxStdinBytes {
+		return fmt.Errorf("stdin may not exceed %d bytes", MaxStdinBytes)
+	}
+	return nil
+}
+
+// ValidateFiles checks the paths of the files and their count and total
+// size, including the code, against the limits.
+func (r *ExecutionRequest) ValidateFiles() error {
+	if len(r.Files) > MaxFiles {
+		return fmt.Errorf("at most %d files are allowed", MaxFiles)
+	}
+	size := len(r.Code)
+	for name, content := range r.Files {
+		if err := ValidatePath(name); err != nil {
+			return err
+		}
+		size += len(content)
+	}
+	if size > MaxFilesBytes {
+		return fmt.Errorf("files may not exceed %d bytes", MaxFilesBytes)
+	}
+	return nil
+}
+
+// ValidatePath checks that name is a clean, slash separated path which stays
+// inside the workspace.
+func ValidatePath(name string) error {
+	if name == "" || len(name) > MaxPathLength || strings.ContainsAny(name, "\\\x00") ||
+		strings.HasPrefix(name, "/") || path.Clean(name) != name || name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return fmt.Errorf("invalid file path %q", name)
+	}
+	return nil
 }
 
 type GenerateRequest struct {
@@ -48,15 +168,149 @@ type Question struct {
 	SolutionCode    string     `json:"solution_code,omitempty"`
 	SolutionLang    string     `json:"solution_lang,omitempty"`
 	GeneratorConfig string     `json:"generator_config,omitempty"`
+	// Project makes the question grade whole repositories with their own
+	// test command instead of the test cases.
+	Project *Project `json:"project,omitempty"`
+	// UnitTests makes the question grade solutions with test code written
+	// by the instructor instead of the test cases.
+	UnitTests *UnitTests `json:"unit_tests,omitempty"`
+	// SQL makes the question a query question judged against an embedded
+	// database.
+	SQL *SQLQuestion `json:"sql,omitempty"`
+	// Scoring rates the outputs of the test cases with a scorer program
+	// instead of comparing them.
+	Scoring *Scoring `json:"scoring,omitempty"`
+	// Signature makes the solution a typed function called with the
+	// arguments of the test cases.
+	Signature *Signature `json:"signature,omitempty"`
+	// StarterCode is the code students start with by spec key. Languages
+	// without one get starter code generated by the API.
+	StarterCode map[string]string `json:"starter_code,omitempty"`
+	// Limits override the sandbox limits for the runs of the question
+	Limits *Limits `json:"limits,omitempty"`
+}
+
+// Frameworks of instructor test suites.
+const (
+	FrameworkPytest = "pytest"
+	FrameworkJest   = "jest"
+)
+
+// UnitTests is a test file which imports the solution module of the
+// student, solution.py for pytest and solution.js for jest.
+type UnitTests struct {
+	Framework string `json:"framework"`
+	Code      string `json:"code"`
+}
+
+// SQLQuestion is answered with a single query. Its result set is compared
+// with the one of the reference query on a database set up with Schema and
+// Seed.
+type SQLQuestion struct {
+	Schema    string `json:"schema"`
+	Seed      string `json:"seed,omitempty"`
+	Reference string `json:"reference"`
+	// Ordered requires the rows in the order of the reference, otherwise
+	// they are compared regardless of their order
+	Ordered bool `json:"ordered,omitempty"`
+}
+
+// Validate checks that the question has a schema and a reference query.
+func (q SQLQuestion) Validate() error {
+	if strings.TrimSpace(q.Schema) == "" {
+		return errors.New("sql questions need a schema")
+	}
+	if strings.TrimSpace(q.Reference) == "" {
+		return errors.New("sql questions need a reference query")
+	}
+	return nil
+}
+
+// Validate checks that the suite can be run.
+func (u UnitTests) Validate() error {
+	if u.Framework != FrameworkPytest && u.Framework != FrameworkJest {
+		return fmt.Errorf("unsupported test framework %q", u.Framework)
+	}
+	if strings.TrimSpace(u.Code) == "" {
+		return errors.New("unit tests need code")
+	}
+	return nil
+}
+
+// Public returns the question as shown to students, without the grading
+// material of the instructor. Nested values are copied, not modified.
+func (q Question) Public() Question {
+	q.SolutionCode, q.GeneratorConfig = "", ""
+	if q.Project != nil {
+		project := *q.Project
+		project.Files = nil
+		q.Project = &project
+	}
+	if q.UnitTests != nil {
+		suite := *q.UnitTests
+		suite.Code = ""
+		q.UnitTests = &suite
+	}
+	if q.SQL != nil {
+		sql := *q.SQL
+		sql.Reference = ""
+		q.SQL = &sql
+	}
+	if q.Scoring != nil {
+		scoring := *q.Scoring
+		scoring.Scorer = ""
+		q.Scoring = &scoring
+	}
+	return q
+}
+
+// TestsVersion identifies the current state of the question's test set and
+// changes whenever a test case is added, removed or edited, or the project
+// configuration, unit tests, SQL setup, scoring or signature change.
+func (q *Question) TestsVersion() string {
+	data, _ := json.Marshal(q.TestCases)
+	if q.Project != nil {
+		project, _ := json.Marshal(q.Project)
+		data = append(data, project...)
+	}
+	if q.UnitTests != nil {
+		suite, _ := json.Marshal(q.UnitTests)
+		data = append(data, suite...)
+	}
+	if q.SQL != nil {
+		sql, _ := json.Marshal(q.SQL)
+		data = append(data, sql...)
+	}
+	if q.Scoring != nil {
+		scoring, _ := json.Marshal(q.Scoring)
+		data = append(data, scoring...)
+	}
+	if q.Signature != nil {
+		signature, _ := json.Marshal(q.Signature)
+		data = append(data, signature...)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
 }
 
 type JobPayload struct {									// transfered to REDIS
-	SubmissionID     string   `json:"submission_id"`
-	Language         string   `json:"language"`
-	Code             string   `json:"code"`
-	QuestionID       string   `json:"question_id"`
-	AdminInputs      []string `json:"admin_inputs,omitempty"`
-	IsInputGenerator bool     `json:"is_input_generator,omitempty"`
+	SubmissionID     string    `json:"submission_id"`
+	Language         string    `json:"language"`
+	Code             string    `json:"code"`
+	QuestionID       string    `json:"question_id"`
+	AdminInputs      []string  `json:"admin_inputs,omitempty"`
+	IsInputGenerator bool      `json:"is_input_generator,omitempty"`
+	BypassCache      bool      `json:"bypass_cache,omitempty"`
+	EnqueuedAt       time.Time `json:"enqueued_at"`
+
+	Arguments   []string          `json:"arguments,omitempty"`
+	Environment map[string]string `json:"environment,omitempty"`
+	Stdin       string            `json:"stdin,omitempty"`
+
+	// Playground jobs run the code as-is, without a driver or tests.
+	Playground bool `json:"playground,omitempty"`
+	// Files are written into the workspace next to the code.
+	Files map[string]string `json:"files,omitempty"`
 }
 
 type Submission struct {									// transfered to Database
@@ -72,5 +326,20 @@ type Submission struct {									// transfered to Database
 	PassedCount int          `json:"passed_count"`
 	TotalCount  int          `json:"total_count"`
 	CreatedAt   time.Time    `json:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+	Attempts    int          `json:"attempts"`
 	IsAdmin     bool         `json:"is_admin"`
+
+	Playground bool              `json:"playground"`
+	Files      map[string]string `json:"files,omitempty"`
+	// Arguments, Environment and Stdin are the inputs of the request, kept
+	// so the job can be rebuilt
+	Arguments   []string          `json:"arguments,omitempty"`
+	Environment map[string]string `json:"environment,omitempty"`
+	Stdin       string            `json:"stdin,omitempty"`
+	ExitCode    int               `json:"exit_code"`
+	CPUTimeMS   int               `json:"cpu_time_ms"`
+	MaxMemoryKB int               `json:"max_memory_kb"`
+	// Score is the aggregated score of scored questions
+	Score *float64 `json:"score,omitempty"`
 }
\ No newline at end of file
@@ -0,0 +1,75 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Upper bounds of the limits of a question.
+const (
+	MaxTimeMS      = 10 * 60 * 1000
+	MaxOutputBytes = 16 << 20
+	maxMultiplier  = 100
+)
+
+// Limits override the time, memory and output limits of the engine for
+// the runs of a question. Zero values keep the defaults of the engine.
+type Limits struct {
+	TimeMS int `json:"time_ms,omitempty"`
+	// Memory is a size like 256M
+	Memory      string `json:"memory,omitempty"`
+	StdoutBytes int    `json:"stdout_bytes,omitempty"`
+	StderrBytes int    `json:"stderr_bytes,omitempty"`
+	// Multipliers scale time and memory by spec key, e.g. for slow runtimes
+	Multipliers map[string]float64 `json:"multipliers,omitempty"`
+}
+
+// Validate checks the limits against their bounds.
+func (l Limits) Validate() error {
+	if l.TimeMS < 0 || l.TimeMS > MaxTimeMS {
+		return fmt.Errorf("time limit has to be between 0 and %d ms", MaxTimeMS)
+	}
+	if l.Memory != "" {
+		if n, err := ParseMemory(l.Memory); err != nil || n <= 0 {
+			return fmt.Errorf("invalid memory limit %q", l.Memory)
+		}
+	}
+	if l.StdoutBytes < 0 || l.StdoutBytes > MaxOutputBytes || l.StderrBytes < 0 || l.StderrBytes > MaxOutputBytes {
+		return fmt.Errorf("output limits have to be between 0 and %d bytes", MaxOutputBytes)
+	}
+	for lang, m := range l.Multipliers {
+		if m <= 0 || m > maxMultiplier {
+			return fmt.Errorf("multiplier of %s has to be above 0 and at most %d", lang, maxMultiplier)
+		}
+	}
+	return nil
+}
+
+// Multiplier returns the multiplier of the language, 1 if it has none.
+func (l Limits) Multiplier(lang string) float64 {
+	if m, ok := l.Multipliers[lang]; ok {
+		return m
+	}
+	return 1
+}
+
+// ParseMemory converts a memory limit like "100M", "1G" or "512k" to bytes.
+func ParseMemory(v string) (int64, error) {
+	v = strings.TrimSpace(strings.ToUpper(v))
+	v = strings.TrimSuffix(v, "B")
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(v, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(v, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(v, "G"):
+		mult = 1 << 30
+	}
+	n, err := strconv.ParseInt(strings.TrimRight(v, "KMG"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory limit %q", v)
+	}
+	return n * mult, nil
+}
@@ -0,0 +1,166 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Formats of the test reports of a project.
+const (
+	ReportJUnit = "junit"
+	ReportTAP   = "tap"
+	// ReportLibtest is the plain output of Rust's test harness
+	ReportLibtest = "libtest"
+)
+
+// ReportDir in the test command and the reports of a project stands for a
+// directory of a random name chosen for each run. Reports written there
+// cannot be submitted along with the project. Code running in the tests can
+// still rewrite them, which is why the framework files stay under the
+// control of the instructor.
+const ReportDir = "{report_dir}"
+
+// Project grades a whole repository submitted as files. Instead of the
+// driver, the test command of the project runs and its reports are parsed
+// into per-test results.
+type Project struct {
+	// BuildSystem is one of make, maven, gradle, npm, cargo or pytest and
+	// provides defaults for the other fields. It may be empty if they are set.
+	BuildSystem string `json:"build_system,omitempty"`
+	// TestCommand is run by the shell in the root of the project
+	TestCommand string `json:"test_command,omitempty"`
+	// Reports are glob patterns of the report files, relative to the root.
+	// Submitted files matching them are dropped before the run. Without
+	// reports, the output of the test command is parsed.
+	Reports      []string `json:"reports,omitempty"`
+	ReportFormat string   `json:"report_format,omitempty"`
+	// Files of the instructor, e.g. hidden tests, replace the submitted ones
+	Files map[string]string `json:"files,omitempty"`
+	// FrameworkFiles are glob patterns of files which configure or extend
+	// the test framework, e.g. conftest.py or build.rs. Patterns without a
+	// slash match the base name at any depth. Submissions containing such a
+	// file are rejected unless the instructor provides it in Files.
+	FrameworkFiles []string `json:"framework_files,omitempty"`
+	// ExpectedTests are the names of the tests as reported, and MinTests the
+	// number of tests, the reports have to contain. Missing tests fail the
+	// run, so tests cannot pass by being left out of the reports.
+	ExpectedTests []string `json:"expected_tests,omitempty"`
+	MinTests      int      `json:"min_tests,omitempty"`
+}
+
+var buildSystems = map[string]Project{
+	"make": {
+		TestCommand: "make test", ReportFormat: ReportTAP,
+		FrameworkFiles: []string{"Makefile", "makefile", "GNUmakefile", "*.mk"},
+	},
+	"maven": {
+		TestCommand: "mvn -B test", ReportFormat: ReportJUnit, Reports: []string{"target/surefire-reports/TEST-*.xml"},
+		FrameworkFiles: []string{"pom.xml", ".mvn/*", "junit-platform.properties", "META-INF/services/*"},
+	},
+	"gradle": {
+		TestCommand: "gradle test --no-daemon", ReportFormat: ReportJUnit, Reports: []string{"build/test-results/test/TEST-*.xml"},
+		FrameworkFiles: []string{"*.gradle", "*.gradle.kts", "gradle.properties", "buildSrc/*", "gradle/*", "junit-platform.properties", "META-INF/services/*"},
+	},
+	"npm": {
+		TestCommand: "npm test", ReportFormat: ReportTAP,
+		FrameworkFiles: []string{"package.json", ".npmrc", "jest.config.*", ".mocharc.*", ".taprc", "node_modules/*"},
+	},
+	"cargo": {
+		TestCommand: "cargo test", ReportFormat: ReportLibtest,
+		FrameworkFiles: []string{"Cargo.toml", "build.rs", ".cargo/*"},
+	},
+	"pytest": {
+		TestCommand: "python3 -m pytest --junitxml=" + ReportDir + "/report.xml", ReportFormat: ReportJUnit, Reports: []string{ReportDir + "/report.xml"},
+		FrameworkFiles: []string{"conftest.py", "pytest.ini", "pyproject.toml", "setup.cfg", "tox.ini", "sitecustomize.py", "usercustomize.py", "*.pth"},
+	},
+}
+
+// WithDefaults fills the fields left empty from the defaults of the build
+// system.
+func (p Project) WithDefaults() Project {
+	d := buildSystems[p.BuildSystem]
+	if p.TestCommand == "" {
+		p.TestCommand = d.TestCommand
+	}
+	if p.ReportFormat == "" {
+		p.ReportFormat = d.ReportFormat
+	}
+	if p.Reports == nil {
+		p.Reports = d.Reports
+	}
+	if p.FrameworkFiles == nil {
+		p.FrameworkFiles = d.FrameworkFiles
+	}
+	return p
+}
+
+// SubmittedFrameworkFile returns the first of the submitted files which
+// configures the test framework and is not provided by the instructor.
+func (p Project) SubmittedFrameworkFile(files map[string]string) (string, bool) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := p.Files[name]; ok {
+			continue
+		}
+		for _, pattern := range p.FrameworkFiles {
+			if matchFrameworkFile(pattern, name) {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// matchFrameworkFile matches patterns without a slash against the base name
+// and patterns ending in /* against everything below the directory.
+func matchFrameworkFile(pattern, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(name))
+		return ok
+	}
+	if dir, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return name == dir || strings.HasPrefix(name, dir+"/") || strings.Contains(name, "/"+dir+"/")
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// Validate checks that the project can be run and its reports be parsed.
+func (p Project) Validate() error {
+	if _, ok := buildSystems[p.BuildSystem]; p.BuildSystem != "" && !ok {
+		return fmt.Errorf("unsupported build system %q", p.BuildSystem)
+	}
+	p = p.WithDefaults()
+	if p.TestCommand == "" {
+		return errors.New("a build system or test command is required")
+	}
+	switch p.ReportFormat {
+	case ReportJUnit, ReportTAP, ReportLibtest:
+	default:
+		return fmt.Errorf("unsupported report format %q", p.ReportFormat)
+	}
+	if p.ReportFormat == ReportJUnit && len(p.Reports) == 0 {
+		return errors.New("junit reports need report paths")
+	}
+	if p.MinTests < 0 {
+		return errors.New("min_tests must not be negative")
+	}
+	for _, pattern := range p.FrameworkFiles {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid framework file pattern %q", pattern)
+		}
+	}
+	for name := range p.Files {
+		if err := ValidatePath(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Aggregations of the scores of the test cases.
+const (
+	AggregateSum     = "sum"
+	AggregateAverage = "average"
+	AggregateMin     = "min"
+)
+
+// Scoring turns a question into an optimization problem. Instead of
+// comparing the output of every test case with the expected one, a scorer
+// program rates it with a number.
+//
+// The scorer runs in a sandbox of its own per test case, with the files
+// input.txt, output.txt and answer.txt holding the input, the output of the
+// submission and the expected output of the test case. It accepts the output
+// by printing the score as the first line of its stdout and exiting with 0.
+// Exiting with 1 rejects the output, the rest of the output is shown as the
+// message. Any other exit code is an error of the judge.
+type Scoring struct {
+	Scorer string `json:"scorer"`
+	// ScorerLang is the spec the scorer runs in
+	ScorerLang string `json:"scorer_lang"`
+	// OutputOnly questions are answered with an output file per test case,
+	// named <test case id>.out, instead of code.
+	OutputOnly bool `json:"output_only,omitempty"`
+	// Aggregate is one of sum (default), average or min
+	Aggregate string `json:"aggregate,omitempty"`
+	// Minimize makes lower scores better
+	Minimize bool `json:"minimize,omitempty"`
+	// Normalize divides the score of every test case by the best known one
+	// of the test case, or the other way around if minimizing, so each is
+	// worth at most 1. Rejected outputs are worth 0.
+	Normalize bool `json:"normalize,omitempty"`
+}
+
+// OutputFile is the name of the submitted output of an output-only test case.
+func OutputFile(testCaseID string) string {
+	return testCaseID + ".out"
+}
+
+// Validate checks the scorer and that every test case has a best known
+// score if scores are normalized.
+func (s Scoring) Validate(tests []TestCase) error {
+	if strings.TrimSpace(s.Scorer) == "" || s.ScorerLang == "" {
+		return errors.New("scoring needs a scorer and its language")
+	}
+	switch s.Aggregate {
+	case "", AggregateSum, AggregateAverage, AggregateMin:
+	default:
+		return fmt.Errorf("unsupported aggregation %q", s.Aggregate)
+	}
+	// rejected outputs are worth 0, which would be the best raw score
+	if s.Minimize && !s.Normalize {
+		return errors.New("minimized scores have to be normalized")
+	}
+	if len(tests) == 0 {
+		return errors.New("scoring needs test cases")
+	}
+	seen := make(map[string]bool, len(tests))
+	for _, t := range tests {
+		if s.OutputOnly {
+			if err := ValidatePath(OutputFile(t.ID)); err != nil || strings.Contains(t.ID, "/") {
+				return fmt.Errorf("test case id %q can not name an output file", t.ID)
+			}
+		}
+		if seen[t.ID] {
+			return fmt.Errorf("duplicate test case id %q", t.ID)
+		}
+		seen[t.ID] = true
+		if s.Normalize && t.BestScore == nil {
+			return fmt.Errorf("test case %s needs a best known score", t.ID)
+		}
+	}
+	return nil
+}
+
+// Normalized returns score relative to the best known score, at most 1.
+func (s Scoring) Normalized(score, best float64) float64 {
+	var r float64
+	switch {
+	case !s.Minimize && score >= best, s.Minimize && score <= best:
+		return 1
+	case !s.Minimize && best > 0:
+		r = score / best
+	case s.Minimize && score > 0:
+		r = best / score
+	}
+	if r < 0 {
+		return 0
+	}
+	return r
+}
+
+// Total aggregates the scores of the test cases.
+func (s Scoring) Total(scores []float64) float64 {
+	if len(scores) == 0 {
+		return 0
+	}
+	total := 0.0
+	for i, v := range scores {
+		switch {
+		case s.Aggregate == AggregateMin:
+			if i == 0 || v < total {
+				total = v
+			}
+		default:
+			total += v
+		}
+	}
+	if s.Aggregate == AggregateAverage {
+		total /= float64(len(scores))
+	}
+	return total
+}
@@ -0,0 +1,176 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Base types of signatures. Any type may be made an array by appending [],
+// e.g. int[][]. Trees are binary trees of ints encoded as level-order
+// arrays with null for missing children, lists are linked lists of ints
+// encoded as arrays.
+const (
+	TypeInt    = "int"
+	TypeFloat  = "float"
+	TypeString = "string"
+	TypeBool   = "bool"
+	TypeTree   = "TreeNode"
+	TypeList   = "ListNode"
+)
+
+var identRx = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Signature declares the function a solution implements. The arguments of
+// the test cases are passed to it as native values of the language and its
+// return value is compared with the expected output as JSON.
+type Signature struct {
+	Function string  `json:"function"`
+	Params   []Param `json:"params"`
+	Returns  string  `json:"returns"`
+}
+
+type Param struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// ElemType returns the element type of an array type.
+func ElemType(t string) (string, bool) {
+	return strings.CutSuffix(t, "[]")
+}
+
+// ValidType reports whether t is a base type followed by any number of [].
+func ValidType(t string) bool {
+	for {
+		elem, ok := ElemType(t)
+		if !ok {
+			break
+		}
+		t = elem
+	}
+	switch t {
+	case TypeInt, TypeFloat, TypeString, TypeBool, TypeTree, TypeList:
+		return true
+	}
+	return false
+}
+
+// Validate checks the signature and that the arguments and expected outputs
+// of the test cases match its types.
+func (s Signature) Validate(tests []TestCase) error {
+	if !identRx.MatchString(s.Function) {
+		return fmt.Errorf("invalid function name %q", s.Function)
+	}
+	seen := make(map[string]bool, len(s.Params))
+	for _, p := range s.Params {
+		if !identRx.MatchString(p.Name) || seen[p.Name] {
+			return fmt.Errorf("invalid or duplicate parameter name %q", p.Name)
+		}
+		seen[p.Name] = true
+		if !ValidType(p.Type) {
+			return fmt.Errorf("unsupported type %q of parameter %s", p.Type, p.Name)
+		}
+	}
+	if !ValidType(s.Returns) {
+		return fmt.Errorf("unsupported return type %q", s.Returns)
+	}
+
+	for _, t := range tests {
+		if err := s.CheckArgs(t.Args); err != nil {
+			return fmt.Errorf("test case %s: %w", t.ID, err)
+		}
+		if t.ExpectedOutput == "" || t.ExpectedOutput == "__GENERATE__" {
+			continue
+		}
+		if err := checkJSON(s.Returns, json.RawMessage(t.ExpectedOutput)); err != nil {
+			return fmt.Errorf("test case %s: expected output: %w", t.ID, err)
+		}
+	}
+	return nil
+}
+
+// CheckArgs checks that args holds a value of the type of every parameter.
+func (s Signature) CheckArgs(args []json.RawMessage) error {
+	if len(args) != len(s.Params) {
+		return fmt.Errorf("expected %d arguments, got %d", len(s.Params), len(args))
+	}
+	for i, p := range s.Params {
+		if err := checkJSON(p.Type, args[i]); err != nil {
+			return fmt.Errorf("argument %s: %w", p.Name, err)
+		}
+	}
+	return nil
+}
+
+func checkJSON(t string, raw json.RawMessage) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return errors.New("invalid JSON")
+	}
+	if dec.More() {
+		return errors.New("invalid JSON")
+	}
+	return checkValue(t, v)
+}
+
+func checkValue(t string, v interface{}) error {
+	if elem, ok := ElemType(t); ok {
+		arr, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("expected an array of %s", elem)
+		}
+		for _, e := range arr {
+			if err := checkValue(elem, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	switch t {
+	case TypeInt:
+		if n, ok := v.(json.Number); ok {
+			if _, err := n.Int64(); err == nil {
+				return nil
+			}
+		}
+	case TypeFloat:
+		if _, ok := v.(json.Number); ok {
+			return nil
+		}
+	case TypeString:
+		if _, ok := v.(string); ok {
+			return nil
+		}
+	case TypeBool:
+		if _, ok := v.(bool); ok {
+			return nil
+		}
+	case TypeTree, TypeList:
+		// null is the empty tree or list
+		if v == nil {
+			return nil
+		}
+		arr, ok := v.([]interface{})
+		if !ok {
+			break
+		}
+		for i, e := range arr {
+			// only trees have missing nodes, but never as the root
+			if e == nil && t == TypeTree && i > 0 {
+				continue
+			}
+			if err := checkValue(TypeInt, e); err != nil {
+				return fmt.Errorf("expected a %s as an array of int", t)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("expected %s", t)
+}
@@ -1,5 +1,18 @@
 package models
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+const (
+	BackendDocker = "docker"
+	BackendNative = "native"
+	// BackendWasm runs a WASI module, the spec image is its path or URL
+	BackendWasm = "wasm"
+)
+
 type Spec struct {
 	Image      string `json:"image" yaml:"image"`
 	Entrypoint string `json:"entrypoint" yaml:"entrypoint"`
@@ -7,6 +20,104 @@ type Spec struct {
 	Cmd        string `json:"cmd" yaml:"cmd"`
 	Language   string `json:"language" yaml:"language"`
 	Use        string `json:"use" yaml:"use"`
+	// Backend selects the sandbox provider running this language, defaults to docker
+	Backend string `json:"backend,omitempty" yaml:"backend"`
+	// Digest pins the image, e.g. "sha256:...". Runs fail instead of using
+	// an image with different content.
+	Digest string `json:"digest,omitempty" yaml:"digest"`
+	// Build derives the image the language runs in from Image, e.g. to add
+	// packages. Only the docker backend builds images.
+	Build *ImageBuild `json:"build,omitempty" yaml:"build"`
+}
+
+// ImageBuild lists what is added on top of the spec image.
+type ImageBuild struct {
+	// Apt packages are installed with apt-get, or apk on Alpine images
+	Apt []string `json:"apt,omitempty" yaml:"apt"`
+	Pip []string `json:"pip,omitempty" yaml:"pip"`
+	// Npm packages are installed globally and resolvable with require
+	Npm []string `json:"npm,omitempty" yaml:"npm"`
+	// Dockerfile is appended to the generated instructions
+	Dockerfile string `json:"dockerfile,omitempty" yaml:"dockerfile"`
+}
+
+// BaseRef returns the spec image pinned to the configured digest.
+func (s Spec) BaseRef() string {
+	if s.Digest == "" || strings.Contains(s.Image, "@") {
+		return s.Image
+	}
+	return s.Image + "@" + s.Digest
+}
+
+// ImageRef returns the image sandboxes of the spec run in. Built images are
+// tagged with the hash of their Dockerfile, so changing the build yields a
+// new tag.
+func (s Spec) ImageRef() string {
+	if s.Build == nil {
+		return s.BaseRef()
+	}
+	sum := sha256.Sum256([]byte(s.Dockerfile()))
+	return "code-runner/" + imageName(s.Language) + ":" + hex.EncodeToString(sum[:])[:16]
+}
+
+// Dockerfile returns the Dockerfile building the spec image, or an empty
+// string if the spec uses Image as is.
+func (s Spec) Dockerfile() string {
+	if s.Build == nil {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("FROM " + s.BaseRef() + "\n")
+	if pkgs := quoteAll(s.Build.Apt); pkgs != "" {
+		b.WriteString("RUN if command -v apt-get >/dev/null; then apt-get update && apt-get install -y --no-install-recommends " + pkgs +
+			" && rm -rf /var/lib/apt/lists/*; else apk add --no-cache " + pkgs + "; fi\n")
+	}
+	if pkgs := quoteAll(s.Build.Pip); pkgs != "" {
+		b.WriteString("RUN pip install --no-cache-dir " + pkgs + "\n")
+	}
+	if pkgs := quoteAll(s.Build.Npm); pkgs != "" {
+		b.WriteString("RUN npm install -g " + pkgs + " && npm cache clean --force\n")
+		b.WriteString("ENV NODE_PATH=/usr/local/lib/node_modules\n")
+	}
+	if d := strings.TrimSpace(s.Build.Dockerfile); d != "" {
+		b.WriteString(d + "\n")
+	}
+	return b.String()
+}
+
+// quoteAll single quotes package names for the shell.
+func quoteAll(pkgs []string) string {
+	quoted := make([]string, 0, len(pkgs))
+	for _, p := range pkgs {
+		if p = strings.TrimSpace(p); p != "" {
+			quoted = append(quoted, "'"+strings.ReplaceAll(p, "'", `'\''`)+"'")
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// imageName turns a language into a valid repository name component.
+func imageName(lang string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, lang)
+	if name = strings.Trim(name, "-_."); name == "" {
+		return "custom"
+	}
+	return name
+}
+
+func (s Spec) GetBackend() string {
+	if s.Backend == "" {
+		return BackendDocker
+	}
+	return s.Backend
 }
 
 type SpecMap map[string]*Spec